@@ -0,0 +1,345 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrAdminInvalidState = newError("admin.invalid_state", KindFailedPrecondition)
+var ErrAdminUnauthorized = newError("admin.unauthorized", KindUnauthenticated)
+
+// Disable desativa a chave ativa id: os códigos deixam de ser aceitos até Enable.
+func (v *Verifier) Disable(id, actor string, t time.Time) error {
+	return v.admin(AuditDisable, id, actor, t, func(rec *KeyRecord) error {
+		if rec.State != KeyActive {
+			return ErrAdminInvalidState
+		}
+		rec.State = KeyDisabled
+		return nil
+	})
+}
+
+// Enable reativa uma chave desativada por Disable.
+func (v *Verifier) Enable(id, actor string, t time.Time) error {
+	return v.admin(AuditEnable, id, actor, t, func(rec *KeyRecord) error {
+		if rec.State != KeyDisabled {
+			return ErrAdminInvalidState
+		}
+		rec.State = KeyActive
+		return nil
+	})
+}
+
+// ForceReenroll invalida a chave id e os dispositivos confiáveis. A chave
+// deixa de ser aceita e o próximo BeginTOTP ou BeginHOTP da conta a substitui.
+func (v *Verifier) ForceReenroll(id, actor string, t time.Time) error {
+	return v.admin(AuditReenroll, id, actor, t, func(rec *KeyRecord) error {
+		if rec.State != KeyActive && rec.State != KeyDisabled {
+			return ErrAdminInvalidState
+		}
+		rec.State = KeyReenroll
+		rec.NextURL, rec.NextCounter, rec.GraceUntil = "", 0, time.Time{}
+		rec.Devices = nil
+		rec.Challenge = nil
+		return nil
+	})
+}
+
+// Unlock encerra o bloqueio por tentativas da conta id, inclusive o dos
+// códigos de recuperação e o do estado compartilhado.
+func (v *Verifier) Unlock(id, actor string, t time.Time) error {
+	err := v.store.Update(id, func(rec *KeyRecord) error {
+		rec.Throttle.Reset()
+		if rec.Recovery != nil {
+			rec.Recovery.Throttle.Reset()
+		}
+		return nil
+	})
+	if err == nil && v.shared != nil {
+		err = v.shared.Reset(id)
+	}
+	v.audit.Record(AuditEntry{Time: t, Event: AuditUnlock, Account: id, Actor: actor, Success: err == nil, Error: auditError(err)})
+	return err
+}
+
+// admin aplica fn ao registro id e registra a ação de actor na auditoria.
+func (v *Verifier) admin(event AuditEvent, id, actor string, t time.Time, fn func(rec *KeyRecord) error) error {
+	err := v.store.Update(id, fn)
+	v.audit.Record(AuditEntry{Time: t, Event: event, Account: id, Actor: actor, Success: err == nil, Error: auditError(err)})
+	return err
+}
+
+// KeyInfo são os metadados de uma chave, sem o segredo.
+type KeyInfo struct {
+	ID            string     `json:"id"`
+	Issuer        string     `json:"issuer"`
+	Account       string     `json:"account"`
+	Type          string     `json:"type"`
+	Algorithm     string     `json:"algorithm"`
+	Digits        int        `json:"digits"`
+	Period        uint64     `json:"period,omitempty"` // apenas TOTP
+	State         KeyState   `json:"state"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	ActivatedAt   *time.Time `json:"activated_at,omitempty"`
+	LastUsedAt    *time.Time `json:"last_used_at,omitempty"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+	Failures      uint       `json:"failures"`
+	Rotating      bool       `json:"rotating"`
+	RecoveryCodes int        `json:"recovery_codes"`
+	Devices       int        `json:"devices"`
+}
+
+// NewKeyInfo extrai os metadados de rec.
+func NewKeyInfo(rec *KeyRecord) (KeyInfo, error) {
+	k, err := rec.Key()
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	info := KeyInfo{
+		ID:          rec.ID,
+		Issuer:      k.Issuer(),
+		Account:     k.AccountName(),
+		Type:        k.Type(),
+		Algorithm:   k.Algorithm().String(),
+		Digits:      k.Digits().Length(),
+		State:       rec.State,
+		CreatedAt:   optionalTime(rec.CreatedAt),
+		ExpiresAt:   optionalTime(rec.ExpiresAt),
+		ActivatedAt: optionalTime(rec.ActivatedAt),
+		LastUsedAt:  optionalTime(rec.LastUsedAt),
+		LockedUntil: optionalTime(rec.Throttle.LockedUntil),
+		Failures:    rec.Throttle.Failures,
+		Rotating:    rec.NextURL != "",
+		Devices:     len(rec.Devices),
+	}
+	if info.Type == "totp" {
+		info.Period = k.Period()
+	}
+	if rec.Recovery != nil {
+		info.RecoveryCodes = rec.Recovery.Remaining()
+	}
+	return info, nil
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// AdminOtp fornece opções para AdminAPI.
+type AdminOtp struct {
+	// Auth autentica a requisição e retorna o administrador, registrado como
+	// Actor na auditoria. Obrigatório, ver AdminTokens.
+	Auth     func(r *http.Request) (string, error)
+	MaxLimit int       // Maior página aceita. O padrão é 500.
+	Webhooks *Webhooks // Se definido, sua API fica em /webhooks/ com a mesma autenticação.
+}
+
+func (o AdminOtp) defaults() AdminOtp {
+	if o.MaxLimit == 0 {
+		o.MaxLimit = 500
+	}
+	return o
+}
+
+// AdminTokens autentica por "Authorization: Bearer <token>", com tokens
+// mapeados para o nome do administrador.
+func AdminTokens(tokens map[string]string) func(r *http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		actor := bearerActor(tokens, r.Header.Get("Authorization"))
+		if actor == "" {
+			return "", ErrAdminUnauthorized
+		}
+		return actor, nil
+	}
+}
+
+// bearerActor retorna o nome associado ao token de "Bearer <token>", ou vazio.
+func bearerActor(tokens map[string]string, header string) string {
+	got, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || got == "" {
+		return ""
+	}
+	actor := ""
+	for token, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			actor = name
+		}
+	}
+	return actor
+}
+
+// AdminAPI é a API REST de administração das chaves para o suporte. Todas as
+// ações, inclusive consultas e listagens, são auditadas com o administrador
+// como Actor. IDs vão no caminho com escape de URL ("Brisa:ana%40example.com").
+//
+//	GET    /keys?issuer=&state=&after=&limit=  lista, {"keys": [...], "next": cursor}
+//	GET    /keys/{id}                          metadados (KeyInfo)
+//	DELETE /keys/{id}                          remove
+//	POST   /keys/{id}/disable                  desativa
+//	POST   /keys/{id}/enable                   reativa
+//	POST   /keys/{id}/reenroll                 exige novo cadastro
+//	POST   /keys/{id}/unlock                   encerra o bloqueio por tentativas
+//
+//	mux.Handle("/admin/", http.StripPrefix("/admin", app.NewAdminAPI(verifier, opts)))
+type AdminAPI struct {
+	verify *Verifier
+	otp    AdminOtp
+	now    func() time.Time
+}
+
+func NewAdminAPI(verify *Verifier, otp AdminOtp) *AdminAPI {
+	return &AdminAPI{verify: verify, otp: otp.defaults(), now: time.Now}
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lang := r.Header.Get("Accept-Language")
+	fail := func(err error) {
+		http.Error(w, Localize(err, lang), HTTPStatus(err))
+	}
+	if a.otp.Auth == nil {
+		fail(ErrAdminUnauthorized)
+		return
+	}
+	actor, err := a.otp.Auth(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/webhooks/") && a.otp.Webhooks != nil {
+		http.StripPrefix("/webhooks", a.otp.Webhooks).ServeHTTP(w, r)
+		return
+	}
+	path := r.URL.EscapedPath()
+	if path == "/keys" || path == "/keys/" {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		a.list(w, r, actor)
+		return
+	}
+	rest, ok := strings.CutPrefix(path, "/keys/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	escaped, action, _ := strings.Cut(rest, "/")
+	id, err := url.PathUnescape(escaped)
+	if err != nil || id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	t := a.now()
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		rec, err := a.verify.store.Get(id)
+		a.verify.audit.Record(AuditEntry{Time: t, Event: AuditView, Account: id, Actor: actor, Success: err == nil, Error: auditError(err)})
+		if err != nil {
+			fail(err)
+			return
+		}
+		a.reply(w, rec)
+		return
+	case action == "" && r.Method == http.MethodDelete:
+		if err := a.verify.Delete(id, actor, t); err != nil {
+			fail(err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case action != "" && r.Method != http.MethodPost:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var op func(id, actor string, t time.Time) error
+	switch action {
+	case "disable":
+		op = a.verify.Disable
+	case "enable":
+		op = a.verify.Enable
+	case "reenroll":
+		op = a.verify.ForceReenroll
+	case "unlock":
+		op = a.verify.Unlock
+	case "":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err := op(id, actor, t); err != nil {
+		fail(err)
+		return
+	}
+	rec, err := a.verify.store.Get(id)
+	if err != nil {
+		fail(err)
+		return
+	}
+	a.reply(w, rec)
+}
+
+func (a *AdminAPI) list(w http.ResponseWriter, r *http.Request, actor string) {
+	q := r.URL.Query()
+	f := KeyFilter{Issuer: q.Get("issuer"), State: KeyState(q.Get("state")), After: q.Get("after")}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		f.Limit = min(n, a.otp.MaxLimit)
+	}
+	recs, next, err := ListKeys(a.verify.store, f)
+	filter := url.Values{}
+	for k, v := range map[string]string{"issuer": f.Issuer, "state": string(f.State), "after": f.After} {
+		if v != "" {
+			filter.Set(k, v)
+		}
+	}
+	if f.Limit > 0 {
+		filter.Set("limit", strconv.Itoa(f.Limit))
+	}
+	a.verify.audit.Record(AuditEntry{Time: a.now(), Event: AuditList, Actor: actor, Success: err == nil, Error: auditError(err), Filter: filter.Encode()})
+	if err != nil {
+		http.Error(w, Localize(err, r.Header.Get("Accept-Language")), HTTPStatus(err))
+		return
+	}
+	out := struct {
+		Keys []KeyInfo `json:"keys"`
+		Next string    `json:"next,omitempty"`
+	}{Keys: []KeyInfo{}, Next: next}
+	for _, rec := range recs {
+		info, err := NewKeyInfo(rec)
+		if err != nil {
+			http.Error(w, Localize(err, r.Header.Get("Accept-Language")), HTTPStatus(err))
+			return
+		}
+		out.Keys = append(out.Keys, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (a *AdminAPI) reply(w http.ResponseWriter, rec *KeyRecord) {
+	info, err := NewKeyInfo(rec)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	var entries []AuditEntry
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 2}})
+	v.UseAuditor(NewAuditor(AuditCallback(func(e AuditEntry) { entries = append(entries, e) })))
+	secret := "JBSWY3DPEHPK3PXP"
+	ana := newActiveRecord(t, s, "otpauth://totp/Brisa:ana@example.com?secret="+secret+"&issuer=Brisa&digits=8&algorithm=SHA256")
+	newActiveRecord(t, s, "otpauth://hotp/Brisa:bia?secret="+secret+"&issuer=Brisa&counter=0")
+	newActiveRecord(t, s, "otpauth://totp/Outro:caio?secret="+secret+"&issuer=Outro")
+	now := time.Unix(1700000000, 0).UTC()
+	require.NoError(t, s.Update(ana, func(rec *KeyRecord) error {
+		rec.CreatedAt, rec.LastUsedAt = now.Add(-time.Hour), now.Add(-time.Minute)
+		return nil
+	}))
+
+	webhooks, err := OpenWebhooks(filepath.Join(t.TempDir(), "webhooks.db"), WebhookOtp{})
+	require.NoError(t, err)
+	defer webhooks.Close()
+	api := NewAdminAPI(v, AdminOtp{Auth: AdminTokens(map[string]string{"tok": "suporte"}), Webhooks: webhooks})
+	api.now = func() time.Time { return now }
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+	keyPath := "/keys/" + url.PathEscape(ana)
+
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/keys", "").Code)
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/keys", "errado").Code)
+
+	// Listagem por emissor, paginada.
+	var page struct {
+		Keys []KeyInfo
+		Next string
+	}
+	w := do("GET", "/keys?issuer=Brisa&limit=1", "tok")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Keys, 1)
+	require.Equal(t, ana, page.Keys[0].ID)
+	require.Equal(t, ana, page.Next)
+	w = do("GET", "/keys?issuer=Brisa&limit=1&after="+url.QueryEscape(page.Next), "tok")
+	page.Keys, page.Next = nil, ""
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, "Brisa:bia", page.Keys[0].ID)
+	require.Equal(t, "hotp", page.Keys[0].Type)
+	require.Zero(t, page.Keys[0].Period)
+	require.Empty(t, page.Next)
+	require.Equal(t, http.StatusBadRequest, do("GET", "/keys?limit=x", "tok").Code)
+
+	// Metadados sem o segredo.
+	w = do("GET", keyPath, "tok")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), secret)
+	var info KeyInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	require.Equal(t, KeyInfo{
+		ID: ana, Issuer: "Brisa", Account: "ana@example.com", Type: "totp", Algorithm: "SHA256",
+		Digits: 8, Period: 30, State: KeyActive, CreatedAt: optionalTime(now.Add(-time.Hour)),
+		LastUsedAt: optionalTime(now.Add(-time.Minute)),
+	}, info)
+	require.Equal(t, http.StatusNotFound, do("GET", "/keys/Brisa:ninguem", "tok").Code)
+
+	// Desbloqueio.
+	for i := 0; i < 2; i++ {
+		_, err := v.Verify(ana, "00000000", now)
+		require.ErrorIs(t, err, ErrValidateInvalidCode)
+	}
+	_, err = v.Verify(ana, "00000000", now)
+	require.ErrorIs(t, err, ErrValidateThrottled)
+	w = do("POST", keyPath+"/unlock", "tok")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	require.Nil(t, info.LockedUntil)
+	_, err = v.Verify(ana, "00000000", now)
+	require.ErrorIs(t, err, ErrValidateInvalidCode, "Desbloqueada")
+
+	// Desativar e reativar. Nenhum método aceita a conta desativada.
+	push := NewPush(v, PushOtp{})
+	channel, err := NewChannel(s, &captureSender{}, ChannelOtp{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, do("POST", keyPath+"/disable", "tok").Code)
+	_, err = v.Verify(ana, "00000000", now)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+	_, err = push.Begin(ana, "", now)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+	require.ErrorIs(t, channel.Send(context.Background(), ana, "ana@example.com", now), ErrKeyNotActive)
+	_, err = channel.Verify(ana, "00000000", now)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+	require.Equal(t, http.StatusForbidden, do("POST", keyPath+"/disable", "tok").Code)
+	require.Equal(t, http.StatusOK, do("POST", keyPath+"/enable", "tok").Code)
+	require.Equal(t, http.StatusForbidden, do("POST", keyPath+"/enable", "tok").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, do("GET", keyPath+"/enable", "tok").Code)
+	require.Equal(t, http.StatusNotFound, do("POST", keyPath+"/formatar", "tok").Code)
+
+	// Novo cadastro obrigatório.
+	e := NewEnrollment(s, EnrollOtp{})
+	_, err = e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "ana@example.com"}, now)
+	require.ErrorIs(t, err, ErrKeyExists)
+	w = do("POST", keyPath+"/reenroll", "tok")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	require.Equal(t, KeyReenroll, info.State)
+	_, err = v.Verify(ana, "00000000", now)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+	_, err = push.Begin(ana, "", now)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+	require.ErrorIs(t, channel.Send(context.Background(), ana, "ana@example.com", now), ErrKeyNotActive)
+	w = do("GET", "/keys?state=reenroll", "tok")
+	page.Keys = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Keys, 1)
+	_, err = e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "ana@example.com"}, now)
+	require.NoError(t, err, "A chave antiga é substituída")
+
+	require.Equal(t, http.StatusNoContent, do("DELETE", "/keys/Outro:caio", "tok").Code)
+	require.Equal(t, http.StatusNotFound, do("DELETE", "/keys/Outro:caio", "tok").Code)
+	require.Equal(t, http.StatusOK, do("GET", "/webhooks/subscriptions", "tok").Code)
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/webhooks/subscriptions", "").Code)
+
+	// Cada ação fica na auditoria com o administrador.
+	byAdmin := map[AuditEvent]int{}
+	var filters []string
+	for _, e := range entries {
+		if e.Actor == "suporte" {
+			byAdmin[e.Event]++
+		}
+		if e.Event == AuditList {
+			filters = append(filters, e.Filter)
+		}
+	}
+	require.Equal(t, map[AuditEvent]int{
+		AuditList: 3, AuditView: 2, AuditUnlock: 1, AuditDisable: 2, AuditEnable: 2, AuditReenroll: 1, AuditDelete: 2,
+	}, byAdmin)
+	require.Equal(t, []string{"issuer=Brisa&limit=1", "after=" + url.QueryEscape(ana) + "&issuer=Brisa&limit=1", "state=reenroll"}, filters)
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// AuditEvent identifica o tipo de um evento de auditoria.
+type AuditEvent string
+
+const (
+	AuditEnroll       AuditEvent = "enroll"
+	AuditConfirm      AuditEvent = "confirm"
+	AuditVerify       AuditEvent = "verify"
+	AuditLockout      AuditEvent = "lockout"
+	AuditRotate       AuditEvent = "rotate"
+	AuditDelete       AuditEvent = "delete"
+	AuditRecovery     AuditEvent = "recovery"
+	AuditResync       AuditEvent = "resync"
+	AuditDeviceTrust  AuditEvent = "device_trust"
+	AuditDeviceRevoke AuditEvent = "device_revoke"
+	AuditChallenge    AuditEvent = "challenge"
+	AuditPushBegin    AuditEvent = "push_begin"
+	AuditPushRespond  AuditEvent = "push_respond"
+	AuditDisable      AuditEvent = "disable"
+	AuditEnable       AuditEvent = "enable"
+	AuditReenroll     AuditEvent = "reenroll"
+	AuditUnlock       AuditEvent = "unlock"
+	AuditView         AuditEvent = "view" // consulta de um administrador
+	AuditList         AuditEvent = "list" // listagem de um administrador, com o filtro em Filter
+)
+
+// AuditEntry é um evento de auditoria. Não há campo para segredos ou códigos:
+// eles nunca são registrados.
+type AuditEntry struct {
+	Time    time.Time
+	Event   AuditEvent
+	Account string // ID da chave (issuer:account)
+	Actor   string // quem executou a ação, quando não é o próprio usuário
+	Success bool
+	Method  Method
+	Offset  int        // desvio em passos ou contadores de um código aceito
+	Secret  SecretSlot // segredo que validou o código durante uma rotação
+	Error   string     // código estável do erro, ver ErrorCode
+	Filter  string     // filtro de uma listagem (AuditList), como query string
+}
+
+// Auditor emite eventos de auditoria como JSON estruturado via log/slog.
+// Um Auditor nil descarta os eventos.
+type Auditor struct {
+	logger *slog.Logger
+}
+
+// NewAuditor cria um Auditor que envia cada evento a todos os handlers.
+func NewAuditor(handlers ...slog.Handler) *Auditor {
+	var h slog.Handler = multiHandler(handlers)
+	if len(handlers) == 1 {
+		h = handlers[0]
+	}
+	return &Auditor{logger: slog.New(h)}
+}
+
+// Record emite e. Falhas e bloqueios saem com nível Warn.
+func (a *Auditor) Record(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	attrs := []slog.Attr{
+		slog.String("event", string(e.Event)),
+		slog.String("account", e.Account),
+		slog.Bool("success", e.Success),
+	}
+	if e.Actor != "" {
+		attrs = append(attrs, slog.String("actor", e.Actor))
+	}
+	if e.Method != "" {
+		attrs = append(attrs, slog.String("method", string(e.Method)), slog.Int("offset", e.Offset))
+	}
+	if e.Secret != "" {
+		attrs = append(attrs, slog.String("secret_slot", string(e.Secret)))
+	}
+	if e.Error != "" {
+		attrs = append(attrs, slog.String("error", e.Error))
+	}
+	if e.Filter != "" {
+		attrs = append(attrs, slog.String("filter", e.Filter))
+	}
+
+	level := slog.LevelInfo
+	if !e.Success || e.Event == AuditLockout {
+		level = slog.LevelWarn
+	}
+	r := slog.NewRecord(e.Time, level, "otp audit", 0)
+	r.AddAttrs(attrs...)
+	a.logger.Handler().Handle(context.Background(), r)
+}
+
+// recordResult é um atalho para eventos que terminam em sucesso ou erro.
+func (a *Auditor) recordResult(event AuditEvent, account string, t time.Time, err error) {
+	a.Record(AuditEntry{Time: t, Event: event, Account: account, Success: err == nil, Error: auditError(err)})
+}
+
+func auditError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if c := ErrorCode(err); c != "" {
+		return c
+	}
+	return "internal"
+}
+
+// AuditFile é um destino de auditoria que acrescenta uma linha JSON por evento a um arquivo.
+type AuditFile struct {
+	slog.Handler
+	f *os.File
+}
+
+func OpenAuditFile(path string) (*AuditFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditFile{Handler: slog.NewJSONHandler(f, nil), f: f}, nil
+}
+
+func (a *AuditFile) Close() error {
+	return a.f.Close()
+}
+
+// AuditCallback retorna um handler que entrega cada evento a fn, por exemplo
+// para encaminhá-lo a outro sistema.
+func AuditCallback(fn func(AuditEntry)) slog.Handler {
+	return callbackHandler(fn)
+}
+
+type callbackHandler func(AuditEntry)
+
+func (h callbackHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h callbackHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h callbackHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h callbackHandler) Handle(_ context.Context, r slog.Record) error {
+	e := AuditEntry{Time: r.Time}
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "event":
+			e.Event = AuditEvent(a.Value.String())
+		case "account":
+			e.Account = a.Value.String()
+		case "actor":
+			e.Actor = a.Value.String()
+		case "success":
+			e.Success = a.Value.Bool()
+		case "method":
+			e.Method = Method(a.Value.String())
+		case "offset":
+			e.Offset = int(a.Value.Int64())
+		case "secret_slot":
+			e.Secret = SecretSlot(a.Value.String())
+		case "error":
+			e.Error = a.Value.String()
+		case "filter":
+			e.Filter = a.Value.String()
+		}
+		return true
+	})
+	h(e)
+	return nil
+}
+
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range m {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+
+package app
+
+import (
+	"log/slog"
+	"log/syslog"
+)
+
+// AuditSyslog é um destino de auditoria que envia cada evento em JSON ao syslog
+// com a facilidade LOG_AUTH.
+type AuditSyslog struct {
+	slog.Handler
+	w *syslog.Writer
+}
+
+// OpenAuditSyslog conecta ao syslog. Com network e raddr vazios usa o daemon local.
+func OpenAuditSyslog(network, raddr, tag string) (*AuditSyslog, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditSyslog{Handler: slog.NewJSONHandler(w, nil), w: w}, nil
+}
+
+func (a *AuditSyslog) Close() error {
+	return a.w.Close()
+}
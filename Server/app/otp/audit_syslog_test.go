@@ -0,0 +1,32 @@
+//go:build !windows && !plan9
+
+package app
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sink, err := OpenAuditSyslog("udp", conn.LocalAddr().String(), "otp")
+	require.NoError(t, err)
+	defer sink.Close()
+	NewAuditor(sink).Record(AuditEntry{Event: AuditEnroll, Account: "Brisa:a@b.com", Success: true})
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := string(buf[:n])
+	require.True(t, strings.HasPrefix(msg, "<38>"), "Facilidade LOG_AUTH com nível INFO")
+	require.Contains(t, msg, `"event":"enroll"`)
+	require.Contains(t, msg, `"account":"Brisa:a@b.com"`)
+}
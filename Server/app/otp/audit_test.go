@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditTrail(t *testing.T) {
+	var entries []AuditEntry
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := OpenAuditFile(path)
+	require.NoError(t, err)
+	a := NewAuditor(file, AuditCallback(func(e AuditEntry) { entries = append(entries, e) }))
+
+	s := NewMemoryStore()
+	e := NewEnrollment(s, EnrollOtp{})
+	e.UseAuditor(a)
+	v := NewVerifier(s, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 2}})
+	v.UseAuditor(a)
+
+	now := time.Unix(1700000000, 0).UTC()
+	k, err := e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "a@b.com"}, now)
+	require.NoError(t, err)
+	id := KeyID("Brisa", "a@b.com")
+	code, err := GenerateCodes(k.Secret(), now)
+	require.NoError(t, err)
+	_, err = e.Confirm(id, code, now)
+	require.NoError(t, err)
+
+	later := now.Add(30 * time.Second)
+	code, err = GenerateCodes(k.Secret(), later)
+	require.NoError(t, err)
+	_, err = v.Verify(id, code, later)
+	require.NoError(t, err)
+	_, err = v.Verify(id, "000000", later)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = v.Verify(id, "111111", later)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = v.Rotate(id, time.Hour, later)
+	require.NoError(t, err)
+	require.NoError(t, v.Delete(id, "admin@brisa", later))
+	require.NoError(t, file.Close())
+
+	var events []AuditEvent
+	for _, en := range entries {
+		events = append(events, en.Event)
+	}
+	require.Equal(t, []AuditEvent{AuditEnroll, AuditConfirm, AuditVerify, AuditVerify, AuditVerify, AuditLockout, AuditRotate, AuditDelete}, events)
+	require.True(t, entries[2].Success)
+	require.Equal(t, MethodTOTP, entries[2].Method)
+	require.Equal(t, SecretCurrent, entries[2].Secret)
+	require.False(t, entries[3].Success)
+	require.Equal(t, "validate.invalid_code", entries[3].Error)
+	require.Equal(t, "admin@brisa", entries[7].Actor)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), k.Secret(), "Segredos nunca aparecem na auditoria")
+	require.NotContains(t, string(data), code, "Códigos nunca aparecem na auditoria")
+
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	n := 0
+	for sc.Scan() {
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &line), "Cada linha é um JSON")
+		require.Equal(t, "otp audit", line["msg"])
+		n++
+	}
+	require.Equal(t, 8, n)
+	require.Contains(t, string(data), `"event":"lockout"`)
+}
+
+func TestAuditVerifyRecovery(t *testing.T) {
+	var entries []AuditEntry
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{})
+	v.UseAuditor(NewAuditor(AuditCallback(func(e AuditEntry) { entries = append(entries, e) })))
+
+	rc, codes, err := GenerateRecoveryCodes(testRecoveryOtp)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(&KeyRecord{ID: "Brisa:a@b.com", State: KeyActive, Recovery: rc}))
+
+	require.NoError(t, v.VerifyRecovery("Brisa:a@b.com", codes[0], time.Now(), testRecoveryOtp))
+	require.Equal(t, ErrValidateInvalidCode, v.VerifyRecovery("Brisa:a@b.com", codes[0], time.Now(), testRecoveryOtp))
+	rec, err := s.Get("Brisa:a@b.com")
+	require.NoError(t, err)
+	require.Equal(t, 3, rec.Recovery.Remaining(), "Código consumido no registro")
+
+	require.Len(t, entries, 2)
+	require.Equal(t, AuditRecovery, entries[0].Event)
+	require.Equal(t, MethodRecovery, entries[0].Method)
+	require.False(t, entries[1].Success)
+}
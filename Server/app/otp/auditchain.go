@@ -0,0 +1,184 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// AuditChain é um destino de auditoria à prova de adulteração. Cada linha do
+// arquivo leva o hash da linha anterior e um HMAC sob a chave de auditoria, de
+// forma que VerifyAuditChain detecta qualquer alteração, remoção ou troca de
+// ordem. A remoção das últimas linhas só é detectada comparando com o último
+// hash conhecido, por isso ele é retornado por VerifyAuditChain.
+type AuditChain struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  []byte
+	seq  uint64
+	prev string
+}
+
+// auditLink é uma linha do arquivo encadeado.
+type auditLink struct {
+	Seq   uint64          `json:"seq"`
+	Prev  string          `json:"prev"`
+	Entry json.RawMessage `json:"entry"`
+	Hash  string          `json:"hash"`
+	MAC   string          `json:"mac"`
+}
+
+// OpenAuditChain abre o arquivo em path para acrescentar entradas, continuando
+// a cadeia a partir da última linha existente. A cadeia inteira é conferida
+// antes: um arquivo adulterado retorna *AuditChainError. Uma última linha
+// incompleta, sem a quebra de linha final, só pode ser uma gravação
+// interrompida e é descartada.
+func OpenAuditChain(path string, key []byte) (*AuditChain, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c, err := openAuditChain(f, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func openAuditChain(f *os.File, key []byte) (*AuditChain, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+		if err := f.Truncate(int64(len(data))); err != nil {
+			return nil, err
+		}
+	}
+
+	n, prev, err := VerifyAuditChain(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditChain{f: f, key: append([]byte(nil), key...), seq: uint64(n), prev: prev}, nil
+}
+
+// Hash da "linha zero", usado como prev da primeira entrada.
+var chainGenesis = strings.Repeat("0", 64)
+
+func (c *AuditChain) Close() error {
+	return c.f.Close()
+}
+
+func (c *AuditChain) Enabled(context.Context, slog.Level) bool { return true }
+func (c *AuditChain) WithAttrs([]slog.Attr) slog.Handler       { return c }
+func (c *AuditChain) WithGroup(string) slog.Handler            { return c }
+
+func (c *AuditChain) Handle(ctx context.Context, r slog.Record) error {
+	var body bytes.Buffer
+	if err := slog.NewJSONHandler(&body, nil).Handle(ctx, r); err != nil {
+		return err
+	}
+	return c.Append(bytes.TrimSpace(body.Bytes()))
+}
+
+// Append acrescenta entry (um objeto JSON) à cadeia e grava no disco.
+func (c *AuditChain) Append(entry []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := auditLink{Seq: c.seq + 1, Prev: c.prev, Entry: entry}
+	l.Hash, l.MAC = chainSeal(c.key, l)
+
+	// Sem escapar HTML, para que o conteúdo gravado seja exatamente o que foi assinado.
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(l); err != nil {
+		return err
+	}
+	if _, err := c.f.Write(line.Bytes()); err != nil {
+		return err
+	}
+	if err := c.f.Sync(); err != nil {
+		return err
+	}
+	c.seq, c.prev = l.Seq, l.Hash
+	return nil
+}
+
+// chainSeal calcula o hash da entrada (seq, prev e conteúdo) e o HMAC desse hash,
+// com o mesmo HMAC usado por GenerateCodeCustom.
+func chainSeal(key []byte, l auditLink) (string, string) {
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, l.Seq)
+
+	h := sha256.New()
+	h.Write(seq)
+	h.Write([]byte(l.Prev))
+	h.Write(l.Entry)
+	sum := h.Sum(nil)
+
+	mac := hmac.New(AlgorithmSHA256.Hash, key)
+	mac.Write(sum)
+	return hex.EncodeToString(sum), hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditChainError indica a primeira linha em que a cadeia foi quebrada.
+type AuditChainError struct {
+	Line   int
+	Reason string
+}
+
+func (e *AuditChainError) Error() string {
+	return fmt.Sprintf("auditoria adulterada na linha %d: %s", e.Line, e.Reason)
+}
+
+// VerifyAuditChain confere todas as entradas de r e retorna quantas são válidas
+// e o hash da última, que pode ser guardado fora do servidor como âncora.
+func VerifyAuditChain(r io.Reader, key []byte) (int, string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	prev := chainGenesis
+	n := 0
+	for sc.Scan() {
+		line := n + 1
+		var l auditLink
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			return n, prev, &AuditChainError{Line: line, Reason: "linha ilegível"}
+		}
+		if l.Seq != uint64(line) {
+			return n, prev, &AuditChainError{Line: line, Reason: fmt.Sprintf("sequência %d, esperada %d", l.Seq, line)}
+		}
+		if l.Prev != prev {
+			return n, prev, &AuditChainError{Line: line, Reason: "hash anterior não confere"}
+		}
+		hash, mac := chainSeal(key, l)
+		if !hmac.Equal([]byte(hash), []byte(l.Hash)) {
+			return n, prev, &AuditChainError{Line: line, Reason: "conteúdo alterado"}
+		}
+		if !hmac.Equal([]byte(mac), []byte(l.MAC)) {
+			return n, prev, &AuditChainError{Line: line, Reason: "HMAC inválido"}
+		}
+		prev = l.Hash
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return n, prev, err
+	}
+	return n, prev, nil
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestChain(t *testing.T, key []byte) string {
+	path := filepath.Join(t.TempDir(), "audit.chain")
+	c, err := OpenAuditChain(path, key)
+	require.NoError(t, err)
+	a := NewAuditor(c)
+	a.Record(AuditEntry{Event: AuditEnroll, Account: "Brisa:a@b.com", Success: true})
+	a.Record(AuditEntry{Event: AuditVerify, Account: "Brisa:a@b.com", Success: false, Error: "validate.invalid_code"})
+	require.NoError(t, c.Close())
+
+	// Reabrir continua a mesma cadeia.
+	c, err = OpenAuditChain(path, key)
+	require.NoError(t, err)
+	NewAuditor(c).Record(AuditEntry{Event: AuditDelete, Account: "Brisa:<a&b>", Actor: "admin", Success: true})
+	require.NoError(t, c.Close())
+	return path
+}
+
+func TestAuditChainVerify(t *testing.T) {
+	key := []byte("chave-de-auditoria")
+	path := writeTestChain(t, key)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	n, last, err := VerifyAuditChain(f, key)
+	require.NoError(t, err, "Cadeia íntegra")
+	require.Equal(t, 3, n)
+	require.Len(t, last, 64)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	_, _, err = VerifyAuditChain(bytes.NewReader(data), []byte("outra chave"))
+	require.IsType(t, &AuditChainError{}, err, "Chave errada não valida")
+}
+
+func TestAuditChainTamper(t *testing.T) {
+	key := []byte("chave-de-auditoria")
+	data, err := os.ReadFile(writeTestChain(t, key))
+	require.NoError(t, err)
+	lines := strings.SplitAfter(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+
+	check := func(content string, line int, msg string) {
+		_, _, err := VerifyAuditChain(strings.NewReader(content), key)
+		require.Error(t, err, msg)
+		ce, ok := err.(*AuditChainError)
+		require.True(t, ok, msg)
+		require.Equal(t, line, ce.Line, msg)
+	}
+
+	check(strings.Replace(string(data), `"success":false`, `"success":true`, 1), 2, "Alteração de conteúdo")
+	check(lines[0]+lines[2], 2, "Remoção de linha")
+	check(lines[1]+lines[0]+lines[2], 1, "Troca de ordem")
+
+	// Recalcular o hash sem a chave não basta: o HMAC denuncia.
+	forged := strings.Replace(lines[0], `"account":"Brisa:a@b.com"`, `"account":"Brisa:x@b.com"`, 1)
+	check(forged+lines[1]+lines[2], 1, "Conteúdo forjado")
+}
+
+func TestAuditChainReopen(t *testing.T) {
+	key := []byte("chave-de-auditoria")
+	path := writeTestChain(t, key)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// Uma gravação interrompida deixa meia linha no fim: ela é descartada e a
+	// cadeia continua válida.
+	require.NoError(t, os.WriteFile(path, append(append([]byte(nil), data...), `{"seq":4,"prev":"`...), 0600))
+	c, err := OpenAuditChain(path, key)
+	require.NoError(t, err, "Linha incompleta não impede a abertura")
+	NewAuditor(c).Record(AuditEntry{Event: AuditEnroll, Account: "Brisa:c@d.com", Success: true})
+	require.NoError(t, c.Close())
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	n, _, err := VerifyAuditChain(f, key)
+	f.Close()
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	// Uma cadeia adulterada não é continuada.
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(data), `"success":false`, `"success":true`, 1)), 0600))
+	_, err = OpenAuditChain(path, key)
+	require.IsType(t, &AuditChainError{}, err, "Adulteração detectada na abertura")
+	_, err = OpenAuditChain(writeTestChain(t, key), []byte("outra chave"))
+	require.IsType(t, &AuditChainError{}, err, "Chave errada")
+}
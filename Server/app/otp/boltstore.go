@@ -0,0 +1,187 @@
+package app
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltKeysBucket  = []byte("keys")
+	boltAuditBucket = []byte("audit")
+)
+
+// BoltStore é um KeyStore embarcado em um único arquivo, para instalações sem
+// servidor de banco. Cada operação é uma transação do bbolt, então um registro
+// (segredo, contador HOTP, último passo TOTP e falhas) nunca fica pela metade,
+// mesmo se o processo morrer durante a gravação.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore abre ou cria o arquivo em path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltKeysBucket, boltAuditBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Get(id string) (*KeyRecord, error) {
+	var rec *KeyRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = boltGet(tx, id)
+		return err
+	})
+	return rec, err
+}
+
+func (s *BoltStore) Put(rec *KeyRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, rec)
+	})
+}
+
+func (s *BoltStore) Create(rec *KeyRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltKeysBucket).Get([]byte(rec.ID)) != nil {
+			return ErrKeyExists
+		}
+		return boltPut(tx, rec)
+	})
+}
+
+func (s *BoltStore) Update(id string, fn func(rec *KeyRecord) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rec, err := boltGet(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		rec.ID = id
+		return boltPut(tx, rec)
+	})
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKeysBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrKeyNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) DeleteIf(id string, fn func(rec *KeyRecord) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rec, err := boltGet(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		return tx.Bucket(boltKeysBucket).Delete([]byte(id))
+	})
+}
+
+// List retorna os registros ordenados por ID, a ordem natural das chaves no bbolt.
+func (s *BoltStore) List() ([]*KeyRecord, error) {
+	var out []*KeyRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltKeysBucket).ForEach(func(k, v []byte) error {
+			rec := &KeyRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			out = append(out, rec)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// AppendAudit grava uma entrada de auditoria com número de sequência crescente.
+func (s *BoltStore) AppendAudit(entry []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAuditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, seq)
+		return b.Put(k, entry)
+	})
+}
+
+// AuditEntries percorre as entradas de auditoria em ordem de gravação.
+func (s *BoltStore) AuditEntries(fn func(seq uint64, entry []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAuditBucket).ForEach(func(k, v []byte) error {
+			return fn(binary.BigEndian.Uint64(k), v)
+		})
+	})
+}
+
+// Backup grava uma cópia consistente do banco em path sem bloquear as gravações.
+func (s *BoltStore) Backup(path string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+}
+
+// WriteBackup escreve uma cópia consistente do banco em w.
+func (s *BoltStore) WriteBackup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+func boltGet(tx *bolt.Tx, id string) (*KeyRecord, error) {
+	v := tx.Bucket(boltKeysBucket).Get([]byte(id))
+	if v == nil {
+		return nil, ErrKeyNotFound
+	}
+	rec := &KeyRecord{}
+	if err := json.Unmarshal(v, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func boltPut(tx *bolt.Tx, rec *KeyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltKeysBucket).Put([]byte(rec.ID), data)
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otp.db")
+	s, err := NewBoltStore(path)
+	require.NoError(t, err)
+	testKeyStore(t, s)
+
+	require.NoError(t, s.AppendAudit([]byte(`{"event":"enroll"}`)))
+	require.NoError(t, s.AppendAudit([]byte(`{"event":"verify"}`)))
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	require.NoError(t, s.Backup(backup), "Backup com o banco aberto")
+	require.NoError(t, s.Close())
+
+	b, err := NewBoltStore(backup)
+	require.NoError(t, err, "Abrir o backup")
+	defer b.Close()
+	got, err := b.Get(KeyID("Brisa", "matiasdias@gmail.com"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), got.Counter)
+
+	var seqs []uint64
+	var entries []string
+	require.NoError(t, b.AuditEntries(func(seq uint64, entry []byte) error {
+		seqs = append(seqs, seq)
+		entries = append(entries, string(entry))
+		return nil
+	}))
+	require.Equal(t, []uint64{1, 2}, seqs)
+	require.Equal(t, `{"event":"verify"}`, entries[1])
+}
+
+// TestBoltStoreCrash mata um processo filho no meio das gravações e confere que
+// nenhum registro ficou pela metade. No processo filho OTP_BOLT_CRASH_PATH está
+// definido e o teste apenas grava sem parar.
+func TestBoltStoreCrash(t *testing.T) {
+	if path := os.Getenv("OTP_BOLT_CRASH_PATH"); path != "" {
+		boltCrashWriter(path)
+		return
+	}
+	if testing.Short() {
+		t.Skip("teste de queda do processo")
+	}
+
+	path := filepath.Join(t.TempDir(), "crash.db")
+	for round := 0; round < 3; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestBoltStoreCrash$")
+		cmd.Env = append(os.Environ(), "OTP_BOLT_CRASH_PATH="+path)
+		out, err := cmd.StdoutPipe()
+		require.NoError(t, err)
+		require.NoError(t, cmd.Start())
+		// O filho avisa quando a primeira gravação terminou.
+		_, err = bufio.NewReader(out).ReadString('\n')
+		require.NoError(t, err)
+		time.Sleep(200 * time.Millisecond)
+		require.NoError(t, cmd.Process.Kill(), "Matar o processo no meio da gravação")
+		cmd.Wait()
+
+		s, err := NewBoltStore(path)
+		require.NoError(t, err, "Banco abre após a queda")
+		recs, err := s.List()
+		require.NoError(t, err)
+		require.NotEmpty(t, recs, "O filho chegou a gravar")
+		for _, r := range recs {
+			// Counter e LastStep são gravados na mesma transação.
+			require.Equal(t, int64(r.Counter), r.LastStep, "Registro %s gravado pela metade", r.ID)
+		}
+		n := 0
+		require.NoError(t, s.AuditEntries(func(uint64, []byte) error { n++; return nil }))
+		require.NotZero(t, n)
+		require.NoError(t, s.Close())
+	}
+}
+
+func boltCrashWriter(path string) {
+	s, err := NewBoltStore(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for i := 0; ; i++ {
+		id := "Brisa:" + strconv.Itoa(i%50)
+		err := s.Update(id, func(r *KeyRecord) error {
+			r.Counter++
+			r.LastStep = int64(r.Counter)
+			r.URL = fmt.Sprintf("otpauth://hotp/%s?counter=%d", id, r.Counter)
+			return nil
+		})
+		if err == ErrKeyNotFound {
+			err = s.Put(&KeyRecord{ID: id, State: KeyActive, Counter: 1, LastStep: 1})
+		}
+		if err == nil {
+			err = s.AppendAudit([]byte(`{"event":"verify","account":"` + id + `"}`))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if i == 0 {
+			fmt.Println("ready")
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var ErrChallengeNotFound = newError("challenge.not_found", KindFailedPrecondition)
+var ErrChallengeExpired = newError("challenge.expired", KindUnauthenticated)
+var ErrChallengeTooSoon = newError("challenge.too_soon", KindResourceExhausted)
+var ErrChannelInvalidAddress = newError("channel.invalid_address", KindInvalidArgument)
+
+// MethodEmail indica um código enviado por email.
+const MethodEmail Method = "email"
+
+// Message é uma mensagem com código a entregar por um canal fora de banda.
+type Message struct {
+	To      string
+	Subject string // ignorado por canais sem assunto, como SMS
+	Body    string
+}
+
+// Sender entrega mensagens de um Channel: SMTPSender, provedores de SMS etc.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// SenderFunc adapta uma função a Sender.
+type SenderFunc func(ctx context.Context, m Message) error
+
+func (f SenderFunc) Send(ctx context.Context, m Message) error {
+	return f(ctx, m)
+}
+
+// MessageData são os campos disponíveis nos modelos de ChannelOtp.
+type MessageData struct {
+	Code    string
+	Issuer  string
+	Account string
+	Minutes int // validade do código em minutos
+}
+
+// ChannelOtp fornece opções para Channel. Subject e Body são modelos
+// text/template sobre MessageData.
+type ChannelOtp struct {
+	Method      Method        // Método registrado na auditoria e no Match. O padrão é MethodEmail.
+	Subject     string        // O padrão é "Seu código de verificação".
+	Body        string        // O padrão é "Seu código de verificação é {{.Code}}...", mais curto para MethodSMS.
+	Digits      Digits        // O padrão é DigitsSix.
+	HOTP        bool          // Gera o código com um contador por conta em vez de aleatório.
+	TTL         time.Duration // Validade do código. O padrão é 10 minutos.
+	ResendAfter time.Duration // Intervalo mínimo entre envios. O padrão é 30 segundos.
+	MaxAttempts uint          // Tentativas por código. O padrão é 5.
+	// Throttle bloqueia a conta após falhas seguidas, somadas entre códigos
+	// reenviados: sem ele, um novo código a cada ResendAfter renovaria as tentativas.
+	Throttle ThrottleOtp
+	Rand     io.Reader
+}
+
+func (o ChannelOtp) defaults() ChannelOtp {
+	if o.Method == "" {
+		o.Method = MethodEmail
+	}
+	if o.Subject == "" {
+		o.Subject = "Seu código de verificação"
+	}
+	if o.Body == "" && o.Method == MethodSMS {
+		o.Body = "{{.Code}} é seu código {{.Issuer}}. Vale por {{.Minutes}} min."
+	}
+	if o.Body == "" {
+		o.Body = "Seu código de verificação é {{.Code}}.\n\nEle vale por {{.Minutes}} minutos. Se você não pediu este código, ignore esta mensagem.\n"
+	}
+	if o.Digits == 0 {
+		o.Digits = DigitsSix
+	}
+	if o.TTL == 0 {
+		o.TTL = 10 * time.Minute
+	}
+	if o.ResendAfter == 0 {
+		o.ResendAfter = 30 * time.Second
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 5
+	}
+	if o.Rand == nil {
+		o.Rand = rand.Reader
+	}
+	o.Throttle = o.Throttle.defaults()
+	return o
+}
+
+// Challenge é o código pendente de um Channel. Só o HMAC do código é guardado.
+type Challenge struct {
+	Salt      string
+	Hash      string
+	SentAt    time.Time
+	ExpiresAt time.Time
+	Attempts  uint
+}
+
+func challengeHash(salt, code string) string {
+	h := hmac.New(sha256.New, []byte(salt))
+	h.Write([]byte(code))
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Channel envia códigos de uso único por um canal fora de banda (email, SMS)
+// para contas sem aplicativo autenticador. Cada conta tem um KeyRecord HOTP
+// próprio, criado no primeiro envio, cujo segredo nunca sai do servidor; use
+// um emissor ou KeyStore diferente do das chaves TOTP, pois o ID é o mesmo.
+type Channel struct {
+	store  KeyStore
+	sender Sender
+	otp    ChannelOtp
+	audit  *Auditor
+	shared SharedState
+	now    func() time.Time
+
+	subject *template.Template
+	body    *template.Template
+}
+
+func NewChannel(store KeyStore, sender Sender, otp ChannelOtp) (*Channel, error) {
+	otp = otp.defaults()
+	subject, err := template.New("subject").Parse(otp.Subject)
+	if err != nil {
+		return nil, err
+	}
+	body, err := template.New("body").Parse(otp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Channel{store: store, sender: sender, otp: otp, now: time.Now, subject: subject, body: body}, nil
+}
+
+// UseAuditor faz o Channel registrar envios e validações em a.
+func (c *Channel) UseAuditor(a *Auditor) {
+	c.audit = a
+}
+
+// UseShared faz o Channel somar as falhas também em st, como Verifier.UseShared.
+func (c *Channel) UseShared(st SharedState) {
+	c.shared = st
+}
+
+// Send gera um novo código para a conta id (issuer:account) e o envia para to.
+// Um código anterior ainda pendente deixa de valer.
+func (c *Channel) Send(ctx context.Context, id, to string, t time.Time) error {
+	err := c.send(ctx, id, to, t)
+	c.audit.recordResult(AuditChallenge, id, t, err)
+	return err
+}
+
+func (c *Channel) send(ctx context.Context, id, to string, t time.Time) error {
+	issuer, account, ok := strings.Cut(id, ":")
+	if !ok || strings.TrimSpace(to) == "" {
+		return ErrChannelInvalidAddress
+	}
+	var (
+		code string
+		ch   Challenge
+	)
+	challenge := func() error {
+		return c.store.Update(id, func(rec *KeyRecord) error {
+			code, ch = "", Challenge{}
+			if rec.State != KeyActive {
+				return ErrKeyNotActive
+			}
+			if rec.Challenge != nil && t.Before(rec.Challenge.SentAt.Add(c.otp.ResendAfter)) {
+				return ErrChallengeTooSoon
+			}
+			var err error
+			if code, err = c.code(rec); err != nil {
+				return err
+			}
+			salt := make([]byte, 16)
+			if _, err := io.ReadFull(c.otp.Rand, salt); err != nil {
+				return err
+			}
+			ch = Challenge{Salt: base64.RawStdEncoding.EncodeToString(salt), SentAt: t, ExpiresAt: t.Add(c.otp.TTL)}
+			ch.Hash = challengeHash(ch.Salt, code)
+			rec.Challenge = &ch
+			return nil
+		})
+	}
+	err := challenge()
+	if err == ErrKeyNotFound {
+		// Primeiro envio: o registro é criado sem sobrescrever um cadastro
+		// feito ao mesmo tempo, e o código é gerado sobre o que ficou gravado.
+		k, gerr := Generate(GenerateOtp{Issuer: issuer, AccountName: account, Digits: c.otp.Digits, Rand: c.otp.Rand})
+		if gerr != nil {
+			return gerr
+		}
+		err = createKey(c.store, &KeyRecord{ID: id, URL: k.String(), State: KeyActive, CreatedAt: t, ActivatedAt: t})
+		if err == nil || err == ErrKeyExists {
+			err = challenge()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	m, err := c.message(to, MessageData{Code: code, Issuer: issuer, Account: account, Minutes: int(c.otp.TTL / time.Minute)})
+	if err == nil {
+		err = c.sender.Send(ctx, m)
+	}
+	if err != nil {
+		// Sem a mensagem o usuário precisa poder pedir outro código já.
+		c.store.Update(id, func(rec *KeyRecord) error {
+			if rec.Challenge != nil && rec.Challenge.Hash == ch.Hash {
+				rec.Challenge = nil
+			}
+			return nil
+		})
+	}
+	return err
+}
+
+// code gera o próximo código: HOTP do contador da conta ou aleatório.
+func (c *Channel) code(rec *KeyRecord) (string, error) {
+	if c.otp.HOTP {
+		k, err := rec.Key()
+		if err != nil {
+			return "", err
+		}
+		code, err := GenerateCodeCustom(k.Secret(), rec.Counter, ValidateOtps{Digits: k.Digits(), Algorithm: k.Algorithm()})
+		if err != nil {
+			return "", err
+		}
+		rec.Counter++
+		return code, nil
+	}
+	max := big.NewInt(1)
+	for i := 0; i < c.otp.Digits.Length(); i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(c.otp.Rand, max)
+	if err != nil {
+		return "", err
+	}
+	return c.otp.Digits.Format(int32(n.Int64())), nil
+}
+
+func (c *Channel) message(to string, data MessageData) (Message, error) {
+	var subject, body strings.Builder
+	if err := c.subject.Execute(&subject, data); err != nil {
+		return Message{}, err
+	}
+	if err := c.body.Execute(&body, data); err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: subject.String(), Body: body.String()}, nil
+}
+
+// Verify valida o código enviado para a conta id. O código é de uso único e
+// deixa de valer após TTL ou MaxAttempts tentativas erradas; as falhas também
+// contam para o bloqueio da conta (Throttle), que vale entre reenvios. Só
+// contas ativas são aceitas.
+func (c *Channel) Verify(id, code string, t time.Time) (Match, error) {
+	locked, err := c.verify(id, strings.TrimSpace(code), t)
+	e := AuditEntry{Time: t, Event: AuditVerify, Account: id, Success: err == nil, Error: auditError(err)}
+	if err == nil {
+		e.Method = c.otp.Method
+	}
+	c.audit.Record(e)
+	if locked {
+		c.audit.Record(AuditEntry{Time: t, Event: AuditLockout, Account: id, Success: true})
+	}
+	if err != nil {
+		return Match{}, err
+	}
+	return Match{Method: c.otp.Method}, nil
+}
+
+func (c *Channel) verify(id, code string, t time.Time) (bool, error) {
+	// Como no Verifier, a tentativa é contada no estado compartilhado antes.
+	var shared uint
+	if c.shared != nil {
+		n, err := c.shared.Fail(id, c.otp.Throttle.Lockout)
+		if err != nil {
+			return false, err
+		}
+		if n > c.otp.Throttle.MaxFailures {
+			return false, ErrValidateThrottled
+		}
+		shared = n
+	}
+
+	var (
+		result error
+		locked bool
+	)
+	err := c.store.Update(id, func(rec *KeyRecord) error {
+		result, locked = nil, false
+		if rec.State != KeyActive {
+			return ErrKeyNotActive
+		}
+		if err := rec.Throttle.Allow(t); err != nil {
+			return err
+		}
+		ch := rec.Challenge
+		if ch == nil {
+			return ErrChallengeNotFound
+		}
+		if !t.Before(ch.ExpiresAt) {
+			rec.Challenge = nil
+			result = ErrChallengeExpired
+			return nil
+		}
+		if hmac.Equal([]byte(challengeHash(ch.Salt, code)), []byte(ch.Hash)) {
+			rec.Challenge = nil
+			rec.LastUsedAt = t
+			rec.Throttle.Reset()
+			return nil
+		}
+		// A falha precisa ser gravada, por isso fn não retorna o erro.
+		ch.Attempts++
+		if ch.Attempts >= c.otp.MaxAttempts {
+			rec.Challenge = nil
+		}
+		locked = rec.Throttle.Fail(t, c.otp.Throttle)
+		result = ErrValidateInvalidCode
+		return nil
+	})
+	if err == ErrKeyNotFound {
+		return false, ErrChallengeNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if c.shared != nil {
+		if result != nil {
+			locked = locked || (result == ErrValidateInvalidCode && shared == c.otp.Throttle.MaxFailures)
+		} else if err := c.shared.Reset(id); err != nil {
+			return false, err
+		}
+	}
+	return locked, result
+}
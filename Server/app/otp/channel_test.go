@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// captureSender guarda as mensagens em vez de enviá-las.
+type captureSender struct {
+	sent []Message
+	err  error
+}
+
+func (s *captureSender) Send(ctx context.Context, m Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+var codePattern = regexp.MustCompile(`\b\d{6}\b`)
+
+func (s *captureSender) lastCode(t *testing.T) string {
+	require.NotEmpty(t, s.sent)
+	code := codePattern.FindString(s.sent[len(s.sent)-1].Body)
+	require.NotEmpty(t, code)
+	return code
+}
+
+func TestChannel(t *testing.T) {
+	s := NewMemoryStore()
+	sender := &captureSender{}
+	c, err := NewChannel(s, sender, ChannelOtp{})
+	require.NoError(t, err)
+	id := KeyID("Brisa", "ana@example.com")
+	now := time.Unix(1700000000, 0).UTC()
+	ctx := context.Background()
+
+	_, err = c.Verify(id, "123456", now)
+	require.ErrorIs(t, err, ErrChallengeNotFound)
+
+	require.NoError(t, c.Send(ctx, id, "ana@example.com", now))
+	require.Equal(t, "Seu código de verificação", sender.sent[0].Subject)
+	require.Contains(t, sender.sent[0].Body, "10 minutos")
+	code := sender.lastCode(t)
+
+	rec, err := s.Get(id)
+	require.NoError(t, err)
+	require.NotNil(t, rec.Challenge)
+	require.NotContains(t, rec.Challenge.Hash, code, "Apenas o hash é guardado")
+
+	require.ErrorIs(t, c.Send(ctx, id, "ana@example.com", now.Add(10*time.Second)), ErrChallengeTooSoon)
+
+	_, err = c.Verify(id, "000000", now)
+	require.ErrorIs(t, err, ErrValidateInvalidCode)
+	m, err := c.Verify(id, code, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, MethodEmail, m.Method)
+	_, err = c.Verify(id, code, now.Add(time.Minute))
+	require.ErrorIs(t, err, ErrChallengeNotFound, "Código de uso único")
+
+	// Expiração.
+	require.NoError(t, c.Send(ctx, id, "ana@example.com", now.Add(time.Minute)))
+	_, err = c.Verify(id, sender.lastCode(t), now.Add(11*time.Minute))
+	require.ErrorIs(t, err, ErrChallengeExpired)
+
+	// Tentativas esgotadas invalidam o código.
+	later := now.Add(time.Hour)
+	require.NoError(t, c.Send(ctx, id, "ana@example.com", later))
+	code = sender.lastCode(t)
+	for i := 0; i < 3; i++ {
+		_, err = c.Verify(id, "000000", later)
+		require.ErrorIs(t, err, ErrValidateInvalidCode)
+	}
+	// Um novo código não renova as tentativas da conta.
+	later = later.Add(time.Minute)
+	require.NoError(t, c.Send(ctx, id, "ana@example.com", later))
+	code = sender.lastCode(t)
+	for i := 0; i < 2; i++ {
+		_, err = c.Verify(id, "000000", later)
+		require.ErrorIs(t, err, ErrValidateInvalidCode)
+	}
+	_, err = c.Verify(id, code, later)
+	require.ErrorIs(t, err, ErrValidateThrottled, "Conta bloqueada após 5 falhas somadas")
+	later = later.Add(15 * time.Minute)
+	_, err = c.Verify(id, code, later)
+	require.ErrorIs(t, err, ErrChallengeExpired)
+
+	// MaxAttempts invalida o código mesmo antes do bloqueio.
+	c.otp.MaxAttempts = 2
+	require.NoError(t, c.Send(ctx, id, "ana@example.com", later))
+	code = sender.lastCode(t)
+	for i := 0; i < 2; i++ {
+		_, err = c.Verify(id, "000000", later)
+		require.ErrorIs(t, err, ErrValidateInvalidCode)
+	}
+	_, err = c.Verify(id, code, later)
+	require.ErrorIs(t, err, ErrChallengeNotFound)
+
+	// Falha no envio libera um novo pedido.
+	sender.err = errors.New("smtp fora do ar")
+	require.Error(t, c.Send(ctx, id, "ana@example.com", later.Add(time.Minute)))
+	sender.err = nil
+	require.NoError(t, c.Send(ctx, id, "ana@example.com", later.Add(time.Minute+time.Second)))
+
+	// Um cadastro pendente com o mesmo ID não é sobrescrito nem recebe códigos.
+	pending := KeyID("Brisa", "bia@example.com")
+	require.NoError(t, s.Put(&KeyRecord{ID: pending, State: KeyPending}))
+	require.ErrorIs(t, c.Send(ctx, pending, "bia@example.com", now), ErrKeyNotActive)
+	rec, err = s.Get(pending)
+	require.NoError(t, err)
+	require.Equal(t, KeyPending, rec.State)
+	require.Nil(t, rec.Challenge)
+	_, err = c.Verify(pending, "000000", now)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+}
+
+func TestChannelHOTP(t *testing.T) {
+	s := NewMemoryStore()
+	sender := &captureSender{}
+	c, err := NewChannel(s, sender, ChannelOtp{
+		HOTP:    true,
+		Subject: "Código {{.Issuer}}",
+		Body:    "Olá {{.Account}}, use {{.Code}}",
+	})
+	require.NoError(t, err)
+	id := KeyID("Brisa", "ana")
+	now := time.Unix(1700000000, 0).UTC()
+
+	require.NoError(t, c.Send(context.Background(), id, "ana@example.com", now))
+	require.Equal(t, "Código Brisa", sender.sent[0].Subject)
+	require.Regexp(t, `^Olá ana, use \d{6}$`, sender.sent[0].Body)
+
+	rec, err := s.Get(id)
+	require.NoError(t, err)
+	k, err := rec.Key()
+	require.NoError(t, err)
+	require.Equal(t, "hotp", k.Type())
+	want, err := GenerateCode(k.Secret(), 0)
+	require.NoError(t, err)
+	require.Equal(t, want, sender.lastCode(t))
+	require.Equal(t, uint64(1), rec.Counter)
+
+	_, err = NewChannel(s, sender, ChannelOtp{Body: "{{.Code"})
+	require.Error(t, err, "Modelo inválido")
+}
@@ -0,0 +1,295 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+)
+
+var ErrCryptUnknownKeyVersion = newError("crypt.unknown_key_version", KindInternal)
+var ErrCryptInvalidMasterKey = newError("crypt.invalid_master_key", KindInvalidArgument)
+var ErrCryptInvalidCiphertext = newError("crypt.invalid_ciphertext", KindInternal)
+
+// Prefixo das URLs cifradas. Registros sem ele são lidos como texto puro,
+// o que permite cifrar uma base existente com Reencrypt.
+const sealedPrefix = "enc:"
+
+// Keyring guarda as chaves mestras AES-256 por versão.
+// Current é a versão usada para cifrar novos registros.
+type Keyring struct {
+	Current string
+	keys    map[string][]byte
+}
+
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	kr := &Keyring{Current: current, keys: map[string][]byte{}}
+	for v, k := range keys {
+		if len(k) != 32 {
+			return nil, ErrCryptInvalidMasterKey
+		}
+		kr.keys[v] = append([]byte(nil), k...)
+	}
+	if _, ok := kr.keys[current]; !ok {
+		return nil, ErrCryptUnknownKeyVersion
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) aead(version string) (cipher.AEAD, error) {
+	k, ok := kr.keys[version]
+	if !ok {
+		return nil, ErrCryptUnknownKeyVersion
+	}
+	return newGCM(k)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedStore cifra os segredos antes de repassar os registros a outro KeyStore.
+// Cada registro tem uma chave de dados AES-GCM própria, guardada em WrappedKey
+// cifrada pela chave mestra indicada em KeyVersion.
+type EncryptedStore struct {
+	store KeyStore
+	ring  *Keyring
+	Rand  io.Reader
+}
+
+func NewEncryptedStore(store KeyStore, ring *Keyring) *EncryptedStore {
+	return &EncryptedStore{store: store, ring: ring, Rand: rand.Reader}
+}
+
+func (s *EncryptedStore) Get(id string) (*KeyRecord, error) {
+	rec, err := s.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(rec)
+}
+
+func (s *EncryptedStore) Put(rec *KeyRecord) error {
+	sealed, err := s.seal(rec, nil)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(sealed)
+}
+
+func (s *EncryptedStore) Create(rec *KeyRecord) error {
+	sealed, err := s.seal(rec, nil)
+	if err != nil {
+		return err
+	}
+	return createKey(s.store, sealed)
+}
+
+func (s *EncryptedStore) Update(id string, fn func(rec *KeyRecord) error) error {
+	return s.store.Update(id, func(rec *KeyRecord) error {
+		plain, err := s.open(rec)
+		if err != nil {
+			return err
+		}
+		if err := fn(plain); err != nil {
+			return err
+		}
+		sealed, err := s.seal(plain, nil)
+		if err != nil {
+			return err
+		}
+		*rec = *sealed
+		return nil
+	})
+}
+
+func (s *EncryptedStore) Delete(id string) error {
+	return s.store.Delete(id)
+}
+
+func (s *EncryptedStore) DeleteIf(id string, fn func(rec *KeyRecord) error) error {
+	return deleteKeyIf(s.store, id, func(rec *KeyRecord) error {
+		plain, err := s.open(rec)
+		if err != nil {
+			return err
+		}
+		return fn(plain)
+	})
+}
+
+func (s *EncryptedStore) List() ([]*KeyRecord, error) {
+	recs, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	for i, rec := range recs {
+		if recs[i], err = s.open(rec); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// ListPage repassa o filtro ao store interno, para ListKeys paginar no banco.
+func (s *EncryptedStore) ListPage(f KeyFilter) ([]*KeyRecord, error) {
+	recs, _, err := ListKeys(s.store, f)
+	if err != nil {
+		return nil, err
+	}
+	for i, rec := range recs {
+		if recs[i], err = s.open(rec); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// Reencrypt recifra as chaves de dados de todos os registros com a chave mestra
+// atual, após uma troca de Keyring.Current. Registros em texto puro também são
+// cifrados. Retorna quantos registros foram alterados.
+func (s *EncryptedStore) Reencrypt() (int, error) {
+	recs, err := s.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, r := range recs {
+		if r.KeyVersion == s.ring.Current {
+			continue
+		}
+		err := s.store.Update(r.ID, func(rec *KeyRecord) error {
+			dek, err := s.unwrap(rec)
+			if err != nil {
+				return err
+			}
+			plain, err := s.open(rec)
+			if err != nil {
+				return err
+			}
+			sealed, err := s.seal(plain, dek)
+			if err != nil {
+				return err
+			}
+			*rec = *sealed
+			return nil
+		})
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// seal retorna uma cópia de rec com as URLs cifradas. Se dek for nil uma nova
+// chave de dados é gerada.
+func (s *EncryptedStore) seal(rec *KeyRecord, dek []byte) (*KeyRecord, error) {
+	out := rec.clone()
+	if dek == nil {
+		dek = make([]byte, 32)
+		if _, err := io.ReadFull(s.Rand, dek); err != nil {
+			return nil, err
+		}
+	}
+
+	master, err := s.ring.aead(s.ring.Current)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.encrypt(master, dek, []byte(rec.ID))
+	if err != nil {
+		return nil, err
+	}
+	out.KeyVersion = s.ring.Current
+	out.WrappedKey = wrapped
+
+	data, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []*string{&out.URL, &out.NextURL} {
+		if *f == "" {
+			continue
+		}
+		c, err := s.encrypt(data, []byte(*f), []byte(rec.ID))
+		if err != nil {
+			return nil, err
+		}
+		*f = sealedPrefix + c
+	}
+	return out, nil
+}
+
+// open retorna uma cópia de rec com as URLs em texto puro.
+func (s *EncryptedStore) open(rec *KeyRecord) (*KeyRecord, error) {
+	out := rec.clone()
+	if rec.KeyVersion == "" {
+		return out, nil
+	}
+	dek, err := s.unwrap(rec)
+	if err != nil {
+		return nil, err
+	}
+	data, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range []*string{&out.URL, &out.NextURL} {
+		if !strings.HasPrefix(*f, sealedPrefix) {
+			continue
+		}
+		p, err := decrypt(data, strings.TrimPrefix(*f, sealedPrefix), []byte(rec.ID))
+		if err != nil {
+			return nil, err
+		}
+		*f = string(p)
+	}
+	out.KeyVersion = ""
+	out.WrappedKey = ""
+	return out, nil
+}
+
+// unwrap retorna a chave de dados de rec, ou nil se o registro está em texto puro.
+func (s *EncryptedStore) unwrap(rec *KeyRecord) ([]byte, error) {
+	if rec.KeyVersion == "" {
+		return nil, nil
+	}
+	master, err := s.ring.aead(rec.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(master, rec.WrappedKey, []byte(rec.ID))
+}
+
+// encrypt retorna base64(nonce || texto cifrado). O ID do registro é usado como
+// dado adicional para impedir a troca de segredos entre registros.
+func (s *EncryptedStore) encrypt(aead cipher.AEAD, plain, ad []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(s.Rand, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, ad)), nil
+}
+
+func decrypt(aead cipher.AEAD, encoded string, ad []byte) ([]byte, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, ErrCryptInvalidCiphertext
+	}
+	p, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrCryptInvalidCiphertext
+	}
+	return p, nil
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, current string) *Keyring {
+	kr, err := NewKeyring(current, map[string][]byte{
+		"v1": bytes.Repeat([]byte{1}, 32),
+		"v2": bytes.Repeat([]byte{2}, 32),
+	})
+	require.NoError(t, err)
+	return kr
+}
+
+func TestEncryptedStore(t *testing.T) {
+	inner := NewMemoryStore()
+	testKeyStore(t, NewEncryptedStore(inner, testKeyring(t, "v1")))
+
+	recs, err := inner.List()
+	require.NoError(t, err)
+	for _, r := range recs {
+		require.NotContains(t, r.URL, "JBSWY3DPEHPK3PXP", "O store interno nunca vê o segredo")
+		require.Equal(t, "v1", r.KeyVersion)
+	}
+}
+
+func TestEncryptedStoreReencrypt(t *testing.T) {
+	inner := NewMemoryStore()
+	url := `otpauth://totp/Brisa:a@b.com?secret=JBSWY3DPEHPK3PXP&issuer=Brisa`
+	require.NoError(t, inner.Put(&KeyRecord{ID: "Brisa:plain", URL: url, State: KeyActive}))
+
+	s := NewEncryptedStore(inner, testKeyring(t, "v1"))
+	require.NoError(t, s.Put(&KeyRecord{ID: "Brisa:a@b.com", URL: url, NextURL: url, State: KeyActive}))
+
+	got, err := s.Get("Brisa:plain")
+	require.NoError(t, err, "Registros antigos em texto puro continuam legíveis")
+	require.Equal(t, url, got.URL)
+
+	s = NewEncryptedStore(inner, testKeyring(t, "v2"))
+	n, err := s.Reencrypt()
+	require.NoError(t, err)
+	require.Equal(t, 2, n, "Todos os registros recifrados")
+
+	recs, err := inner.List()
+	require.NoError(t, err)
+	for _, r := range recs {
+		require.Equal(t, "v2", r.KeyVersion)
+		require.True(t, strings.HasPrefix(r.URL, sealedPrefix))
+	}
+
+	got, err = s.Get("Brisa:a@b.com")
+	require.NoError(t, err)
+	require.Equal(t, url, got.URL)
+	require.Equal(t, url, got.NextURL)
+
+	// Sem a chave antiga no Keyring a leitura falha.
+	kr, err := NewKeyring("v3", map[string][]byte{"v3": bytes.Repeat([]byte{3}, 32)})
+	require.NoError(t, err)
+	_, err = NewEncryptedStore(inner, kr).Get("Brisa:a@b.com")
+	require.Equal(t, ErrCryptUnknownKeyVersion, err)
+
+	// Segredo copiado para outro registro não pode ser aberto.
+	rec, err := inner.Get("Brisa:a@b.com")
+	require.NoError(t, err)
+	rec.ID = "Brisa:outro"
+	require.NoError(t, inner.Put(rec))
+	_, err = s.Get("Brisa:outro")
+	require.Equal(t, ErrCryptInvalidCiphertext, err)
+}
+
+func TestNewKeyring(t *testing.T) {
+	_, err := NewKeyring("v1", map[string][]byte{"v1": []byte("curta")})
+	require.Equal(t, ErrCryptInvalidMasterKey, err)
+	_, err = NewKeyring("v9", map[string][]byte{"v1": bytes.Repeat([]byte{1}, 32)})
+	require.Equal(t, ErrCryptUnknownKeyVersion, err)
+}
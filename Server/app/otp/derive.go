@@ -0,0 +1,75 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+var ErrDeriveShortMasterKey = newError("derive.short_master_key", KindInvalidArgument)
+
+// Salt fixo do HKDF, separa as chaves derivadas aqui de outros usos da chave mestra.
+var deriveSalt = []byte("otp/app derive v1")
+
+// DeriveSecret calcula o segredo de uma conta a partir da chave mestra, sem
+// precisar guardá-lo. Mudar version gera um segredo novo para a mesma conta.
+func DeriveSecret(master []byte, issuer, accountName string, version uint32, size uint) ([]byte, error) {
+	if len(master) < 16 {
+		return nil, ErrDeriveShortMasterKey
+	}
+	if size == 0 {
+		size = 20
+	}
+
+	// Cada campo leva o tamanho na frente para que ("a:b", "c") e ("a", "b:c")
+	// nunca produzam o mesmo info.
+	info := make([]byte, 0, len(issuer)+len(accountName)+2*binary.MaxVarintLen64+4)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, f := range []string{issuer, accountName} {
+		n := binary.PutUvarint(buf, uint64(len(f)))
+		info = append(info, buf[:n]...)
+		info = append(info, f...)
+	}
+	binary.BigEndian.PutUint32(buf, version)
+	info = append(info, buf[:4]...)
+
+	return hkdfSHA256(master, deriveSalt, info, int(size)), nil
+}
+
+// Derives gera a mesma Key que Generates geraria, mas com o segredo derivado
+// de master. O SecretSize de otp define o tamanho do segredo (padrão 20 bytes).
+func Derives(master []byte, version uint32, otp GeneratesOtp) (*Key, error) {
+	if otp.Issuer == "" {
+		return nil, ErrGenerateMissingIssuer
+	}
+	if otp.AccountName == "" {
+		return nil, ErrGenerateMissingAccountName
+	}
+
+	secret, err := DeriveSecret(master, otp.Issuer, otp.AccountName, version, otp.SecretSize)
+	if err != nil {
+		return nil, err
+	}
+	otp.Secret = secret
+	return Generates(otp)
+}
+
+// hkdfSHA256 implementa a RFC 5869 (extract e expand) com HMAC-SHA256.
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	out := make([]byte, 0, length+sha256.Size)
+	var prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		expand.Reset()
+		expand.Write(prev)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		prev = expand.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHKDFVector(t *testing.T) {
+	// RFC 5869, caso de teste 1
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := hkdfSHA256(ikm, salt, info, 42)
+	require.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865", hex.EncodeToString(okm))
+}
+
+func TestDerives(t *testing.T) {
+	master := bytes.Repeat([]byte("m"), 32)
+	opts := GeneratesOtp{Issuer: "Brisa", AccountName: "matiasdias@gmail.com"}
+
+	k1, err := Derives(master, 1, opts)
+	require.NoError(t, err, "Derivar chave")
+	k2, err := Derives(master, 1, opts)
+	require.NoError(t, err)
+	require.Equal(t, k1.String(), k2.String(), "A derivação é determinística")
+	require.Equal(t, 32, len(k1.Secret()), "Mesmo tamanho de segredo que Generates")
+
+	g, err := Generates(GeneratesOtp{Issuer: "Brisa", AccountName: "matiasdias@gmail.com", Secret: []byte("12345678901234567890")})
+	require.NoError(t, err)
+	require.Equal(t, g.Type(), k1.Type())
+	require.Equal(t, g.Period(), k1.Period())
+	require.Equal(t, g.Digits(), k1.Digits())
+	require.Equal(t, g.Algorithm(), k1.Algorithm())
+
+	k3, err := Derives(master, 2, opts)
+	require.NoError(t, err)
+	require.NotEqual(t, k1.Secret(), k3.Secret(), "Nova versão gera novo segredo")
+
+	k4, err := Derives(master, 1, GeneratesOtp{Issuer: "Brisa", AccountName: "outro@gmail.com"})
+	require.NoError(t, err)
+	require.NotEqual(t, k1.Secret(), k4.Secret(), "Cada conta tem seu segredo")
+
+	a, err := DeriveSecret(master, "a:b", "c", 1, 20)
+	require.NoError(t, err)
+	b, err := DeriveSecret(master, "a", "b:c", 1, 20)
+	require.NoError(t, err)
+	require.NotEqual(t, a, b, "Campos não podem se confundir")
+
+	_, err = Derives([]byte("curta"), 1, opts)
+	require.Equal(t, ErrDeriveShortMasterKey, err)
+	_, err = Derives(master, 1, GeneratesOtp{AccountName: "a@b.com"})
+	require.Equal(t, ErrGenerateMissingIssuer, err)
+}
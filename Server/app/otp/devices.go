@@ -0,0 +1,205 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrDeviceNotTrusted = newError("device.not_trusted", KindUnauthenticated)
+var ErrDeviceNotFound = newError("device.not_found", KindNotFound)
+
+// MethodDevice indica um login aceito por um dispositivo confiável, sem código.
+const MethodDevice Method = "device"
+
+// DeviceOtp fornece opções para dispositivos confiáveis.
+type DeviceOtp struct {
+	TTL        time.Duration // Por quanto tempo o dispositivo dispensa o código. O padrão é 30 dias.
+	MaxDevices uint          // Dispositivos por conta; o mais antigo sai. O padrão é 10.
+	Rand       io.Reader
+}
+
+func (o DeviceOtp) defaults() DeviceOtp {
+	if o.TTL == 0 {
+		o.TTL = 30 * 24 * time.Hour
+	}
+	if o.MaxDevices == 0 {
+		o.MaxDevices = 10
+	}
+	if o.Rand == nil {
+		o.Rand = rand.Reader
+	}
+	return o
+}
+
+// TrustedDevice é um dispositivo lembrado ("lembrar deste dispositivo").
+// O token só é guardado como hash, junto com a impressão digital do
+// dispositivo, de forma que um token copiado para outro dispositivo não vale.
+type TrustedDevice struct {
+	ID         string // identificador público, para listar e revogar
+	Name       string // descrição mostrada ao usuário, ex.: navegador e sistema
+	Hash       string `json:",omitempty"`
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+}
+
+// O token entregue ao dispositivo é ID.segredo; o hash cobre o segredo e a impressão digital.
+func deviceHash(secret, fingerprint string) string {
+	h := sha256.New()
+	h.Write([]byte(secret))
+	h.Write([]byte{0})
+	h.Write([]byte(fingerprint))
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// pruneDevices remove os dispositivos expirados em t.
+func pruneDevices(devices []TrustedDevice, t time.Time) []TrustedDevice {
+	kept := devices[:0]
+	for _, d := range devices {
+		if t.Before(d.ExpiresAt) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// TrustDevice lembra o dispositivo com impressão digital fingerprint para a
+// chave id e retorna o token a guardar nele (em um cookie, por exemplo).
+// Deve ser chamado apenas logo após um Verify bem-sucedido.
+func (v *Verifier) TrustDevice(id, fingerprint, name string, t time.Time, otp DeviceOtp) (string, *TrustedDevice, error) {
+	otp = otp.defaults()
+	raw := make([]byte, 40)
+	if _, err := io.ReadFull(otp.Rand, raw); err != nil {
+		return "", nil, err
+	}
+	d := TrustedDevice{
+		ID:         base64.RawURLEncoding.EncodeToString(raw[:8]),
+		Name:       name,
+		CreatedAt:  t,
+		ExpiresAt:  t.Add(otp.TTL),
+		LastUsedAt: t,
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw[8:])
+	d.Hash = deviceHash(secret, fingerprint)
+
+	err := v.store.Update(id, func(rec *KeyRecord) error {
+		if rec.State != KeyActive {
+			return ErrKeyNotActive
+		}
+		devices := pruneDevices(rec.Devices, t)
+		sort.SliceStable(devices, func(i, j int) bool { return devices[i].CreatedAt.Before(devices[j].CreatedAt) })
+		for uint(len(devices)) >= otp.MaxDevices {
+			devices = devices[1:]
+		}
+		rec.Devices = append(devices, d)
+		return nil
+	})
+	v.audit.recordResult(AuditDeviceTrust, id, t, err)
+	if err != nil {
+		return "", nil, err
+	}
+	d.Hash = ""
+	return d.ID + "." + secret, &d, nil
+}
+
+// VerifyDevice aceita o token de um dispositivo confiável da chave id no lugar
+// do código. Uma conta bloqueada por tentativas também recusa dispositivos.
+func (v *Verifier) VerifyDevice(id, token, fingerprint string, t time.Time) (Match, error) {
+	err := v.verifyDevice(id, token, fingerprint, t)
+	e := AuditEntry{Time: t, Event: AuditVerify, Account: id, Success: err == nil, Error: auditError(err)}
+	if err == nil {
+		e.Method = MethodDevice
+	}
+	v.audit.Record(e)
+	if err != nil {
+		return Match{}, err
+	}
+	return Match{Method: MethodDevice}, nil
+}
+
+func (v *Verifier) verifyDevice(id, token, fingerprint string, t time.Time) error {
+	deviceID, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrDeviceNotTrusted
+	}
+	hash := deviceHash(secret, fingerprint)
+	return v.store.Update(id, func(rec *KeyRecord) error {
+		if rec.State != KeyActive {
+			return ErrKeyNotActive
+		}
+		if err := rec.Throttle.Allow(t); err != nil {
+			return err
+		}
+		for i := range rec.Devices {
+			d := &rec.Devices[i]
+			if d.ID != deviceID {
+				continue
+			}
+			if !t.Before(d.ExpiresAt) || subtle.ConstantTimeCompare([]byte(d.Hash), []byte(hash)) != 1 {
+				return ErrDeviceNotTrusted
+			}
+			d.LastUsedAt = t
+			rec.Devices = pruneDevices(rec.Devices, t)
+			return nil
+		}
+		return ErrDeviceNotTrusted
+	})
+}
+
+// Authenticate valida um login com dispositivo confiável ou código. Com fresh
+// (ações sensíveis, como trocar a senha) o dispositivo é ignorado e o código é
+// sempre exigido. Sem código, a falha do dispositivo é retornada.
+func (v *Verifier) Authenticate(id, passcode, deviceToken, fingerprint string, fresh bool, t time.Time) (Match, error) {
+	if !fresh && deviceToken != "" {
+		m, err := v.VerifyDevice(id, deviceToken, fingerprint, t)
+		if err == nil || passcode == "" {
+			return m, err
+		}
+	}
+	return v.Verify(id, passcode, t)
+}
+
+// Devices lista os dispositivos ainda válidos da chave id, do mais recente ao
+// mais antigo. Os hashes não são retornados.
+func (v *Verifier) Devices(id string, t time.Time) ([]TrustedDevice, error) {
+	rec, err := v.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	out := []TrustedDevice{}
+	for _, d := range rec.Devices {
+		if t.Before(d.ExpiresAt) {
+			d.Hash = ""
+			out = append(out, d)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+// RevokeDevice remove um dispositivo da chave id; com deviceID vazio remove
+// todos ("sair de todos os dispositivos"). actor identifica um administrador
+// na auditoria, vazio quando é o próprio usuário.
+func (v *Verifier) RevokeDevice(id, deviceID, actor string, t time.Time) error {
+	err := v.store.Update(id, func(rec *KeyRecord) error {
+		if deviceID == "" {
+			rec.Devices = nil
+			return nil
+		}
+		for i, d := range rec.Devices {
+			if d.ID == deviceID {
+				rec.Devices = append(rec.Devices[:i:i], rec.Devices[i+1:]...)
+				return nil
+			}
+		}
+		return ErrDeviceNotFound
+	})
+	v.audit.Record(AuditEntry{Time: t, Event: AuditDeviceRevoke, Account: id, Actor: actor, Success: err == nil, Error: auditError(err)})
+	return err
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedDevice(t *testing.T) {
+	var entries []AuditEntry
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{Skew: 1})
+	v.UseAuditor(NewAuditor(AuditCallback(func(e AuditEntry) { entries = append(entries, e) })))
+	secret := "JBSWY3DPEHPK3PXP"
+	id := newActiveRecord(t, s, "otpauth://totp/Brisa:ana?secret="+secret+"&issuer=Brisa")
+	now := time.Unix(1700000000, 0).UTC()
+	opts := DeviceOtp{TTL: 24 * time.Hour, MaxDevices: 2}
+
+	token, d, err := v.TrustDevice(id, "fp-notebook", "Firefox no Linux", now, opts)
+	require.NoError(t, err)
+	require.Empty(t, d.Hash)
+	require.Equal(t, now.Add(24*time.Hour), d.ExpiresAt)
+
+	rec, err := s.Get(id)
+	require.NoError(t, err)
+	require.Len(t, rec.Devices, 1)
+	require.NotContains(t, rec.Devices[0].Hash, token, "Apenas o hash é guardado")
+
+	later := now.Add(time.Hour)
+	m, err := v.VerifyDevice(id, token, "fp-notebook", later)
+	require.NoError(t, err)
+	require.Equal(t, MethodDevice, m.Method)
+	_, err = v.VerifyDevice(id, token, "fp-outro", later)
+	require.ErrorIs(t, err, ErrDeviceNotTrusted, "Token copiado para outro dispositivo")
+	_, err = v.VerifyDevice(id, token+"x", "fp-notebook", later)
+	require.ErrorIs(t, err, ErrDeviceNotTrusted)
+	_, err = v.VerifyDevice(id, token, "fp-notebook", now.Add(24*time.Hour))
+	require.ErrorIs(t, err, ErrDeviceNotTrusted, "Expirado")
+
+	// Ações sensíveis exigem código mesmo com dispositivo confiável.
+	m, err = v.Authenticate(id, "", token, "fp-notebook", false, later)
+	require.NoError(t, err)
+	require.Equal(t, MethodDevice, m.Method)
+	_, err = v.Authenticate(id, "000000", token, "fp-notebook", true, later)
+	require.ErrorIs(t, err, ErrValidateInvalidCode)
+	code, err := GenerateCodes(secret, later)
+	require.NoError(t, err)
+	m, err = v.Authenticate(id, code, "", "", true, later)
+	require.NoError(t, err)
+	require.Equal(t, MethodTOTP, m.Method)
+
+	// O limite por conta descarta o mais antigo.
+	_, d2, err := v.TrustDevice(id, "fp-celular", "Safari no iPhone", now.Add(time.Minute), opts)
+	require.NoError(t, err)
+	_, d3, err := v.TrustDevice(id, "fp-tablet", "Chrome no Android", now.Add(2*time.Minute), opts)
+	require.NoError(t, err)
+	list, err := v.Devices(id, later)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, d3.ID, list[0].ID)
+	require.Equal(t, d2.ID, list[1].ID)
+	require.Empty(t, list[0].Hash)
+	_, err = v.VerifyDevice(id, token, "fp-notebook", later)
+	require.ErrorIs(t, err, ErrDeviceNotTrusted)
+
+	require.NoError(t, v.RevokeDevice(id, d2.ID, "admin@brisa", later))
+	require.ErrorIs(t, v.RevokeDevice(id, d2.ID, "", later), ErrDeviceNotFound)
+	list, err = v.Devices(id, later)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.NoError(t, v.RevokeDevice(id, "", "", later))
+	list, err = v.Devices(id, later)
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	var revoke AuditEntry
+	for _, e := range entries {
+		if e.Event == AuditDeviceRevoke {
+			revoke = e
+			break
+		}
+	}
+	require.Equal(t, "admin@brisa", revoke.Actor)
+	require.True(t, revoke.Success)
+}
+
+func TestTrustedDeviceThrottle(t *testing.T) {
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{Throttle: ThrottleOtp{MaxFailures: 1}})
+	id := newActiveRecord(t, s, "otpauth://totp/Brisa:ana?secret=JBSWY3DPEHPK3PXP&issuer=Brisa")
+	now := time.Unix(1700000000, 0).UTC()
+
+	token, _, err := v.TrustDevice(id, "fp", "", now, DeviceOtp{})
+	require.NoError(t, err)
+	_, err = v.Verify(id, "000000", now)
+	require.ErrorIs(t, err, ErrValidateInvalidCode)
+	_, err = v.VerifyDevice(id, token, "fp", now)
+	require.ErrorIs(t, err, ErrValidateThrottled, "Conta bloqueada recusa também dispositivos")
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"time"
+)
+
+var ErrEnrollExpired = newError("enroll.expired", KindFailedPrecondition)
+var ErrEnrollNotPending = newError("enroll.not_pending", KindFailedPrecondition)
+
+// EnrollOtp fornece opções para Enrollment.
+type EnrollOtp struct {
+	Confirmations uint          // Códigos válidos antes de ativar a chave. O padrão é 1.
+	TTL           time.Duration // Validade de uma chave pendente. O padrão é 10 minutos.
+	Verify        VerifyOtp
+}
+
+// Enrollment cria chaves pendentes e só as ativa depois que o usuário
+// provar que adicionou a chave ao aplicativo OTP.
+type Enrollment struct {
+	store   KeyStore
+	otp     EnrollOtp
+	audit   *Auditor
+	metrics *Metrics
+}
+
+func NewEnrollment(store KeyStore, otp EnrollOtp) *Enrollment {
+	if otp.Confirmations == 0 {
+		otp.Confirmations = 1
+	}
+	if otp.TTL == 0 {
+		otp.TTL = 10 * time.Minute
+	}
+	return &Enrollment{store: store, otp: otp}
+}
+
+// UseAuditor faz o Enrollment registrar cadastros, confirmações e remoções em a.
+func (e *Enrollment) UseAuditor(a *Auditor) {
+	e.audit = a
+}
+
+// UseMetrics faz o Enrollment contar cadastros, confirmações e bloqueios em m.
+func (e *Enrollment) UseMetrics(m *Metrics) {
+	e.metrics = m
+}
+
+// BeginTOTP gera uma chave TOTP com Generates e a guarda como pendente.
+func (e *Enrollment) BeginTOTP(otp GeneratesOtp, t time.Time) (*Key, error) {
+	k, err := Generates(otp)
+	if err != nil {
+		return nil, err
+	}
+	return k, e.begin(k, t)
+}
+
+// BeginHOTP gera uma chave HOTP com Generate e a guarda como pendente.
+func (e *Enrollment) BeginHOTP(otp GenerateOtp, t time.Time) (*Key, error) {
+	k, err := Generate(otp)
+	if err != nil {
+		return nil, err
+	}
+	return k, e.begin(k, t)
+}
+
+func (e *Enrollment) begin(k *Key, t time.Time) error {
+	id := KeyID(k.Issuer(), k.AccountName())
+	err := e.put(id, k, t)
+	e.metrics.enrolled(k, err)
+	e.audit.recordResult(AuditEnroll, id, t, err)
+	return err
+}
+
+func (e *Enrollment) put(id string, k *Key, t time.Time) error {
+	rec := &KeyRecord{
+		ID:        id,
+		URL:       k.String(),
+		State:     KeyPending,
+		CreatedAt: t,
+		ExpiresAt: t.Add(e.otp.TTL),
+	}
+	err := createKey(e.store, rec)
+	if err != ErrKeyExists {
+		return err
+	}
+	// Um cadastro pendente pode ser refeito, uma chave ativa não. Após
+	// ForceReenroll a chave antiga é substituída.
+	return e.store.Update(id, func(old *KeyRecord) error {
+		if old.State != KeyPending && old.State != KeyReenroll {
+			return ErrKeyExists
+		}
+		*old = *rec.clone()
+		return nil
+	})
+}
+
+// Confirm valida um código para a chave pendente id e retorna o estado resultante.
+// Com Confirmations igual a 2 são necessários dois códigos de passos diferentes.
+func (e *Enrollment) Confirm(id string, passcode string, t time.Time) (KeyState, error) {
+	state, locked, err := e.confirm(id, passcode, t)
+	e.metrics.confirmed(err)
+	e.audit.recordResult(AuditConfirm, id, t, err)
+	if locked {
+		e.metrics.lockedOut("confirm")
+		e.audit.Record(AuditEntry{Time: t, Event: AuditLockout, Account: id, Success: true})
+	}
+	return state, err
+}
+
+func (e *Enrollment) confirm(id string, passcode string, t time.Time) (KeyState, bool, error) {
+	var (
+		state   KeyState
+		valid   bool
+		expired bool
+		locked  bool
+	)
+	err := e.store.Update(id, func(rec *KeyRecord) error {
+		state, valid, expired, locked = "", false, false, false
+		if rec.State != KeyPending {
+			return ErrEnrollNotPending
+		}
+		if !t.Before(rec.ExpiresAt) {
+			expired = true
+			return nil
+		}
+		if err := rec.Throttle.Allow(t); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		_, ok, err := ValidateRecord(passcode, rec, t, e.otp.Verify)
+		e.metrics.observeValidate("ValidateRecord", start)
+		if err != nil && err != ErrValidateReplayed {
+			return err
+		}
+		state = rec.State
+		if !ok {
+			locked = rec.Throttle.Fail(t, e.otp.Verify.Throttle)
+			return nil
+		}
+
+		valid = true
+		rec.Throttle.Reset()
+		rec.Confirmations++
+		if rec.Confirmations >= e.otp.Confirmations {
+			rec.State = KeyActive
+			rec.ActivatedAt = t
+			rec.ExpiresAt = time.Time{}
+		}
+		state = rec.State
+		return nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	if expired {
+		// Só sai no log a remoção que aconteceu: o cadastro pode ter sido
+		// refeito depois da leitura.
+		switch err := e.deleteExpired(id, t); err {
+		case nil:
+			e.audit.Record(AuditEntry{Time: t, Event: AuditDelete, Account: id, Actor: "system", Success: true})
+		case ErrKeyNotFound, ErrEnrollNotPending:
+		default:
+			return "", false, err
+		}
+		return "", false, ErrEnrollExpired
+	}
+	if !valid {
+		return state, locked, ErrValidateInvalidCode
+	}
+	return state, false, nil
+}
+
+// Cleanup remove os cadastros pendentes abandonados e retorna quantos foram removidos.
+func (e *Enrollment) Cleanup(t time.Time) (int, error) {
+	recs, err := e.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, rec := range recs {
+		if rec.State != KeyPending || t.Before(rec.ExpiresAt) {
+			continue
+		}
+		err := e.deleteExpired(rec.ID, t)
+		if err == ErrKeyNotFound || err == ErrEnrollNotPending {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		e.audit.Record(AuditEntry{Time: t, Event: AuditDelete, Account: rec.ID, Actor: "system", Success: true})
+		n++
+	}
+	return n, nil
+}
+
+// deleteExpired remove id só se ele ainda for um cadastro pendente vencido em t:
+// um cadastro refeito ou confirmado entre a leitura e a remoção fica.
+func (e *Enrollment) deleteExpired(id string, t time.Time) error {
+	return deleteKeyIf(e.store, id, func(rec *KeyRecord) error {
+		if rec.State != KeyPending || t.Before(rec.ExpiresAt) {
+			return ErrEnrollNotPending
+		}
+		return nil
+	})
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrollTOTP(t *testing.T) {
+	s := NewMemoryStore()
+	e := NewEnrollment(s, EnrollOtp{Confirmations: 2, Verify: VerifyOtp{Skew: 1}})
+	now := time.Unix(1700000000, 0).UTC()
+
+	k, err := e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "matiasdias@gmail.com"}, now)
+	require.NoError(t, err, "Iniciar cadastro")
+	id := KeyID("Brisa", "matiasdias@gmail.com")
+
+	rec, err := s.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, KeyPending, rec.State, "Chave começa pendente")
+
+	state, err := e.Confirm(id, "000000", now)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	require.Equal(t, KeyPending, state)
+
+	code, err := GenerateCodes(k.Secret(), now)
+	require.NoError(t, err)
+	state, err = e.Confirm(id, code, now)
+	require.NoError(t, err)
+	require.Equal(t, KeyPending, state, "Ainda falta o segundo código")
+
+	_, err = e.Confirm(id, code, now)
+	require.Equal(t, ErrValidateInvalidCode, err, "O mesmo código não conta duas vezes")
+
+	code, err = GenerateCodes(k.Secret(), now.Add(30*time.Second))
+	require.NoError(t, err)
+	state, err = e.Confirm(id, code, now.Add(30*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, KeyActive, state, "Ativada após dois códigos")
+
+	_, err = e.Confirm(id, code, now.Add(time.Minute))
+	require.Equal(t, ErrEnrollNotPending, err)
+
+	_, err = e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "matiasdias@gmail.com"}, now)
+	require.Equal(t, ErrKeyExists, err, "Chave ativa não pode ser substituída")
+}
+
+func TestEnrollHOTP(t *testing.T) {
+	s := NewMemoryStore()
+	e := NewEnrollment(s, EnrollOtp{})
+	now := time.Now()
+
+	k, err := e.BeginHOTP(GenerateOtp{Issuer: "Zenir", AccountName: "flavia@gmail.com"}, now)
+	require.NoError(t, err)
+
+	code, err := GenerateCode(k.Secret(), 0)
+	require.NoError(t, err)
+	state, err := e.Confirm(KeyID("Zenir", "flavia@gmail.com"), code, now)
+	require.NoError(t, err)
+	require.Equal(t, KeyActive, state)
+
+	rec, err := s.Get(KeyID("Zenir", "flavia@gmail.com"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rec.Counter, "Contador avançado após o uso")
+}
+
+func TestEnrollExpiry(t *testing.T) {
+	s := NewMemoryStore()
+	e := NewEnrollment(s, EnrollOtp{TTL: time.Minute})
+	now := time.Now()
+
+	k, err := e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "a@b.com"}, now)
+	require.NoError(t, err)
+	_, err = e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "c@d.com"}, now.Add(time.Minute))
+	require.NoError(t, err)
+
+	later := now.Add(2 * time.Minute)
+	code, err := GenerateCodes(k.Secret(), later)
+	require.NoError(t, err)
+	_, err = e.Confirm(KeyID("Brisa", "a@b.com"), code, later)
+	require.Equal(t, ErrEnrollExpired, err)
+	_, err = s.Get(KeyID("Brisa", "a@b.com"))
+	require.Equal(t, ErrKeyNotFound, err, "Cadastro expirado é removido")
+
+	n, err := e.Cleanup(now.Add(5 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, n, "Cadastros abandonados são limpos")
+	list, err := s.List()
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
+
+// staleList devolve em List uma leitura antiga, como um Cleanup que perdeu a
+// corrida para um novo cadastro.
+type staleList struct {
+	*MemoryStore
+	recs []*KeyRecord
+}
+
+func (s staleList) List() ([]*KeyRecord, error) { return s.recs, nil }
+
+func TestEnrollCleanupRace(t *testing.T) {
+	s := NewMemoryStore()
+	e := NewEnrollment(s, EnrollOtp{TTL: time.Minute})
+	now := time.Now()
+	id := KeyID("Brisa", "a@b.com")
+
+	_, err := e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "a@b.com"}, now)
+	require.NoError(t, err)
+	old, err := s.List()
+	require.NoError(t, err)
+
+	// O usuário refaz o cadastro depois da leitura: o novo não pode ser removido.
+	later := now.Add(2 * time.Minute)
+	_, err = e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "a@b.com"}, later)
+	require.NoError(t, err)
+	e.store = staleList{MemoryStore: s, recs: old}
+	n, err := e.Cleanup(later)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	rec, err := s.Get(id)
+	require.NoError(t, err, "Cadastro refeito continua")
+	require.True(t, later.Equal(rec.CreatedAt))
+
+	// Uma chave ativa não é substituída por um novo cadastro.
+	e.store = s
+	require.NoError(t, s.Update(id, func(rec *KeyRecord) error {
+		rec.State = KeyActive
+		return nil
+	}))
+	_, err = e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "a@b.com"}, later)
+	require.Equal(t, ErrKeyExists, err)
+}
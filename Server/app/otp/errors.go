@@ -0,0 +1,261 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kind é a categoria de um Error. Permite tratar grupos de erros de uma vez,
+// por exemplo errors.Is(err, KindUnauthenticated), e mapeá-los para status.
+type Kind string
+
+const (
+	KindInvalidArgument    Kind = "invalid_argument"
+	KindUnauthenticated    Kind = "unauthenticated"
+	KindNotFound           Kind = "not_found"
+	KindAlreadyExists      Kind = "already_exists"
+	KindFailedPrecondition Kind = "failed_precondition"
+	KindResourceExhausted  Kind = "resource_exhausted"
+	KindAborted            Kind = "aborted"
+	KindInternal           Kind = "internal"
+)
+
+func (k Kind) Error() string {
+	return string(k)
+}
+
+// Error é o erro tipado do pacote. Code é estável e pode ser usado por APIs;
+// a mensagem vem do catálogo no idioma pedido em Localize.
+type Error struct {
+	Code string
+	Kind Kind
+}
+
+func newError(code string, kind Kind) *Error {
+	return &Error{Code: code, Kind: kind}
+}
+
+// Error retorna a mensagem no idioma padrão (pt-BR).
+func (e *Error) Error() string {
+	return message(e.Code, DefaultLanguage)
+}
+
+// Is permite comparar um Error com a sua categoria.
+func (e *Error) Is(target error) bool {
+	k, ok := target.(Kind)
+	return ok && k == e.Kind
+}
+
+// DefaultLanguage é o idioma usado por Error() e quando não há tradução.
+const DefaultLanguage = "pt-BR"
+
+var (
+	catalogMu sync.RWMutex
+	catalog   = map[string]map[string]string{
+		"pt-BR": {
+			"validate.secret_invalid_base32": "Falha na decodificação do secredo com a base 32",
+			"validate.input_invalid_length":  "Comprimento de entrada inesperado",
+			"validate.invalid_code":          "Código inválido",
+			"validate.replayed":              "Código já utilizado",
+			"validate.throttled":             "Muitas tentativas inválidas, tente novamente mais tarde",
+			"generate.missing_issuer":        "Emissor deve ser definido",
+			"generate.missing_account_name":  "AccountName deve ser definido",
+			"key.not_found":                  "Chave não encontrada",
+			"key.exists":                     "Chave já cadastrada para esta conta",
+			"key.unknown_type":               "Tipo de chave desconhecido",
+			"key.not_active":                 "Chave não está ativa",
+			"enroll.expired":                 "Cadastro expirado, gere uma nova chave",
+			"enroll.not_pending":             "Chave não está aguardando confirmação",
+			"resync.not_hotp":                "Apenas chaves HOTP podem ser ressincronizadas",
+			"resync.invalid_window":          "Janela de ressincronização deve ser no máximo 1000",
+			"qr.unavailable":                 "QR code disponível apenas durante o cadastro ou uma rotação",
+			"qr.invalid_size":                "Tamanho do QR code deve estar entre 1 e 1024 pixels",
+			"grpc.unauthenticated":           "Credenciais do cliente inválidas",
+			"middleware.no_account":          "Conta não identificada",
+			"middleware.no_account_func":     "Middleware sem MiddlewareOtp.Account configurado",
+			"middleware.short_session_key":   "MiddlewareOtp.SessionKey deve ter ao menos 32 bytes",
+			"middleware.no_code":             "Código OTP obrigatório",
+			"radius.invalid_state":           "Desafio inválido ou expirado, entre novamente",
+			"radius.malformed":               "Pacote RADIUS inválido",
+			"gauth.malformed":                "Arquivo do google-authenticator inválido",
+			"ldap.malformed":                 "Mensagem LDAP inválida",
+			"stepup.invalid_key":             "Chave de assinatura inválida",
+			"forwardauth.short_key":          "Chave de sessão deve ter ao menos 32 bytes",
+			"stepup.invalid_token":           "Token de step-up inválido",
+			"stepup.unknown_key":             "Token assinado por chave desconhecida",
+			"stepup.expired":                 "Token de step-up expirado",
+			"device.not_trusted":             "Dispositivo não reconhecido",
+			"device.not_found":               "Dispositivo não encontrado",
+			"challenge.not_found":            "Nenhum código pendente, peça um novo",
+			"challenge.expired":              "Código expirado, peça um novo",
+			"challenge.too_soon":             "Aguarde antes de pedir outro código",
+			"channel.invalid_address":        "Endereço de entrega inválido",
+			"sms.rate_limited":               "Muitas mensagens para este número, tente mais tarde",
+			"sms.rejected":                   "O provedor de SMS recusou a mensagem",
+			"smtp.no_tls":                    "O servidor SMTP não oferece STARTTLS",
+			"sms.too_long":                   "Mensagem longa demais para um SMS",
+			"smpp.protocol":                  "Erro de protocolo SMPP",
+			"push.not_found":                 "Pedido de aprovação não encontrado",
+			"push.expired":                   "Pedido de aprovação expirado, tente de novo",
+			"push.denied":                    "Login recusado no aplicativo",
+			"push.answered":                  "Este pedido de aprovação já foi respondido",
+			"push.too_many":                  "Muitos pedidos de aprovação pendentes, aguarde",
+			"webhook.invalid":                "Assinatura de webhook inválida",
+			"webhook.not_found":              "Webhook não encontrado",
+			"admin.invalid_state":            "A chave não está em um estado que permita esta ação",
+			"admin.unauthorized":             "Credenciais de administrador inválidas",
+			"recovery.invalid_hash":          "Hash de código de recuperação inválido",
+			"crypt.unknown_key_version":      "Versão da chave mestra desconhecida",
+			"crypt.invalid_master_key":       "A chave mestra deve ter 32 bytes",
+			"crypt.invalid_ciphertext":       "Segredo cifrado inválido",
+			"derive.short_master_key":        "A chave mestra deve ter pelo menos 16 bytes",
+			"sql.conflict":                   "Registro alterado por outra transação, tente novamente",
+			"redis.protocol":                 "Resposta inválida do servidor Redis",
+		},
+		"en": {
+			"validate.secret_invalid_base32": "Failed to decode the secret as base32",
+			"validate.input_invalid_length":  "Unexpected input length",
+			"validate.invalid_code":          "Invalid code",
+			"validate.replayed":              "Code has already been used",
+			"validate.throttled":             "Too many invalid attempts, try again later",
+			"generate.missing_issuer":        "Issuer must be set",
+			"generate.missing_account_name":  "AccountName must be set",
+			"key.not_found":                  "Key not found",
+			"key.exists":                     "A key is already registered for this account",
+			"key.unknown_type":               "Unknown key type",
+			"key.not_active":                 "Key is not active",
+			"enroll.expired":                 "Enrollment expired, generate a new key",
+			"enroll.not_pending":             "Key is not awaiting confirmation",
+			"resync.not_hotp":                "Only HOTP keys can be resynchronized",
+			"resync.invalid_window":          "Resynchronization window must be at most 1000",
+			"qr.unavailable":                 "The QR code is only available during enrollment or a rotation",
+			"qr.invalid_size":                "The QR code size must be between 1 and 1024 pixels",
+			"grpc.unauthenticated":           "Invalid client credentials",
+			"middleware.no_account":          "Account not identified",
+			"middleware.no_account_func":     "Middleware without MiddlewareOtp.Account configured",
+			"middleware.short_session_key":   "MiddlewareOtp.SessionKey must be at least 32 bytes",
+			"middleware.no_code":             "OTP code required",
+			"radius.invalid_state":           "Invalid or expired challenge, sign in again",
+			"radius.malformed":               "Malformed RADIUS packet",
+			"gauth.malformed":                "Malformed google-authenticator file",
+			"ldap.malformed":                 "Malformed LDAP message",
+			"stepup.invalid_key":             "Invalid signing key",
+			"forwardauth.short_key":          "Session key must be at least 32 bytes",
+			"stepup.invalid_token":           "Invalid step-up token",
+			"stepup.unknown_key":             "Token signed by an unknown key",
+			"stepup.expired":                 "Step-up token expired",
+			"device.not_trusted":             "Device not recognized",
+			"device.not_found":               "Device not found",
+			"challenge.not_found":            "No pending code, request a new one",
+			"challenge.expired":              "Code expired, request a new one",
+			"challenge.too_soon":             "Wait before requesting another code",
+			"channel.invalid_address":        "Invalid delivery address",
+			"sms.rate_limited":               "Too many messages to this number, try again later",
+			"sms.rejected":                   "The SMS provider rejected the message",
+			"smtp.no_tls":                    "The SMTP server does not offer STARTTLS",
+			"sms.too_long":                   "Message too long for an SMS",
+			"smpp.protocol":                  "SMPP protocol error",
+			"push.not_found":                 "Approval request not found",
+			"push.expired":                   "Approval request expired, try again",
+			"push.denied":                    "Login denied in the app",
+			"push.answered":                  "This approval request has already been answered",
+			"push.too_many":                  "Too many pending approval requests, please wait",
+			"webhook.invalid":                "Invalid webhook subscription",
+			"webhook.not_found":              "Webhook not found",
+			"admin.invalid_state":            "The key is not in a state that allows this action",
+			"admin.unauthorized":             "Invalid administrator credentials",
+			"recovery.invalid_hash":          "Invalid recovery code hash",
+			"crypt.unknown_key_version":      "Unknown master key version",
+			"crypt.invalid_master_key":       "The master key must be 32 bytes long",
+			"crypt.invalid_ciphertext":       "Invalid encrypted secret",
+			"derive.short_master_key":        "The master key must be at least 16 bytes long",
+			"sql.conflict":                   "Record changed by another transaction, try again",
+			"redis.protocol":                 "Invalid response from the Redis server",
+		},
+	}
+)
+
+// RegisterMessages adiciona ou substitui traduções de um idioma.
+func RegisterMessages(lang string, msgs map[string]string) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	if catalog[lang] == nil {
+		catalog[lang] = map[string]string{}
+	}
+	for code, m := range msgs {
+		catalog[lang][code] = m
+	}
+}
+
+// Localize retorna a mensagem de err no idioma lang (ex.: "en", "en-US", "pt-BR").
+// Erros que não são do pacote retornam err.Error().
+func Localize(err error, lang string) string {
+	var e *Error
+	if !errors.As(err, &e) {
+		return err.Error()
+	}
+	return message(e.Code, lang)
+}
+
+// ErrorCode retorna o código estável de err, ou "" se ele não for do pacote.
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// message procura o código no idioma exato, depois no idioma base
+// ("en-US" -> "en", "pt" -> "pt-BR") e por fim no idioma padrão.
+func message(code, lang string) string {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+
+	for _, l := range languageFallbacks(lang) {
+		if m, ok := catalog[l][code]; ok {
+			return m
+		}
+	}
+	return code
+}
+
+func languageFallbacks(lang string) []string {
+	lang = strings.TrimSpace(lang)
+	base := strings.ToLower(strings.SplitN(strings.ReplaceAll(lang, "_", "-"), "-", 2)[0])
+	var same []string
+	for l := range catalog {
+		if l != lang && strings.EqualFold(strings.SplitN(l, "-", 2)[0], base) {
+			same = append(same, l)
+		}
+	}
+	sort.Strings(same)
+	out := append([]string{lang}, same...)
+	return append(out, DefaultLanguage)
+}
+
+// HTTPStatus mapeia a categoria de err para um status HTTP.
+func HTTPStatus(err error) int {
+	var e *Error
+	if !errors.As(err, &e) {
+		return http.StatusInternalServerError
+	}
+	switch e.Kind {
+	case KindInvalidArgument:
+		return http.StatusBadRequest
+	case KindUnauthenticated:
+		return http.StatusUnauthorized
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindAlreadyExists, KindAborted:
+		return http.StatusConflict
+	case KindFailedPrecondition:
+		return http.StatusForbidden
+	case KindResourceExhausted:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
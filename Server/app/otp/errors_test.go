@@ -0,0 +1,64 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorKinds(t *testing.T) {
+	err := fmt.Errorf("confirmar: %w", ErrValidateReplayed)
+	require.True(t, errors.Is(err, ErrValidateReplayed), "Erro embrulhado continua reconhecido")
+	require.True(t, errors.Is(err, KindUnauthenticated), "Erro pertence à sua categoria")
+	require.False(t, errors.Is(err, KindNotFound))
+
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, "validate.replayed", e.Code)
+	require.Equal(t, "validate.replayed", ErrorCode(err))
+	require.Equal(t, "", ErrorCode(errors.New("outro")))
+}
+
+func TestLocalize(t *testing.T) {
+	require.Equal(t, "Emissor deve ser definido", ErrGenerateMissingIssuer.Error(), "Padrão em pt-BR")
+	require.Equal(t, "Issuer must be set", Localize(ErrGenerateMissingIssuer, "en"))
+	require.Equal(t, "Issuer must be set", Localize(ErrGenerateMissingIssuer, "en-US"), "Idioma base")
+	require.Equal(t, "Emissor deve ser definido", Localize(ErrGenerateMissingIssuer, "pt"))
+	require.Equal(t, "Emissor deve ser definido", Localize(ErrGenerateMissingIssuer, "fr"), "Sem tradução usa o padrão")
+	require.Equal(t, "outro", Localize(errors.New("outro"), "en"))
+
+	RegisterMessages("es", map[string]string{"key.not_found": "Clave no encontrada"})
+	require.Equal(t, "Clave no encontrada", Localize(ErrKeyNotFound, "es-AR"))
+
+	// Todo erro do pacote precisa de mensagem nos dois idiomas.
+	for _, err := range []*Error{
+		ErrValidateSecretInvalidBase32, ErrValidateInputInvalidLength, ErrValidateInvalidCode,
+		ErrValidateReplayed, ErrValidateThrottled, ErrGenerateMissingIssuer, ErrGenerateMissingAccountName,
+		ErrKeyNotFound, ErrKeyExists, ErrKeyUnknownType, ErrKeyNotActive, ErrEnrollExpired,
+		ErrEnrollNotPending, ErrRecoveryInvalidHash, ErrCryptUnknownKeyVersion, ErrCryptInvalidMasterKey,
+		ErrCryptInvalidCiphertext, ErrDeriveShortMasterKey, ErrSQLConflict, ErrRedisProtocol, ErrResyncNotHOTP, ErrResyncInvalidWindow,
+		ErrQRUnavailable, ErrQRInvalidSize, ErrGRPCUnauthenticated, ErrMiddlewareNoAccount, ErrMiddlewareNoAccountFunc, ErrMiddlewareShortSessionKey, ErrMiddlewareNoCode, ErrRadiusMalformed, ErrRadiusInvalidState,
+		ErrGoogleAuthMalformed, ErrLDAPMalformed, ErrStepUpInvalidKey, ErrForwardAuthShortKey, ErrStepUpInvalidToken, ErrStepUpUnknownKey,
+		ErrStepUpExpired, ErrDeviceNotTrusted, ErrDeviceNotFound,
+		ErrChallengeNotFound, ErrChallengeExpired, ErrChallengeTooSoon, ErrChannelInvalidAddress,
+		ErrSMSRateLimited, ErrSMSRejected, ErrSMTPNoTLS, ErrSMSTooLong, ErrSMPPProtocol,
+		ErrPushNotFound, ErrPushExpired, ErrPushDenied, ErrPushAnswered, ErrPushTooMany,
+		ErrWebhookInvalid, ErrWebhookNotFound, ErrAdminInvalidState, ErrAdminUnauthorized,
+	} {
+		for _, lang := range []string{"pt-BR", "en"} {
+			_, ok := catalog[lang][err.Code]
+			require.True(t, ok, "Falta tradução %s para %s", lang, err.Code)
+		}
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	require.Equal(t, http.StatusUnauthorized, HTTPStatus(ErrValidateInvalidCode))
+	require.Equal(t, http.StatusTooManyRequests, HTTPStatus(ErrValidateThrottled))
+	require.Equal(t, http.StatusNotFound, HTTPStatus(fmt.Errorf("x: %w", ErrKeyNotFound)))
+	require.Equal(t, http.StatusBadRequest, HTTPStatus(ErrGenerateMissingIssuer))
+	require.Equal(t, http.StatusInternalServerError, HTTPStatus(errors.New("outro")))
+}
@@ -0,0 +1,253 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrForwardAuthShortKey = newError("forwardauth.short_key", KindInvalidArgument)
+
+// ForwardAuthOtp fornece opções para ForwardAuth.
+type ForwardAuthOtp struct {
+	Issuer        string        // Emissor das chaves; o formulário pede só a conta.
+	CookieName    string        // O padrão é "otp_session".
+	CookieDomain  string        // Domínio do cookie, para valer em vários subdomínios.
+	Secure        bool          // Envia o cookie apenas por HTTPS.
+	TTL           time.Duration // Validade da sessão. O padrão é 12 horas.
+	AccountHeader string        // Cabeçalho com a conta autenticada. O padrão é "X-OTP-Account".
+}
+
+func (o ForwardAuthOtp) defaults() ForwardAuthOtp {
+	if o.CookieName == "" {
+		o.CookieName = "otp_session"
+	}
+	if o.TTL == 0 {
+		o.TTL = 12 * time.Hour
+	}
+	if o.AccountHeader == "" {
+		o.AccountHeader = "X-OTP-Account"
+	}
+	return o
+}
+
+// ForwardAuth protege aplicações atrás de um proxy reverso, no estilo do
+// auth_request do nginx ou do ForwardAuth do Traefik. Os caminhos são:
+//
+//	/auth    200 com a conta em AccountHeader se a sessão for válida, senão 401
+//	/login   GET mostra o formulário, POST valida o código e cria a sessão
+//	/logout  remove a sessão
+//
+// Para montar em um prefixo use http.StripPrefix. Exemplo para o nginx:
+//
+//	location = /otp/auth { internal; proxy_pass http://otp/auth; }
+//	location / {
+//	    auth_request /otp/auth;
+//	    auth_request_set $account $upstream_http_x_otp_account;
+//	    error_page 401 = @login;
+//	}
+//	location @login { return 302 /otp/login?rd=$request_uri; }
+type ForwardAuth struct {
+	verify *Verifier
+	key    []byte
+	otp    ForwardAuthOtp
+	now    func() time.Time
+}
+
+// NewForwardAuth cria o handler. key assina os cookies de sessão com HMAC-SHA256,
+// deve ter ao menos 32 bytes e ser a mesma em todas as instâncias.
+func NewForwardAuth(verify *Verifier, key []byte, otp ForwardAuthOtp) (*ForwardAuth, error) {
+	if len(key) < minSessionKey {
+		return nil, ErrForwardAuthShortKey
+	}
+	return &ForwardAuth{verify: verify, key: append([]byte(nil), key...), otp: otp.defaults(), now: time.Now}, nil
+}
+
+func (f *ForwardAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.URL.Path {
+	case "/auth":
+		f.check(w, r)
+	case "/login":
+		f.login(w, r)
+	case "/logout":
+		f.logout(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *ForwardAuth) check(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(f.otp.CookieName)
+	if err == nil {
+		if id, ok := openSession(f.key, sessionForwardAuth, c.Value, f.now()); ok {
+			w.Header().Set(f.otp.AccountHeader, id)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (f *ForwardAuth) login(w http.ResponseWriter, r *http.Request) {
+	rd := r.FormValue("rd")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		f.prompt(w, http.StatusOK, "", rd, "")
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	account := strings.TrimSpace(r.PostFormValue("account"))
+	t := f.now()
+	id := KeyID(f.otp.Issuer, account)
+	if _, err := f.verify.Verify(id, r.PostFormValue("code"), t); err != nil {
+		// Conta inexistente e código errado respondem igual.
+		if err == ErrKeyNotFound || err == ErrKeyNotActive {
+			err = ErrValidateInvalidCode
+		}
+		f.prompt(w, HTTPStatus(err), account, rd, Localize(err, r.Header.Get("Accept-Language")))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.otp.CookieName,
+		Value:    sealSession(f.key, sessionForwardAuth, id, t.Add(f.otp.TTL)),
+		Path:     "/",
+		Domain:   f.otp.CookieDomain,
+		Expires:  t.Add(f.otp.TTL),
+		Secure:   f.otp.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if !f.allowedRedirect(rd) {
+		rd = "/"
+	}
+	http.Redirect(w, r, rd, http.StatusSeeOther)
+}
+
+func (f *ForwardAuth) logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     f.otp.CookieName,
+		Path:     "/",
+		Domain:   f.otp.CookieDomain,
+		MaxAge:   -1,
+		Secure:   f.otp.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// allowedRedirect aceita caminhos locais e URLs no domínio do cookie, para
+// que o formulário não sirva de redirecionamento aberto.
+func (f *ForwardAuth) allowedRedirect(rd string) bool {
+	if rd == "" {
+		return false
+	}
+	u, err := url.Parse(rd)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(rd, "/") && !strings.HasPrefix(rd, "//") && !strings.HasPrefix(rd, "/\\")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return false
+	}
+	domain := strings.TrimPrefix(f.otp.CookieDomain, ".")
+	host := u.Hostname()
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+var promptTemplate = template.Must(template.New("prompt").Parse(`<!DOCTYPE html>
+<html lang="pt-BR">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Verificação em duas etapas</title>
+<style>
+body { font-family: sans-serif; display: flex; justify-content: center; margin-top: 10vh; }
+form { display: flex; flex-direction: column; gap: .5em; width: 16em; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<form method="post" action="login">
+<h1>{{.Issuer}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<label>Conta <input name="account" value="{{.Account}}" autocomplete="username" required></label>
+<label>Código <input name="code" inputmode="numeric" autocomplete="one-time-code" pattern="[0-9]*" required autofocus></label>
+<input type="hidden" name="rd" value="{{.Redirect}}">
+<button type="submit">Entrar</button>
+</form>
+</body>
+</html>
+`))
+
+func (f *ForwardAuth) prompt(w http.ResponseWriter, status int, account, rd, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	promptTemplate.Execute(w, struct {
+		Issuer, Account, Redirect, Error string
+	}{f.otp.Issuer, account, rd, msg})
+}
+
+// Usos de sealSession. O rótulo entra no HMAC, para que um valor assinado para
+// um uso não valha em outro quando a chave é compartilhada.
+const (
+	sessionForwardAuth = "forwardauth"  // cookie de ForwardAuth
+	sessionStepUp      = "stepup"       // cookie step-up do Middleware
+	sessionRadiusState = "radius_state" // State de um desafio RADIUS
+)
+
+// minSessionKey é o tamanho mínimo das chaves de sealSession, o do HMAC-SHA256.
+const minSessionKey = sha256.Size
+
+// sealSession gera o valor do cookie: base64(expiração|id).base64(HMAC).
+func sealSession(key []byte, label, id string, exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(exp.Unix(), 10) + "|" + id))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sessionMAC(key, label, payload))
+}
+
+// openSession confere a assinatura, o uso e a validade de um valor de sealSession.
+func openSession(key []byte, label, value string, t time.Time) (string, bool) {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, sessionMAC(key, label, payload)) {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+	exp, id, ok := strings.Cut(string(b), "|")
+	if !ok {
+		return "", false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || !t.Before(time.Unix(unix, 0)) {
+		return "", false
+	}
+	return id, true
+}
+
+func sessionMAC(key []byte, label, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label + "\x00"))
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardAuth(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Unix(1700000000, 0).UTC()
+	secret := "JBSWY3DPEHPK3PXP"
+	newActiveRecord(t, s, "otpauth://totp/Painel:ana?secret="+secret+"&issuer=Painel")
+
+	key := []byte("chave-de-sessao-com-32-bytes-ou-mais")
+	_, err := NewForwardAuth(nil, key[:31], ForwardAuthOtp{})
+	require.ErrorIs(t, err, ErrForwardAuthShortKey, "Chave curta permitiria forjar cookies")
+	f, err := NewForwardAuth(NewVerifier(s, VerifyOtp{Skew: 1}), key, ForwardAuthOtp{Issuer: "Painel", CookieDomain: "example.com", TTL: time.Hour})
+	require.NoError(t, err)
+	f.now = func() time.Time { return now }
+
+	do := func(method, target string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if form != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r.Header.Set("Accept-Language", "en")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("GET", "/auth", nil, nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code, "Sem sessão")
+
+	w = do("GET", "/login?rd=/painel", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `name="rd" value="/painel"`)
+
+	w = do("POST", "/login", url.Values{"account": {"ana"}, "code": {"000000"}, "rd": {"/painel"}}, nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), "Invalid code")
+	require.Empty(t, w.Result().Cookies())
+
+	w = do("POST", "/login", url.Values{"account": {"bruno"}, "code": {"000000"}}, nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code, "Conta inexistente responde como código errado")
+
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+	w = do("POST", "/login", url.Values{"account": {"ana"}, "code": {code}, "rd": {"https://grafana.example.com/d/1"}}, nil)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "https://grafana.example.com/d/1", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	session := cookies[0]
+	require.True(t, session.HttpOnly)
+	require.Equal(t, "example.com", session.Domain)
+
+	w = do("GET", "/auth", nil, session)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "Painel:ana", w.Header().Get("X-OTP-Account"))
+
+	// Cookie adulterado ou expirado.
+	forged := *session
+	forged.Value = sealSession([]byte("outra chave"), sessionForwardAuth, "Painel:ana", now.Add(time.Hour))
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/auth", nil, &forged).Code)
+	forged.Value = sealSession(key, sessionStepUp, "Painel:ana", now.Add(time.Hour))
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/auth", nil, &forged).Code, "Cookie de outro uso")
+	f.now = func() time.Time { return now.Add(time.Hour) }
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/auth", nil, session).Code)
+
+	w = do("GET", "/logout", nil, session)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+}
+
+func TestForwardAuthRedirect(t *testing.T) {
+	f, err := NewForwardAuth(nil, make([]byte, 32), ForwardAuthOtp{CookieDomain: ".example.com"})
+	require.NoError(t, err)
+	for rd, ok := range map[string]bool{
+		"/painel":                    true,
+		"https://example.com/":       true,
+		"https://a.b.example.com/x":  true,
+		"":                           false,
+		"//evil.com/":                false,
+		"/\\evil.com":                false,
+		"https://evil.com/":          false,
+		"https://notexample.com/":    false,
+		"javascript:alert(1)":        false,
+		"https://example.com.evil/x": false,
+	} {
+		require.Equal(t, ok, f.allowedRedirect(rd), rd)
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	key := []byte("k")
+	now := time.Unix(1700000000, 0)
+	v := sealSession(key, sessionForwardAuth, "Painel:a|b", now.Add(time.Minute))
+	id, ok := openSession(key, sessionForwardAuth, v, now)
+	require.True(t, ok)
+	require.Equal(t, "Painel:a|b", id)
+
+	_, ok = openSession(key, sessionStepUp, v, now)
+	require.False(t, ok, "Rótulo de outro uso")
+	_, ok = openSession(key, sessionForwardAuth, v+"x", now)
+	require.False(t, ok)
+	_, ok = openSession(key, sessionForwardAuth, "semponto", now)
+	require.False(t, ok)
+}
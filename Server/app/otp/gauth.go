@@ -0,0 +1,318 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrGoogleAuthMalformed = newError("gauth.malformed", KindInvalidArgument)
+
+// GoogleAuthFile é o conteúdo de um ~/.google_authenticator do
+// google-authenticator-libpam: o segredo na primeira linha, opções começando
+// com `" ` e depois os códigos de emergência (scratch codes) de 8 dígitos.
+type GoogleAuthFile struct {
+	Secret        string
+	TOTP          bool    // TOTP_AUTH; sem ela a chave é HOTP
+	HOTPCounter   uint64  // HOTP_COUNTER: próximo contador esperado
+	StepSize      uint    // STEP_SIZE em segundos, 30 se 0
+	WindowSize    uint    // WINDOW_SIZE: códigos aceitos ao todo, 3 se 0
+	DisallowReuse bool    // DISALLOW_REUSE
+	UsedSteps     []int64 // passos já usados, quando DisallowReuse
+	RateLimit     *GoogleAuthRateLimit
+	ScratchCodes  []string
+	Extra         []string // outras opções, mantidas como estão
+}
+
+// GoogleAuthRateLimit é a opção RATE_LIMIT: no máximo Limit tentativas a
+// cada Interval segundos. Attempts guarda os horários (Unix) das tentativas.
+type GoogleAuthRateLimit struct {
+	Limit    uint
+	Interval uint
+	Attempts []int64
+}
+
+// ParseGoogleAuth lê um arquivo no formato do google-authenticator-libpam.
+func ParseGoogleAuth(r io.Reader) (*GoogleAuthFile, error) {
+	sc := bufio.NewScanner(r)
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrGoogleAuthMalformed
+	}
+	f := &GoogleAuthFile{Secret: strings.TrimSpace(sc.Text())}
+	if f.Secret == "" {
+		return nil, ErrGoogleAuthMalformed
+	}
+
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, `"`) {
+			if len(line) != 8 || strings.Trim(line, "0123456789") != "" {
+				return nil, ErrGoogleAuthMalformed
+			}
+			f.ScratchCodes = append(f.ScratchCodes, line)
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, `"`))
+		if len(fields) == 0 {
+			continue
+		}
+		nums, err := parseInts(fields[1:])
+		switch fields[0] {
+		case "TOTP_AUTH":
+			f.TOTP = true
+		case "HOTP_COUNTER":
+			if err != nil || len(nums) != 1 || nums[0] < 0 {
+				return nil, ErrGoogleAuthMalformed
+			}
+			f.HOTPCounter = uint64(nums[0])
+		case "STEP_SIZE":
+			if err != nil || len(nums) != 1 || nums[0] < 1 || nums[0] > 60 {
+				return nil, ErrGoogleAuthMalformed
+			}
+			f.StepSize = uint(nums[0])
+		case "WINDOW_SIZE":
+			if err != nil || len(nums) != 1 || nums[0] < 1 || nums[0] > 100 {
+				return nil, ErrGoogleAuthMalformed
+			}
+			f.WindowSize = uint(nums[0])
+		case "DISALLOW_REUSE":
+			if err != nil {
+				return nil, ErrGoogleAuthMalformed
+			}
+			f.DisallowReuse = true
+			f.UsedSteps = nums
+		case "RATE_LIMIT":
+			if err != nil || len(nums) < 2 || nums[0] < 1 || nums[1] < 1 {
+				return nil, ErrGoogleAuthMalformed
+			}
+			f.RateLimit = &GoogleAuthRateLimit{Limit: uint(nums[0]), Interval: uint(nums[1]), Attempts: nums[2:]}
+		default:
+			f.Extra = append(f.Extra, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseInts(fields []string) ([]int64, error) {
+	out := make([]int64, 0, len(fields))
+	for _, s := range fields {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// WriteTo grava f no mesmo formato, na ordem usada pelo google-authenticator.
+func (f *GoogleAuthFile) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	b.WriteString(f.Secret + "\n")
+	if f.RateLimit != nil {
+		fmt.Fprintf(&b, "\" RATE_LIMIT %d %d%s\n", f.RateLimit.Limit, f.RateLimit.Interval, joinInts(f.RateLimit.Attempts))
+	}
+	if f.WindowSize != 0 {
+		fmt.Fprintf(&b, "\" WINDOW_SIZE %d\n", f.WindowSize)
+	}
+	if f.DisallowReuse {
+		fmt.Fprintf(&b, "\" DISALLOW_REUSE%s\n", joinInts(f.UsedSteps))
+	}
+	if f.TOTP {
+		b.WriteString("\" TOTP_AUTH\n")
+	} else {
+		fmt.Fprintf(&b, "\" HOTP_COUNTER %d\n", f.HOTPCounter)
+	}
+	if f.StepSize != 0 {
+		fmt.Fprintf(&b, "\" STEP_SIZE %d\n", f.StepSize)
+	}
+	for _, l := range f.Extra {
+		b.WriteString(l + "\n")
+	}
+	for _, c := range f.ScratchCodes {
+		b.WriteString(c + "\n")
+	}
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+func joinInts(nums []int64) string {
+	var sb strings.Builder
+	for _, n := range nums {
+		sb.WriteString(" " + strconv.FormatInt(n, 10))
+	}
+	return sb.String()
+}
+
+func (f *GoogleAuthFile) stepSize() uint {
+	if f.StepSize == 0 {
+		return 30
+	}
+	return f.StepSize
+}
+
+func (f *GoogleAuthFile) windowSize() uint {
+	if f.WindowSize == 0 {
+		return 3
+	}
+	return f.WindowSize
+}
+
+// Key retorna a chave equivalente. O google-authenticator usa sempre 6 dígitos e SHA1.
+func (f *GoogleAuthFile) Key(issuer, accountName string) (*Key, error) {
+	if issuer == "" {
+		return nil, ErrGenerateMissingIssuer
+	}
+	if accountName == "" {
+		return nil, ErrGenerateMissingAccountName
+	}
+	v := url.Values{}
+	v.Set("secret", strings.ToUpper(f.Secret))
+	v.Set("issuer", issuer)
+	v.Set("algorithm", AlgorithmSHA1.String())
+	v.Set("digits", DigitsSix.String())
+	typ := "hotp"
+	if f.TOTP {
+		typ = "totp"
+		v.Set("period", strconv.FormatUint(uint64(f.stepSize()), 10))
+	} else {
+		v.Set("counter", strconv.FormatUint(f.HOTPCounter, 10))
+	}
+	u := url.URL{Scheme: "otpauth", Host: typ, Path: "/" + issuer + ":" + accountName, RawQuery: v.Encode()}
+	return NewKeyFromURL(u.String())
+}
+
+// VerifyOtp converte WINDOW_SIZE para as opções do Verifier.
+func (f *GoogleAuthFile) VerifyOtp() VerifyOtp {
+	w := f.windowSize()
+	if f.TOTP {
+		return VerifyOtp{Skew: (w - 1) / 2}
+	}
+	return VerifyOtp{LookAhead: w - 1}
+}
+
+// Record converte f em um KeyRecord ativo para importação em um KeyStore.
+// Os scratch codes viram códigos de recuperação, guardados apenas como hash.
+func (f *GoogleAuthFile) Record(issuer, accountName string, t time.Time, ropt RecoveryOtp) (*KeyRecord, error) {
+	k, err := f.Key(issuer, accountName)
+	if err != nil {
+		return nil, err
+	}
+	rec := &KeyRecord{
+		ID:          KeyID(issuer, accountName),
+		URL:         k.String(),
+		State:       KeyActive,
+		CreatedAt:   t,
+		ActivatedAt: t,
+		Counter:     f.HOTPCounter,
+	}
+	for _, s := range f.UsedSteps {
+		if s > rec.LastStep {
+			rec.LastStep = s
+		}
+	}
+	if len(f.ScratchCodes) > 0 {
+		ropt = ropt.defaults()
+		rec.Recovery = &RecoveryCodes{}
+		for _, c := range f.ScratchCodes {
+			h, err := hashRecoveryCode(c, ropt)
+			if err != nil {
+				return nil, err
+			}
+			rec.Recovery.Hashes = append(rec.Recovery.Hashes, h)
+		}
+	}
+	return rec, nil
+}
+
+// Verify valida code como o pam_google_authenticator: respeita RATE_LIMIT,
+// aceita um scratch code de 8 dígitos (removendo-o) ou um código dentro de
+// WINDOW_SIZE, e atualiza HOTP_COUNTER ou DISALLOW_REUSE. f sempre muda, pois
+// toda tentativa conta para o RATE_LIMIT, e deve ser gravado depois.
+func (f *GoogleAuthFile) Verify(code string, t time.Time) (Match, error) {
+	if rl := f.RateLimit; rl != nil {
+		now := t.Unix()
+		kept := rl.Attempts[:0]
+		for _, a := range rl.Attempts {
+			if a > now-int64(rl.Interval) && a <= now {
+				kept = append(kept, a)
+			}
+		}
+		rl.Attempts = append(kept, now)
+		if uint(len(rl.Attempts)) > rl.Limit {
+			return Match{}, ErrValidateThrottled
+		}
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == 8 {
+		for i, c := range f.ScratchCodes {
+			if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+				f.ScratchCodes = append(f.ScratchCodes[:i:i], f.ScratchCodes[i+1:]...)
+				return Match{Method: MethodRecovery}, nil
+			}
+		}
+		return Match{}, ErrValidateInvalidCode
+	}
+
+	opts := ValidateOtps{Digits: DigitsSix, Algorithm: AlgorithmSHA1}
+	w := f.windowSize()
+	if !f.TOTP {
+		for i := uint64(0); i < uint64(w); i++ {
+			ok, err := ValidateCustom(code, f.HOTPCounter+i, f.Secret, opts)
+			if err != nil {
+				return Match{}, err
+			}
+			if ok {
+				f.HOTPCounter += i + 1
+				return Match{Method: MethodHOTP, Offset: int(i)}, nil
+			}
+		}
+		return Match{}, ErrValidateInvalidCode
+	}
+
+	step := t.Unix() / int64(f.stepSize())
+	for _, off := range skewOffsets((w - 1) / 2) {
+		s := step + int64(off)
+		ok, err := ValidateCustom(code, uint64(s), f.Secret, opts)
+		if err != nil {
+			return Match{}, err
+		}
+		if !ok {
+			continue
+		}
+		if f.DisallowReuse {
+			for _, u := range f.UsedSteps {
+				if u == s {
+					return Match{}, ErrValidateReplayed
+				}
+			}
+			// Só interessam passos que ainda cabem na janela.
+			kept := f.UsedSteps[:0]
+			for _, u := range f.UsedSteps {
+				if u > step-int64(w) && u < step+int64(w) {
+					kept = append(kept, u)
+				}
+			}
+			f.UsedSteps = append(kept, s)
+		}
+		return Match{Method: MethodTOTP, Offset: off}, nil
+	}
+	return Match{}, ErrValidateInvalidCode
+}
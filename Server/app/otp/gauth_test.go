@@ -0,0 +1,142 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testGoogleAuthFile = `JBSWY3DPEHPK3PXP
+" RATE_LIMIT 3 30 1699999990
+" WINDOW_SIZE 5
+" DISALLOW_REUSE 56666665
+" TOTP_AUTH
+" TIME_SKEW 0
+12345678
+87654321
+`
+
+func TestGoogleAuthParse(t *testing.T) {
+	f, err := ParseGoogleAuth(strings.NewReader(testGoogleAuthFile))
+	require.NoError(t, err)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", f.Secret)
+	require.True(t, f.TOTP)
+	require.Equal(t, uint(5), f.WindowSize)
+	require.True(t, f.DisallowReuse)
+	require.Equal(t, []int64{56666665}, f.UsedSteps)
+	require.Equal(t, &GoogleAuthRateLimit{Limit: 3, Interval: 30, Attempts: []int64{1699999990}}, f.RateLimit)
+	require.Equal(t, []string{`" TIME_SKEW 0`}, f.Extra, "Opções desconhecidas são mantidas")
+	require.Equal(t, []string{"12345678", "87654321"}, f.ScratchCodes)
+	require.Equal(t, VerifyOtp{Skew: 2}, f.VerifyOtp())
+
+	var b strings.Builder
+	_, err = f.WriteTo(&b)
+	require.NoError(t, err)
+	require.Equal(t, testGoogleAuthFile, b.String(), "Gravar o que foi lido não muda o arquivo")
+
+	k, err := f.Key("Servidor", "ana")
+	require.NoError(t, err)
+	require.Equal(t, "totp", k.Type())
+	require.Equal(t, "JBSWY3DPEHPK3PXP", k.Secret())
+	require.Equal(t, uint64(30), k.Period())
+
+	for _, bad := range []string{"", "SEGREDO\n123\n", "SEGREDO\n\" WINDOW_SIZE x\n", "SEGREDO\n\" RATE_LIMIT 3\n"} {
+		_, err := ParseGoogleAuth(strings.NewReader(bad))
+		require.Equal(t, ErrGoogleAuthMalformed, err, bad)
+	}
+}
+
+func TestGoogleAuthVerifyTOTP(t *testing.T) {
+	f, err := ParseGoogleAuth(strings.NewReader(testGoogleAuthFile))
+	require.NoError(t, err)
+	f.RateLimit.Limit = 10
+	now := time.Unix(1700000000, 0)
+
+	code, err := GenerateCodes(f.Secret, now.Add(-60*time.Second))
+	require.NoError(t, err)
+	m, err := f.Verify(code, now)
+	require.NoError(t, err, "Dentro de WINDOW_SIZE 5")
+	require.Equal(t, Match{Method: MethodTOTP, Offset: -2}, m)
+	_, err = f.Verify(code, now)
+	require.Equal(t, ErrValidateReplayed, err)
+	require.Equal(t, []int64{56666665, 56666664}, f.UsedSteps)
+
+	f.UsedSteps = []int64{56666600, 56666665}
+	code, err = GenerateCodes(f.Secret, now)
+	require.NoError(t, err)
+	_, err = f.Verify(code, now)
+	require.NoError(t, err)
+	require.Equal(t, []int64{56666665, 56666666}, f.UsedSteps, "Passos fora da janela são descartados")
+
+	m, err = f.Verify("87654321", now)
+	require.NoError(t, err)
+	require.Equal(t, MethodRecovery, m.Method)
+	require.Equal(t, []string{"12345678"}, f.ScratchCodes)
+	_, err = f.Verify("87654321", now)
+	require.Equal(t, ErrValidateInvalidCode, err, "Scratch code é de uso único")
+
+	_, err = f.Verify("000000", now)
+	require.Equal(t, ErrValidateInvalidCode, err)
+}
+
+func TestGoogleAuthRateLimit(t *testing.T) {
+	f, err := ParseGoogleAuth(strings.NewReader(testGoogleAuthFile))
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+
+	_, err = f.Verify("000000", now)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = f.Verify("000000", now.Add(time.Second))
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = f.Verify("000000", now.Add(2*time.Second))
+	require.Equal(t, ErrValidateThrottled, err, "Quarta tentativa em 30 segundos, contando a do arquivo")
+
+	// Depois do intervalo a tentativa antiga deixa de contar.
+	code, err := GenerateCodes(f.Secret, now.Add(31*time.Second))
+	require.NoError(t, err)
+	_, err = f.Verify(code, now.Add(31*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, []int64{1700000002, 1700000031}, f.RateLimit.Attempts)
+}
+
+func TestGoogleAuthHOTP(t *testing.T) {
+	f, err := ParseGoogleAuth(strings.NewReader("JBSWY3DPEHPK3PXP\n\" HOTP_COUNTER 4\n"))
+	require.NoError(t, err)
+	require.False(t, f.TOTP)
+	require.Equal(t, VerifyOtp{LookAhead: 2}, f.VerifyOtp())
+
+	code, err := GenerateCode(f.Secret, 6)
+	require.NoError(t, err)
+	m, err := f.Verify(code, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, Match{Method: MethodHOTP, Offset: 2}, m)
+	require.Equal(t, uint64(7), f.HOTPCounter)
+
+	code, err = GenerateCode(f.Secret, 10)
+	require.NoError(t, err)
+	_, err = f.Verify(code, time.Now())
+	require.Equal(t, ErrValidateInvalidCode, err, "Fora de WINDOW_SIZE")
+}
+
+func TestGoogleAuthRecord(t *testing.T) {
+	f, err := ParseGoogleAuth(strings.NewReader(testGoogleAuthFile))
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	rec, err := f.Record("Servidor", "ana", now, testRecoveryOtp)
+	require.NoError(t, err)
+	require.Equal(t, "Servidor:ana", rec.ID)
+	require.Equal(t, KeyActive, rec.State)
+	require.Equal(t, int64(56666665), rec.LastStep)
+	require.Equal(t, 2, rec.Recovery.Remaining())
+
+	s := NewMemoryStore()
+	require.NoError(t, s.Put(rec))
+	v := NewVerifier(s, f.VerifyOtp())
+	require.NoError(t, v.VerifyRecovery(rec.ID, "12345678", now, testRecoveryOtp), "Scratch code importado")
+	code, err := GenerateCodes(f.Secret, now)
+	require.NoError(t, err)
+	_, err = v.Verify(rec.ID, code, now)
+	require.NoError(t, err)
+}
@@ -0,0 +1,279 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"otp/app/otppb"
+)
+
+var ErrQRUnavailable = newError("qr.unavailable", KindFailedPrecondition)
+var ErrQRInvalidSize = newError("qr.invalid_size", KindInvalidArgument)
+var ErrGRPCUnauthenticated = newError("grpc.unauthenticated", KindUnauthenticated)
+
+// Lado máximo, em pixels, da imagem de GetQR.
+const maxQRSize = 1024
+
+// GRPCServer implementa o serviço otp.v1.OTP (ver otppb/otp.proto) sobre um
+// Enrollment e um Verifier que compartilham o mesmo KeyStore.
+//
+// O serviço expõe segredos e remove chaves, por isso deve ser servido com
+// GRPCAuth: sem um cliente autenticado Delete é recusado, e o Actor da
+// auditoria é o nome retornado pela autenticação, não o enviado na requisição.
+//
+//	s := grpc.NewServer(grpc.UnaryInterceptor(app.GRPCAuth(app.GRPCTokens(tokens))))
+//	otppb.RegisterOTPServer(s, app.NewGRPCServer(enrollment, verifier))
+type GRPCServer struct {
+	otppb.UnimplementedOTPServer
+	enroll *Enrollment
+	verify *Verifier
+	now    func() time.Time
+}
+
+func NewGRPCServer(enroll *Enrollment, verify *Verifier) *GRPCServer {
+	return &GRPCServer{enroll: enroll, verify: verify, now: time.Now}
+}
+
+func (s *GRPCServer) Enroll(ctx context.Context, req *otppb.EnrollRequest) (*otppb.EnrollResponse, error) {
+	digits := Digits(req.Digits)
+	switch digits {
+	case 0:
+		digits = DigitsSix
+	case DigitsSix, DigitsEight:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "digits deve ser 6 ou 8")
+	}
+	alg := Algorithm(req.Algorithm)
+	if _, ok := otppb.Algorithm_name[int32(req.Algorithm)]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "algoritmo desconhecido")
+	}
+
+	var (
+		k   *Key
+		err error
+	)
+	switch req.Type {
+	case otppb.KeyType_KEY_TYPE_TOTP:
+		k, err = s.enroll.BeginTOTP(GeneratesOtp{
+			Issuer:      req.Issuer,
+			AccountName: req.AccountName,
+			Period:      uint(req.Period),
+			SecretSize:  uint(req.SecretSize),
+			Digits:      digits,
+			Algorithm:   alg,
+		}, s.now())
+	case otppb.KeyType_KEY_TYPE_HOTP:
+		k, err = s.enroll.BeginHOTP(GenerateOtp{
+			Issuer:      req.Issuer,
+			AccountName: req.AccountName,
+			SecretSize:  uint(req.SecretSize),
+			Digits:      digits,
+			Algorithm:   alg,
+		}, s.now())
+	default:
+		err = ErrKeyUnknownType
+	}
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &otppb.EnrollResponse{
+		Id:     KeyID(k.Issuer(), k.AccountName()),
+		Url:    k.String(),
+		Secret: k.Secret(),
+	}, nil
+}
+
+func (s *GRPCServer) Confirm(ctx context.Context, req *otppb.ConfirmRequest) (*otppb.ConfirmResponse, error) {
+	state, err := s.enroll.Confirm(req.Id, req.Passcode, s.now())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &otppb.ConfirmResponse{State: string(state)}, nil
+}
+
+func (s *GRPCServer) Verify(ctx context.Context, req *otppb.VerifyRequest) (*otppb.VerifyResponse, error) {
+	m, err := s.verify.Verify(req.Id, req.Passcode, s.now())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &otppb.VerifyResponse{
+		Method:     string(m.Method),
+		Offset:     int32(m.Offset),
+		SecretSlot: string(m.Secret),
+	}, nil
+}
+
+func (s *GRPCServer) Resync(ctx context.Context, req *otppb.ResyncRequest) (*otppb.ResyncResponse, error) {
+	counter, err := s.verify.Resync(req.Id, req.First, req.Second, uint(req.Window), s.now())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &otppb.ResyncResponse{Counter: counter}, nil
+}
+
+func (s *GRPCServer) Rotate(ctx context.Context, req *otppb.RotateRequest) (*otppb.RotateResponse, error) {
+	if req.GraceSeconds < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "grace_seconds não pode ser negativo")
+	}
+	t := s.now()
+	grace := time.Duration(req.GraceSeconds) * time.Second
+	k, err := s.verify.Rotate(req.Id, grace, t)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &otppb.RotateResponse{
+		Url:        k.String(),
+		Secret:     k.Secret(),
+		GraceUntil: t.Add(grace).Unix(),
+	}, nil
+}
+
+// Delete ignora req.Actor: quem remove é o cliente autenticado por GRPCAuth.
+func (s *GRPCServer) Delete(ctx context.Context, req *otppb.DeleteRequest) (*otppb.DeleteResponse, error) {
+	actor := GRPCActor(ctx)
+	if actor == "" {
+		return nil, grpcError(ctx, ErrGRPCUnauthenticated)
+	}
+	if err := s.verify.Delete(req.Id, actor, s.now()); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &otppb.DeleteResponse{}, nil
+}
+
+// GetQR só mostra segredos que o usuário ainda precisa adicionar ao aplicativo:
+// o de uma chave pendente ou o novo de uma rotação em andamento.
+func (s *GRPCServer) GetQR(ctx context.Context, req *otppb.GetQRRequest) (*otppb.GetQRResponse, error) {
+	rec, err := s.verify.store.Get(req.Id)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	url := rec.NextURL
+	if rec.State == KeyPending {
+		url = rec.URL
+	}
+	if url == "" {
+		return nil, grpcError(ctx, ErrQRUnavailable)
+	}
+
+	k, err := NewKeyFromURL(url)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	// Size é uint32: só o limite superior precisa ser conferido.
+	size := int(req.Size)
+	if size == 0 {
+		size = 200
+	}
+	if size > maxQRSize {
+		return nil, grpcError(ctx, ErrQRInvalidSize)
+	}
+	img, err := k.Image(size, size)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &otppb.GetQRResponse{Url: url, Png: buf.Bytes()}, nil
+}
+
+type grpcActorKey struct{}
+
+// GRPCAuth retorna um interceptor que autentica cada chamada com auth e guarda
+// o nome do cliente no contexto, lido por GRPCActor. Sem auth toda chamada é
+// recusada.
+func GRPCAuth(auth func(ctx context.Context) (string, error)) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if auth == nil {
+			return nil, grpcError(ctx, ErrGRPCUnauthenticated)
+		}
+		actor, err := auth(ctx)
+		if err != nil {
+			return nil, grpcError(ctx, err)
+		}
+		if actor == "" {
+			return nil, grpcError(ctx, ErrGRPCUnauthenticated)
+		}
+		return handler(context.WithValue(ctx, grpcActorKey{}, actor), req)
+	}
+}
+
+// GRPCTokens autentica pelo metadado "authorization: Bearer <token>", com
+// tokens mapeados para o nome do cliente.
+func GRPCTokens(tokens map[string]string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if actor := bearerActor(tokens, v); actor != "" {
+				return actor, nil
+			}
+		}
+		return "", ErrGRPCUnauthenticated
+	}
+}
+
+// GRPCActor retorna o cliente autenticado por GRPCAuth, ou vazio.
+func GRPCActor(ctx context.Context) string {
+	actor, _ := ctx.Value(grpcActorKey{}).(string)
+	return actor
+}
+
+// GRPCStatus converte err em um status gRPC com a mensagem no idioma lang.
+// O código estável do erro vai em um ErrorInfo com domínio "otp". Erros que
+// não são do pacote viram codes.Internal sem detalhes.
+func GRPCStatus(err error, lang string) *status.Status {
+	var e *Error
+	if !errors.As(err, &e) {
+		return status.New(codes.Internal, "internal error")
+	}
+	st := status.New(grpcCode(e.Kind), Localize(err, lang))
+	if d, derr := st.WithDetails(&errdetails.ErrorInfo{Reason: e.Code, Domain: "otp"}); derr == nil {
+		st = d
+	}
+	return st
+}
+
+func grpcCode(k Kind) codes.Code {
+	switch k {
+	case KindInvalidArgument:
+		return codes.InvalidArgument
+	case KindUnauthenticated:
+		return codes.Unauthenticated
+	case KindNotFound:
+		return codes.NotFound
+	case KindAlreadyExists:
+		return codes.AlreadyExists
+	case KindFailedPrecondition:
+		return codes.FailedPrecondition
+	case KindResourceExhausted:
+		return codes.ResourceExhausted
+	case KindAborted:
+		return codes.Aborted
+	}
+	return codes.Internal
+}
+
+// grpcError usa o primeiro idioma do metadado accept-language da chamada.
+func grpcError(ctx context.Context, err error) error {
+	lang := DefaultLanguage
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("accept-language"); len(v) > 0 {
+			l := strings.TrimSpace(strings.SplitN(strings.SplitN(v[0], ",", 2)[0], ";", 2)[0])
+			if l != "" {
+				lang = l
+			}
+		}
+	}
+	return GRPCStatus(err, lang).Err()
+}
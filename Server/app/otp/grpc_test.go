@@ -0,0 +1,198 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"otp/app/otppb"
+)
+
+// newTestGRPC sobe o serviço em memória com o relógio em *now.
+func newTestGRPC(t *testing.T, now *time.Time) otppb.OTPClient {
+	s := NewMemoryStore()
+	srv := NewGRPCServer(NewEnrollment(s, EnrollOtp{}), NewVerifier(s, VerifyOtp{Skew: 1, LookAhead: 2, Throttle: ThrottleOtp{MaxFailures: 4}}))
+	srv.now = func() time.Time { return *now }
+
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer(grpc.UnaryInterceptor(GRPCAuth(GRPCTokens(map[string]string{"tok": "admin"}))))
+	otppb.RegisterOTPServer(gs, srv)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			// Token válido, a menos que a chamada já traga outro.
+			if md, _ := metadata.FromOutgoingContext(ctx); len(md.Get("authorization")) == 0 {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer tok")
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return otppb.NewOTPClient(conn)
+}
+
+func requireStatus(t *testing.T, err error, code codes.Code, reason string) {
+	t.Helper()
+	st, ok := status.FromError(err)
+	require.True(t, ok, "Erro deveria ser um status gRPC: %v", err)
+	require.Equal(t, code, st.Code(), st.Message())
+	if reason == "" {
+		return
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			require.Equal(t, reason, info.Reason)
+			require.Equal(t, "otp", info.Domain)
+			return
+		}
+	}
+	t.Fatalf("Status sem ErrorInfo: %v", st)
+}
+
+func TestGRPCTOTP(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0).UTC()
+	c := newTestGRPC(t, &now)
+
+	enr, err := c.Enroll(ctx, &otppb.EnrollRequest{Issuer: "Brisa", AccountName: "a@b.com", Algorithm: otppb.Algorithm_ALGORITHM_SHA256})
+	require.NoError(t, err)
+	require.Equal(t, "Brisa:a@b.com", enr.Id)
+	opts := ValidateOtp{Digits: DigitsSix, Algorithm: AlgorithmSHA256}
+
+	qr, err := c.GetQR(ctx, &otppb.GetQRRequest{Id: enr.Id, Size: 100})
+	require.NoError(t, err)
+	require.Equal(t, enr.Url, qr.Url)
+	img, err := png.Decode(bytes.NewReader(qr.Png))
+	require.NoError(t, err)
+	require.Equal(t, 100, img.Bounds().Dx())
+	for _, size := range []uint32{1025, 1 << 31} {
+		_, err = c.GetQR(ctx, &otppb.GetQRRequest{Id: enr.Id, Size: size})
+		requireStatus(t, err, codes.InvalidArgument, "qr.invalid_size")
+	}
+
+	_, err = c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: "000000"})
+	requireStatus(t, err, codes.FailedPrecondition, "key.not_active")
+
+	code, err := GenerateCodeCustoms(enr.Secret, now, opts)
+	require.NoError(t, err)
+	conf, err := c.Confirm(ctx, &otppb.ConfirmRequest{Id: enr.Id, Passcode: code})
+	require.NoError(t, err)
+	require.Equal(t, "active", conf.State)
+
+	_, err = c.GetQR(ctx, &otppb.GetQRRequest{Id: enr.Id})
+	requireStatus(t, err, codes.FailedPrecondition, "qr.unavailable")
+
+	now = now.Add(30 * time.Second)
+	code, err = GenerateCodeCustoms(enr.Secret, now, opts)
+	require.NoError(t, err)
+	ver, err := c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: code})
+	require.NoError(t, err)
+	require.Equal(t, "totp", ver.Method)
+	require.Equal(t, "current", ver.SecretSlot)
+
+	_, err = c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: code})
+	requireStatus(t, err, codes.Unauthenticated, "validate.replayed")
+
+	// Mensagem no idioma pedido pelo cliente.
+	enCtx := metadata.AppendToOutgoingContext(ctx, "accept-language", "en-US,en;q=0.9")
+	_, err = c.Verify(enCtx, &otppb.VerifyRequest{Id: enr.Id, Passcode: "000000"})
+	requireStatus(t, err, codes.Unauthenticated, "validate.invalid_code")
+	require.Equal(t, "Invalid code", status.Convert(err).Message())
+
+	_, err = c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: "111111"})
+	requireStatus(t, err, codes.Unauthenticated, "validate.invalid_code")
+	_, err = c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: "222222"})
+	requireStatus(t, err, codes.Unauthenticated, "validate.invalid_code")
+	_, err = c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: code})
+	requireStatus(t, err, codes.ResourceExhausted, "validate.throttled")
+
+	// Rotação: o QR do segredo novo fica disponível durante a carência.
+	now = now.Add(time.Hour)
+	rot, err := c.Rotate(ctx, &otppb.RotateRequest{Id: enr.Id, GraceSeconds: 600})
+	require.NoError(t, err)
+	require.Equal(t, now.Add(10*time.Minute).Unix(), rot.GraceUntil)
+	qr, err = c.GetQR(ctx, &otppb.GetQRRequest{Id: enr.Id})
+	require.NoError(t, err)
+	require.Equal(t, rot.Url, qr.Url)
+	code, err = GenerateCodeCustoms(rot.Secret, now, opts)
+	require.NoError(t, err)
+	ver, err = c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: code})
+	require.NoError(t, err)
+	require.Equal(t, "next", ver.SecretSlot)
+
+	_, err = c.Resync(ctx, &otppb.ResyncRequest{Id: enr.Id, First: "000000", Second: "111111"})
+	requireStatus(t, err, codes.FailedPrecondition, "resync.not_hotp")
+
+	_, err = c.Delete(ctx, &otppb.DeleteRequest{Id: enr.Id, Actor: "admin"})
+	require.NoError(t, err)
+	_, err = c.Delete(ctx, &otppb.DeleteRequest{Id: enr.Id, Actor: "admin"})
+	requireStatus(t, err, codes.NotFound, "key.not_found")
+
+	// Com token errado nenhuma chamada passa.
+	bad := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer errado")
+	_, err = c.Delete(bad, &otppb.DeleteRequest{Id: enr.Id, Actor: "admin"})
+	requireStatus(t, err, codes.Unauthenticated, "grpc.unauthenticated")
+	_, err = c.Verify(bad, &otppb.VerifyRequest{Id: enr.Id, Passcode: "000000"})
+	requireStatus(t, err, codes.Unauthenticated, "grpc.unauthenticated")
+}
+
+func TestGRPCHOTPResync(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0).UTC()
+	c := newTestGRPC(t, &now)
+
+	enr, err := c.Enroll(ctx, &otppb.EnrollRequest{Issuer: "Brisa", AccountName: "h@b.com", Type: otppb.KeyType_KEY_TYPE_HOTP, Digits: 8})
+	require.NoError(t, err)
+	opts := ValidateOtps{Digits: DigitsEight, Algorithm: AlgorithmSHA1}
+	code := func(counter uint64) string {
+		c, err := GenerateCodeCustom(enr.Secret, counter, opts)
+		require.NoError(t, err)
+		return c
+	}
+
+	_, err = c.Confirm(ctx, &otppb.ConfirmRequest{Id: enr.Id, Passcode: code(0)})
+	require.NoError(t, err)
+
+	// O aplicativo avançou além do LookAhead.
+	_, err = c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: code(20)})
+	requireStatus(t, err, codes.Unauthenticated, "validate.invalid_code")
+
+	_, err = c.Resync(ctx, &otppb.ResyncRequest{Id: enr.Id, First: code(20), Second: code(22)})
+	requireStatus(t, err, codes.Unauthenticated, "validate.invalid_code")
+	_, err = c.Resync(ctx, &otppb.ResyncRequest{Id: enr.Id, First: code(20), Second: code(21), Window: 10})
+	requireStatus(t, err, codes.Unauthenticated, "validate.invalid_code")
+	_, err = c.Resync(ctx, &otppb.ResyncRequest{Id: enr.Id, First: code(20), Second: code(21), Window: 1 << 31})
+	requireStatus(t, err, codes.InvalidArgument, "resync.invalid_window")
+
+	res, err := c.Resync(ctx, &otppb.ResyncRequest{Id: enr.Id, First: code(20), Second: code(21)})
+	require.NoError(t, err)
+	require.Equal(t, uint64(22), res.Counter)
+
+	ver, err := c.Verify(ctx, &otppb.VerifyRequest{Id: enr.Id, Passcode: code(22)})
+	require.NoError(t, err)
+	require.Equal(t, "hotp", ver.Method)
+	require.Equal(t, int32(0), ver.Offset)
+
+	_, err = c.Enroll(ctx, &otppb.EnrollRequest{Issuer: "Brisa", AccountName: "h@b.com", Type: otppb.KeyType_KEY_TYPE_HOTP})
+	requireStatus(t, err, codes.AlreadyExists, "key.exists")
+	_, err = c.Enroll(ctx, &otppb.EnrollRequest{Issuer: "Brisa", AccountName: "x@b.com", Digits: 7})
+	requireStatus(t, err, codes.InvalidArgument, "")
+	_, err = c.Enroll(ctx, &otppb.EnrollRequest{AccountName: "x@b.com"})
+	requireStatus(t, err, codes.InvalidArgument, "generate.missing_issuer")
+}
@@ -0,0 +1,514 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrLDAPMalformed = newError("ldap.malformed", KindInvalidArgument)
+
+// Tags BER e códigos de resultado LDAP usados (RFC 4511).
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest     = 0x60
+	ldapBindResponse    = 0x61
+	ldapExtendedRequest = 0x77
+	ldapExtendedResp    = 0x78
+	ldapAuthSimple      = 0x80
+	ldapExtendedName    = 0x80
+
+	ldapSuccess                = 0
+	ldapProtocolError          = 2
+	ldapAuthMethodNotSupported = 7
+	ldapInvalidCredentials     = 49
+	ldapUnwillingToPerform     = 53
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+	ldapMaxMessage  = 16 << 20
+)
+
+// LDAPProxyOtp fornece opções para LDAPProxy.
+type LDAPProxyOtp struct {
+	Issuer string // Emissor das chaves.
+	// Account retorna a conta de um DN de bind. O padrão é o valor do primeiro
+	// RDN ("uid=ana,ou=people,dc=example,dc=com" -> "ana") ou o nome inteiro
+	// se ele não for um DN ("ana@example.com").
+	Account func(dn string) string
+	// BypassDNs são contas de serviço, sem chave OTP, cujos binds são repassados sem mudança.
+	BypassDNs []string
+	// Dial abre a conexão com o diretório. O padrão é net.Dial("tcp", upstream);
+	// use tls.Dial para LDAPS.
+	Dial func(upstream string) (net.Conn, error)
+}
+
+// LDAPProxy fica entre aplicações e um diretório LDAP. Em cada bind simples os
+// últimos dígitos da senha são o código OTP: só o restante da senha segue para
+// o diretório e, se ela for aceita, o código é validado com o Verifier. As demais operações são
+// repassadas como estão. Binds SASL e StartTLS são recusados, pois escapariam
+// da validação; para TLS com os clientes use um listener tls.
+type LDAPProxy struct {
+	verify   *Verifier
+	upstream string
+	otp      LDAPProxyOtp
+	now      func() time.Time
+}
+
+func NewLDAPProxy(verify *Verifier, upstream string, otp LDAPProxyOtp) *LDAPProxy {
+	if otp.Account == nil {
+		otp.Account = accountFromDN
+	}
+	if otp.Dial == nil {
+		otp.Dial = func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+	}
+	return &LDAPProxy{verify: verify, upstream: upstream, otp: otp, now: time.Now}
+}
+
+// Serve atende as conexões de l até que ele seja fechado.
+func (p *LDAPProxy) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.serveConn(c)
+	}
+}
+
+// ldapConn serializa as escritas numa conexão, que vêm tanto do diretório
+// quanto de respostas geradas pelo proxy.
+type ldapConn struct {
+	mu sync.Mutex
+	c  net.Conn
+}
+
+func (lc *ldapConn) write(msg []byte) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	_, err := lc.c.Write(msg)
+	return err
+}
+
+// ldapPendingBind é um bind repassado ao diretório cujo código OTP só é
+// validado depois que a senha for aceita. Com reset, o bind é o anônimo
+// enviado para desfazer uma autenticação cujo código estava errado.
+type ldapPendingBind struct {
+	id    string
+	code  string
+	t     time.Time
+	reset bool
+	err   error
+}
+
+// ldapSession guarda os binds de uma conexão à espera da resposta do diretório.
+// Enquanto houver um, o cliente não fala com o diretório: a RFC 4511 proíbe
+// mandar outra mensagem antes da BindResponse, e uma busca repassada nesse
+// intervalo rodaria com a conta autenticada antes de o código ser conferido.
+type ldapSession struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  map[string]ldapPendingBind // por messageID
+	failures int                        // binds desfeitos por código errado
+	closed   bool
+}
+
+func newLDAPSession() *ldapSession {
+	s := &ldapSession{pending: map[string]ldapPendingBind{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *ldapSession) put(msgID []byte, b ldapPendingBind) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b.reset {
+		s.failures++
+	}
+	s.pending[string(msgID)] = b
+}
+
+func (s *ldapSession) get(msgID []byte) (ldapPendingBind, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.pending[string(msgID)]
+	return b, ok
+}
+
+// done encerra o bind msgID e libera o cliente se não restar outro.
+func (s *ldapSession) done(msgID []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, string(msgID))
+	if len(s.pending) == 0 {
+		s.cond.Broadcast()
+	}
+}
+
+func (s *ldapSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// wait bloqueia enquanto houver binds pendentes e informa se a mensagem que
+// chegou nesse intervalo deve ser descartada: quando algum deles falhou no
+// código ou a conexão com o diretório caiu.
+func (s *ldapSession) wait() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return s.closed
+	}
+	failures := s.failures
+	for len(s.pending) > 0 && !s.closed {
+		s.cond.Wait()
+	}
+	return s.closed || s.failures != failures
+}
+
+func (p *LDAPProxy) serveConn(c net.Conn) {
+	defer c.Close()
+	conn, err := p.otp.Dial(p.upstream)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client, up := &ldapConn{c: c}, &ldapConn{c: conn}
+	sess := newLDAPSession()
+	go func() {
+		defer c.Close()
+		defer sess.close()
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readBER(r)
+			if err != nil {
+				return
+			}
+			reply, err := p.upstreamReply(sess, up, msg)
+			if err != nil {
+				return
+			}
+			if reply != nil && client.write(reply) != nil {
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		msg, err := readBER(r)
+		if err != nil {
+			return
+		}
+		if sess.wait() {
+			// Enviada antes da resposta de um bind que falhou: não chega ao diretório.
+			continue
+		}
+		fwd, reply, err := p.intercept(sess, msg)
+		if err != nil {
+			// Sem messageID não há como responder; a conexão é encerrada.
+			return
+		}
+		if reply != nil {
+			if client.write(reply) != nil {
+				return
+			}
+			continue
+		}
+		if up.write(fwd) != nil {
+			return
+		}
+	}
+}
+
+// intercept retorna a mensagem a repassar ao diretório ou a resposta a devolver
+// ao cliente. Mensagens ilegíveis retornam erro e nunca são repassadas.
+func (p *LDAPProxy) intercept(sess *ldapSession, msg []byte) ([]byte, []byte, error) {
+	m, err := parseLDAPMessage(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch m.opTag {
+	case ldapExtendedRequest:
+		if name, ok := ldapExtendedOID(m.op); ok && name == ldapStartTLSOID {
+			return nil, ldapResponse(m.id, ldapExtendedResp, ldapUnwillingToPerform, "StartTLS não é suportado pelo proxy"), nil
+		}
+		return msg, nil, nil
+	case ldapBindRequest:
+	default:
+		return msg, nil, nil
+	}
+
+	version, rest, err := nextBER(m.op)
+	if err != nil {
+		return nil, ldapResponse(m.id, ldapBindResponse, ldapProtocolError, Localize(ErrLDAPMalformed, DefaultLanguage)), nil
+	}
+	nameTLV, rest, err := nextBER(rest)
+	if err != nil {
+		return nil, ldapResponse(m.id, ldapBindResponse, ldapProtocolError, Localize(ErrLDAPMalformed, DefaultLanguage)), nil
+	}
+	auth, _, err := nextBER(rest)
+	if err != nil {
+		return nil, ldapResponse(m.id, ldapBindResponse, ldapProtocolError, Localize(ErrLDAPMalformed, DefaultLanguage)), nil
+	}
+	dn := string(berContent(nameTLV))
+	if auth[0] != ldapAuthSimple {
+		return nil, ldapResponse(m.id, ldapBindResponse, ldapAuthMethodNotSupported, "Apenas bind simples é suportado"), nil
+	}
+	password := berContent(auth)
+	if len(password) == 0 || p.bypass(dn) {
+		// Bind anônimo ou conta de serviço.
+		return msg, nil, nil
+	}
+
+	id := KeyID(p.otp.Issuer, p.otp.Account(dn))
+	digits, err := keyDigits(p.verify.store, id)
+	if err == nil && len(password) <= digits {
+		err = ErrValidateInvalidCode
+	}
+	if err != nil {
+		if err == ErrKeyNotFound || err == ErrKeyNotActive {
+			err = ErrValidateInvalidCode
+		}
+		return nil, ldapResponse(m.id, ldapBindResponse, ldapInvalidCredentials, Localize(err, DefaultLanguage)), nil
+	}
+
+	// A senha é conferida primeiro pelo diretório: o código só é validado (e
+	// só conta para o bloqueio) em upstreamReply, se a senha for aceita.
+	sess.put(m.id, ldapPendingBind{id: id, code: string(password[len(password)-digits:]), t: p.now()})
+	return ldapBind(m, version, nameTLV, password[:len(password)-digits]), nil, nil
+}
+
+// upstreamReply retorna a mensagem do diretório a repassar ao cliente, ou nil
+// se ela foi consumida pelo proxy. Um BindResponse de sucesso para um bind com
+// OTP só é repassado se o código for válido; caso contrário o proxy envia um
+// bind anônimo, para que a conexão não fique autenticada, e responde ao
+// cliente com invalidCredentials quando o diretório confirmar.
+func (p *LDAPProxy) upstreamReply(sess *ldapSession, up *ldapConn, msg []byte) ([]byte, error) {
+	m, err := parseLDAPMessage(msg)
+	if err != nil || m.opTag != ldapBindResponse {
+		return msg, nil
+	}
+	b, ok := sess.get(m.id)
+	if !ok {
+		return msg, nil
+	}
+	if b.reset {
+		sess.done(m.id)
+		return ldapResponse(m.id, ldapBindResponse, ldapInvalidCredentials, Localize(b.err, DefaultLanguage)), nil
+	}
+	result, _, err := nextBER(m.op)
+	if err != nil || result[0] != berEnumerated || len(berContent(result)) != 1 || berContent(result)[0] != ldapSuccess {
+		sess.done(m.id)
+		return msg, nil
+	}
+
+	if _, err = p.verify.Verify(b.id, b.code, b.t); err == nil {
+		sess.done(m.id)
+		return msg, nil
+	}
+	if err == ErrKeyNotFound || err == ErrKeyNotActive {
+		err = ErrValidateInvalidCode
+	}
+	// O bind anônimo substitui o pendente sem liberar o cliente no meio.
+	sess.put(m.id, ldapPendingBind{reset: true, err: err})
+	anon := append(encodeBER(berInteger, []byte{3}), encodeBER(berOctetString, nil)...)
+	anon = append(anon, encodeBER(ldapAuthSimple, nil)...)
+	reset := encodeBER(berSequence, append(encodeBER(berInteger, m.id), encodeBER(ldapBindRequest, anon)...))
+	return nil, up.write(reset)
+}
+
+// ldapBind remonta o BindRequest m com a senha password.
+func ldapBind(m *ldapMessage, version, nameTLV, password []byte) []byte {
+	op := append(append(append([]byte(nil), version...), nameTLV...), encodeBER(ldapAuthSimple, password)...)
+	out := append(append([]byte(nil), m.idTLV...), encodeBER(ldapBindRequest, op)...)
+	out = append(out, m.controls...)
+	return encodeBER(berSequence, out)
+}
+
+func (p *LDAPProxy) bypass(dn string) bool {
+	for _, b := range p.otp.BypassDNs {
+		if strings.EqualFold(strings.ReplaceAll(b, " ", ""), strings.ReplaceAll(dn, " ", "")) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountFromDN retorna o valor do primeiro RDN de dn.
+func accountFromDN(dn string) string {
+	first := dn
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+			continue
+		}
+		if dn[i] == ',' {
+			first = dn[:i]
+			break
+		}
+	}
+	_, v, ok := strings.Cut(first, "=")
+	if !ok {
+		return strings.TrimSpace(dn)
+	}
+	return strings.TrimSpace(strings.NewReplacer(`\,`, ",", `\+`, "+", `\\`, `\`, `\=`, "=").Replace(v))
+}
+
+// keyDigits retorna o tamanho do código da chave id, para separá-lo de uma senha.
+func keyDigits(store KeyStore, id string) (int, error) {
+	rec, err := store.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	k, err := rec.Key()
+	if err != nil {
+		return 0, err
+	}
+	return k.Digits().Length(), nil
+}
+
+type ldapMessage struct {
+	idTLV    []byte
+	id       []byte // conteúdo do messageID
+	opTag    byte
+	op       []byte // conteúdo da operação
+	controls []byte // controles, repassados como estão
+}
+
+func parseLDAPMessage(msg []byte) (*ldapMessage, error) {
+	if len(msg) == 0 || msg[0] != berSequence {
+		return nil, ErrLDAPMalformed
+	}
+	body, _, err := nextBER(msg)
+	if err != nil {
+		return nil, err
+	}
+	body = berContent(body)
+	idTLV, rest, err := nextBER(body)
+	if err != nil || idTLV[0] != berInteger {
+		return nil, ErrLDAPMalformed
+	}
+	op, rest, err := nextBER(rest)
+	if err != nil {
+		return nil, err
+	}
+	return &ldapMessage{idTLV: idTLV, id: berContent(idTLV), opTag: op[0], op: berContent(op), controls: rest}, nil
+}
+
+// ldapExtendedOID retorna o requestName de um ExtendedRequest.
+func ldapExtendedOID(op []byte) (string, bool) {
+	tlv, _, err := nextBER(op)
+	if err != nil || tlv[0] != ldapExtendedName {
+		return "", false
+	}
+	return string(berContent(tlv)), true
+}
+
+// ldapResponse monta um LDAPResult (BindResponse, ExtendedResponse...) para o messageID id.
+func ldapResponse(id []byte, tag byte, code byte, diagnostic string) []byte {
+	result := encodeBER(berEnumerated, []byte{code})
+	result = append(result, encodeBER(berOctetString, nil)...)
+	result = append(result, encodeBER(berOctetString, []byte(diagnostic))...)
+	body := append(encodeBER(berInteger, id), encodeBER(tag, result)...)
+	return encodeBER(berSequence, body)
+}
+
+// readBER lê um elemento BER completo de r. Só a forma de tamanho definido é aceita.
+func readBER(r *bufio.Reader) ([]byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	head := []byte{tag, first}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, ErrLDAPMalformed
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			head = append(head, b)
+			length = length<<8 | int(b)
+		}
+	}
+	if length > ldapMaxMessage {
+		return nil, ErrLDAPMalformed
+	}
+	msg := make([]byte, len(head)+length)
+	copy(msg, head)
+	if _, err := io.ReadFull(r, msg[len(head):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// nextBER separa o primeiro elemento de b (tag, tamanho e conteúdo) do restante.
+func nextBER(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrLDAPMalformed
+	}
+	head, length := 2, int(b[1])
+	if b[1]&0x80 != 0 {
+		n := int(b[1] & 0x7f)
+		if n == 0 || n > 4 || len(b) < 2+n {
+			return nil, nil, ErrLDAPMalformed
+		}
+		length = 0
+		for _, c := range b[2 : 2+n] {
+			length = length<<8 | int(c)
+		}
+		head += n
+	}
+	if length < 0 || len(b)-head < length {
+		return nil, nil, ErrLDAPMalformed
+	}
+	return b[:head+length], b[head+length:], nil
+}
+
+// berContent retorna o conteúdo de um elemento já validado por nextBER.
+func berContent(tlv []byte) []byte {
+	if tlv[1]&0x80 == 0 {
+		return tlv[2:]
+	}
+	return tlv[2+int(tlv[1]&0x7f):]
+}
+
+func encodeBER(tag byte, content []byte) []byte {
+	n := len(content)
+	var out []byte
+	switch {
+	case n < 0x80:
+		out = []byte{tag, byte(n)}
+	case n <= 0xff:
+		out = []byte{tag, 0x81, byte(n)}
+	case n <= 0xffff:
+		out = []byte{tag, 0x82, byte(n >> 8), byte(n)}
+	default:
+		out = []byte{tag, 0x84, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return append(out, content...)
+}
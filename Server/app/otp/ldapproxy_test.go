@@ -0,0 +1,259 @@
+package app
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// ldapStub é um diretório mínimo: aceita binds com a senha "segredo" e
+// responde toda busca com SearchResultDone.
+type ldapStub struct {
+	mu       sync.Mutex
+	binds    []string // "dn:senha" de cada bind recebido
+	searches []string // DN autenticado na conexão em cada busca recebida
+}
+
+func (s *ldapStub) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			bound := ""
+			for {
+				msg, err := readBER(r)
+				if err != nil {
+					return
+				}
+				m, err := parseLDAPMessage(msg)
+				if err != nil {
+					return
+				}
+				switch m.opTag {
+				case ldapBindRequest:
+					_, rest, _ := nextBER(m.op)
+					name, rest, _ := nextBER(rest)
+					auth, _, _ := nextBER(rest)
+					password := string(berContent(auth))
+					s.mu.Lock()
+					s.binds = append(s.binds, string(berContent(name))+":"+password)
+					s.mu.Unlock()
+					code := byte(ldapInvalidCredentials)
+					bound = ""
+					if password == "segredo" {
+						code = ldapSuccess
+						bound = string(berContent(name))
+					}
+					c.Write(ldapResponse(m.id, ldapBindResponse, code, ""))
+				case 0x63: // SearchRequest
+					s.mu.Lock()
+					s.searches = append(s.searches, bound)
+					s.mu.Unlock()
+					c.Write(ldapResponse(m.id, 0x65, ldapSuccess, ""))
+				default:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *ldapStub) lastBind() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.binds) == 0 {
+		return ""
+	}
+	return s.binds[len(s.binds)-1]
+}
+
+type ldapClient struct {
+	t  *testing.T
+	c  net.Conn
+	r  *bufio.Reader
+	id byte
+}
+
+// do envia a operação op (tag e conteúdo) e retorna a tag e o resultCode da resposta.
+func (c *ldapClient) do(tag byte, op []byte) (byte, byte) {
+	c.id++
+	msg := encodeBER(berSequence, append(encodeBER(berInteger, []byte{c.id}), encodeBER(tag, op)...))
+	_, err := c.c.Write(msg)
+	require.NoError(c.t, err)
+	c.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := readBER(c.r)
+	require.NoError(c.t, err)
+	m, err := parseLDAPMessage(resp)
+	require.NoError(c.t, err)
+	require.Equal(c.t, []byte{c.id}, m.id)
+	result, _, err := nextBER(m.op)
+	require.NoError(c.t, err)
+	return m.opTag, berContent(result)[0]
+}
+
+func (c *ldapClient) bind(dn, password string) byte {
+	op := append(encodeBER(berInteger, []byte{3}), encodeBER(berOctetString, []byte(dn))...)
+	op = append(op, encodeBER(ldapAuthSimple, []byte(password))...)
+	tag, code := c.do(ldapBindRequest, op)
+	require.Equal(c.t, byte(ldapBindResponse), tag)
+	return code
+}
+
+func TestLDAPProxy(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Unix(1700000000, 0).UTC()
+	secret := "JBSWY3DPEHPK3PXP"
+	newActiveRecord(t, s, "otpauth://totp/Diretorio:ana?secret="+secret+"&issuer=Diretorio")
+
+	stub := &ldapStub{}
+	ul, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ul.Close() })
+	go stub.serve(ul)
+
+	p := NewLDAPProxy(NewVerifier(s, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 3}}), ul.Addr().String(), LDAPProxyOtp{
+		Issuer:    "Diretorio",
+		BypassDNs: []string{"cn=app, dc=example,dc=com"},
+	})
+	p.now = func() time.Time { return now }
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pl.Close() })
+	go p.Serve(pl)
+
+	conn, err := net.Dial("tcp", pl.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	c := &ldapClient{t: t, c: conn, r: bufio.NewReader(conn)}
+
+	const dn = "uid=ana,ou=people,dc=example,dc=com"
+	// Senha errada: o código nem é validado, então não conta para o bloqueio.
+	for i := 0; i < 5; i++ {
+		require.Equal(t, byte(ldapInvalidCredentials), c.bind(dn, "errada000000"))
+	}
+	require.Equal(t, dn+":errada", stub.lastBind())
+	require.Equal(t, byte(ldapInvalidCredentials), c.bind(dn, "segredo000000"))
+	require.Equal(t, ":", stub.lastBind(), "Código errado desfaz o bind com um bind anônimo")
+	require.Equal(t, byte(ldapInvalidCredentials), c.bind(dn, "123456"), "Senha só com o código")
+	require.Equal(t, byte(ldapInvalidCredentials), c.bind("uid=bruno,dc=example,dc=com", "segredo000000"))
+
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+	require.Equal(t, byte(ldapSuccess), c.bind(dn, "segredo"+code))
+	require.Equal(t, dn+":segredo", stub.lastBind(), "Só a senha segue para o diretório")
+	require.Equal(t, byte(ldapInvalidCredentials), c.bind(dn, "segredo"+code), "Código reutilizado")
+
+	// Outras operações passam direto.
+	tag, result := c.do(0x63, encodeBER(berOctetString, []byte("dc=example,dc=com")))
+	require.Equal(t, byte(0x65), tag)
+	require.Equal(t, byte(ldapSuccess), result)
+
+	// Uma busca enviada logo após o bind espera o código ser conferido: com
+	// código errado ela nunca chega ao diretório.
+	pipelined := func(password string) {
+		bind := append(encodeBER(berInteger, []byte{3}), encodeBER(berOctetString, []byte(dn))...)
+		bind = append(bind, encodeBER(ldapAuthSimple, []byte(password))...)
+		msg := encodeBER(berSequence, append(encodeBER(berInteger, []byte{100}), encodeBER(ldapBindRequest, bind)...))
+		msg = append(msg, encodeBER(berSequence, append(encodeBER(berInteger, []byte{101}), encodeBER(0x63, encodeBER(berOctetString, nil))...))...)
+		_, err := conn.Write(msg)
+		require.NoError(t, err)
+	}
+	stub.mu.Lock()
+	stub.searches = nil
+	stub.mu.Unlock()
+	pipelined("segredo000000")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := readBER(c.r)
+	require.NoError(t, err)
+	m, err := parseLDAPMessage(resp)
+	require.NoError(t, err)
+	require.Equal(t, byte(ldapBindResponse), m.opTag)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = readBER(c.r)
+	require.Error(t, err, "Busca descartada não recebe resposta")
+	stub.mu.Lock()
+	require.Empty(t, stub.searches, "Busca não chega ao diretório")
+	stub.mu.Unlock()
+
+	// Com código válido a busca segue depois do bind, como a conta.
+	now = now.Add(30 * time.Second)
+	code, err = GenerateCodes(secret, now)
+	require.NoError(t, err)
+	pipelined("segredo" + code)
+	for _, want := range []byte{ldapBindResponse, 0x65} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := readBER(c.r)
+		require.NoError(t, err)
+		m, err := parseLDAPMessage(resp)
+		require.NoError(t, err)
+		require.Equal(t, want, m.opTag)
+		result, _, _ := nextBER(m.op)
+		require.Equal(t, byte(ldapSuccess), berContent(result)[0])
+	}
+	stub.mu.Lock()
+	require.Equal(t, []string{dn}, stub.searches)
+	stub.mu.Unlock()
+
+	// Conta de serviço, sem chave OTP.
+	require.Equal(t, byte(ldapSuccess), c.bind("cn=app,dc=example,dc=com", "segredo"))
+	require.Equal(t, "cn=app,dc=example,dc=com:segredo", stub.lastBind())
+
+	// SASL e StartTLS escapariam da validação.
+	sasl := append(encodeBER(berInteger, []byte{3}), encodeBER(berOctetString, []byte(dn))...)
+	sasl = append(sasl, encodeBER(0xa3, encodeBER(berOctetString, []byte("PLAIN")))...)
+	tag, result = c.do(ldapBindRequest, sasl)
+	require.Equal(t, byte(ldapBindResponse), tag)
+	require.Equal(t, byte(ldapAuthMethodNotSupported), result)
+	tag, result = c.do(ldapExtendedRequest, encodeBER(ldapExtendedName, []byte(ldapStartTLSOID)))
+	require.Equal(t, byte(ldapExtendedResp), tag)
+	require.Equal(t, byte(ldapUnwillingToPerform), result)
+
+	// Bind malformado recebe protocolError e não chega ao diretório.
+	before := stub.lastBind()
+	tag, result = c.do(ldapBindRequest, append(encodeBER(berInteger, []byte{3}), berOctetString, 0x7f))
+	require.Equal(t, byte(ldapBindResponse), tag)
+	require.Equal(t, byte(ldapProtocolError), result)
+	require.Equal(t, before, stub.lastBind())
+
+	// Mensagem ilegível encerra a conexão.
+	_, err = conn.Write([]byte{0x04, 0x01, 0x00})
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = readBER(c.r)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestAccountFromDN(t *testing.T) {
+	for dn, want := range map[string]string{
+		"uid=ana,ou=people,dc=example,dc=com": "ana",
+		"CN=Silva\\, Ana,OU=Users,DC=corp":    "Silva, Ana",
+		"ana@example.com":                     "ana@example.com",
+		"uid = ana , dc=example":              "ana",
+	} {
+		require.Equal(t, want, accountFromDN(dn), dn)
+	}
+}
+
+func TestBER(t *testing.T) {
+	long := make([]byte, 300)
+	tlv := encodeBER(berOctetString, long)
+	require.Equal(t, []byte{berOctetString, 0x82, 0x01, 0x2c}, tlv[:4])
+	got, rest, err := nextBER(append(tlv, 0x05, 0x00))
+	require.NoError(t, err)
+	require.Equal(t, long, berContent(got))
+	require.Equal(t, []byte{0x05, 0x00}, rest)
+
+	_, _, err = nextBER([]byte{berOctetString, 0x05, 'a'})
+	require.ErrorIs(t, err, ErrLDAPMalformed)
+	_, _, err = nextBER([]byte{berOctetString, 0x80})
+	require.ErrorIs(t, err, ErrLDAPMalformed, "Tamanho indefinido")
+}
@@ -0,0 +1,359 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics acumula contadores e histogramas do serviço e os expõe no formato
+// texto do Prometheus (versão 0.0.4). Um Metrics nil descarta as medições.
+//
+//	m := NewMetrics()
+//	verifier.UseMetrics(m)
+//	http.Handle("/metrics", m)
+type Metrics struct {
+	enrollments   *counterVec
+	confirmations *counterVec
+	verifications *counterVec
+	replays       *counterVec
+	lockouts      *counterVec
+	offsets       *histogramVec
+	validate      *histogramVec
+	store         *histogramVec
+}
+
+// Limites dos histogramas de latência, em segundos. Uma validação leva
+// microssegundos; uma chamada ao banco, milissegundos.
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Limites do histograma de desvio: passos TOTP podem ser negativos.
+var offsetBuckets = []float64{-3, -2, -1, 0, 1, 2, 3, 5, 10}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		enrollments:   newCounterVec("otp_enrollments_total", "Cadastros de chaves iniciados.", "type", "result"),
+		confirmations: newCounterVec("otp_enrollment_confirmations_total", "Códigos de confirmação de cadastro recebidos.", "result"),
+		verifications: newCounterVec("otp_verifications_total", "Validações de códigos de chaves ativas.", "result", "algorithm"),
+		replays:       newCounterVec("otp_replays_total", "Códigos recusados por já terem sido usados."),
+		lockouts:      newCounterVec("otp_lockouts_total", "Contas bloqueadas por excesso de tentativas.", "source"),
+		offsets:       newHistogramVec("otp_verification_offset", "Desvio em passos (TOTP) ou contadores (HOTP) dos códigos aceitos.", offsetBuckets, "method"),
+		validate:      newHistogramVec("otp_validate_duration_seconds", "Latência das funções de validação.", latencyBuckets, "func"),
+		store:         newHistogramVec("otp_store_duration_seconds", "Latência das chamadas ao KeyStore.", latencyBuckets, "op"),
+	}
+}
+
+// ValidateCustoms chama ValidateCustoms medindo a latência.
+func (m *Metrics) ValidateCustoms(passcode string, secret string, t time.Time, otp ValidateOtp) (bool, error) {
+	start := time.Now()
+	ok, err := ValidateCustoms(passcode, secret, t, otp)
+	m.observeValidate("ValidateCustoms", start)
+	return ok, err
+}
+
+// ServeHTTP escreve as métricas para o Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo escreve todas as métricas em w no formato texto do Prometheus.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	if m != nil {
+		for _, c := range []*counterVec{m.enrollments, m.confirmations, m.verifications, m.replays, m.lockouts} {
+			c.write(bw)
+		}
+		for _, h := range []*histogramVec{m.offsets, m.validate, m.store} {
+			h.write(bw)
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (m *Metrics) enrolled(k *Key, err error) {
+	if m == nil {
+		return
+	}
+	m.enrollments.inc(k.Type(), metricResult(err))
+}
+
+func (m *Metrics) confirmed(err error) {
+	if m == nil {
+		return
+	}
+	m.confirmations.inc(metricResult(err))
+}
+
+func (m *Metrics) verified(algorithm string, match Match, err error) {
+	if m == nil {
+		return
+	}
+	if algorithm == "" {
+		algorithm = "unknown"
+	}
+	m.verifications.inc(metricResult(err), algorithm)
+	if err == ErrValidateReplayed {
+		m.replays.inc()
+	}
+	if err == nil && match.Method != "" {
+		m.offsets.observe(float64(match.Offset), string(match.Method))
+	}
+}
+
+func (m *Metrics) lockedOut(source string) {
+	if m == nil {
+		return
+	}
+	m.lockouts.inc(source)
+}
+
+func (m *Metrics) observeValidate(fn string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.validate.observe(time.Since(start).Seconds(), fn)
+}
+
+// metricResult usa o código estável do erro como rótulo, ver ErrorCode.
+func metricResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return auditError(err)
+}
+
+// InstrumentStore retorna um KeyStore que mede a latência de cada chamada a s.
+// A medição de Update inclui o tempo de fn.
+func InstrumentStore(s KeyStore, m *Metrics) KeyStore {
+	return &metricsStore{s: s, m: m}
+}
+
+type metricsStore struct {
+	s KeyStore
+	m *Metrics
+}
+
+func (ms *metricsStore) observe(op string, start time.Time) {
+	if ms.m != nil {
+		ms.m.store.observe(time.Since(start).Seconds(), op)
+	}
+}
+
+func (ms *metricsStore) Get(id string) (*KeyRecord, error) {
+	defer ms.observe("get", time.Now())
+	return ms.s.Get(id)
+}
+
+func (ms *metricsStore) Put(rec *KeyRecord) error {
+	defer ms.observe("put", time.Now())
+	return ms.s.Put(rec)
+}
+
+func (ms *metricsStore) Create(rec *KeyRecord) error {
+	defer ms.observe("create", time.Now())
+	return createKey(ms.s, rec)
+}
+
+func (ms *metricsStore) Update(id string, fn func(rec *KeyRecord) error) error {
+	defer ms.observe("update", time.Now())
+	return ms.s.Update(id, fn)
+}
+
+func (ms *metricsStore) Delete(id string) error {
+	defer ms.observe("delete", time.Now())
+	return ms.s.Delete(id)
+}
+
+func (ms *metricsStore) DeleteIf(id string, fn func(rec *KeyRecord) error) error {
+	defer ms.observe("delete", time.Now())
+	return deleteKeyIf(ms.s, id, fn)
+}
+
+func (ms *metricsStore) List() ([]*KeyRecord, error) {
+	defer ms.observe("list", time.Now())
+	return ms.s.List()
+}
+
+// ListPage repassa o filtro ao store interno, para ListKeys paginar no banco.
+func (ms *metricsStore) ListPage(f KeyFilter) ([]*KeyRecord, error) {
+	defer ms.observe("list", time.Now())
+	recs, _, err := ListKeys(ms.s, f)
+	return recs, err
+}
+
+// counterVec é um contador com rótulos. As séries são indexadas pelos valores
+// dos rótulos unidos por um separador que não aparece em texto válido.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(values, "\xff")]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, escapeHelp(c.help), c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // por limite, não acumulado
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeHelp(h.help), h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatValue(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels monta {a="x",b="y"} a partir dos nomes e da chave da série,
+// acrescentando extra (por exemplo le) quando informado.
+func formatLabels(names []string, key string, extra, extraValue string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
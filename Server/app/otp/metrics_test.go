@@ -0,0 +1,126 @@
+package app
+
+import (
+	"bufio"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	s := InstrumentStore(NewMemoryStore(), m)
+	e := NewEnrollment(s, EnrollOtp{})
+	e.UseMetrics(m)
+	v := NewVerifier(s, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 2}})
+	v.UseMetrics(m)
+
+	now := time.Unix(1700000000, 0).UTC()
+	k, err := e.BeginTOTP(GeneratesOtp{Issuer: "Brisa", AccountName: "a@b.com", Algorithm: AlgorithmSHA256}, now)
+	require.NoError(t, err)
+	id := KeyID("Brisa", "a@b.com")
+	code, err := GenerateCodeCustoms(k.Secret(), now, ValidateOtp{Digits: DigitsSix, Algorithm: AlgorithmSHA256})
+	require.NoError(t, err)
+	_, err = e.Confirm(id, code, now)
+	require.NoError(t, err)
+
+	// Código do passo anterior: aceito com desvio -1.
+	later := now.Add(60 * time.Second)
+	code, err = GenerateCodeCustoms(k.Secret(), later.Add(-30*time.Second), ValidateOtp{Digits: DigitsSix, Algorithm: AlgorithmSHA256})
+	require.NoError(t, err)
+	_, err = v.Verify(id, code, later)
+	require.NoError(t, err)
+	_, err = v.Verify(id, code, later)
+	require.Equal(t, ErrValidateReplayed, err)
+	_, err = v.Verify(id, "000000", later)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = v.Verify("Brisa:ninguem", "000000", later)
+	require.Equal(t, ErrKeyNotFound, err)
+
+	ok, err := m.ValidateCustoms(code, k.Secret(), later, ValidateOtp{Skew: 1, Digits: DigitsSix, Algorithm: AlgorithmSHA256})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	out := string(body)
+
+	for _, line := range []string{
+		"# TYPE otp_enrollments_total counter",
+		`otp_enrollments_total{type="totp",result="ok"} 1`,
+		`otp_enrollment_confirmations_total{result="ok"} 1`,
+		`otp_verifications_total{result="ok",algorithm="SHA256"} 1`,
+		`otp_verifications_total{result="validate.replayed",algorithm="SHA256"} 1`,
+		`otp_verifications_total{result="validate.invalid_code",algorithm="SHA256"} 1`,
+		`otp_verifications_total{result="key.not_found",algorithm="unknown"} 1`,
+		"otp_replays_total 1",
+		`otp_lockouts_total{source="verify"} 1`,
+		"# TYPE otp_verification_offset histogram",
+		`otp_verification_offset_bucket{method="totp",le="-2"} 0`,
+		`otp_verification_offset_bucket{method="totp",le="-1"} 1`,
+		`otp_verification_offset_bucket{method="totp",le="+Inf"} 1`,
+		`otp_verification_offset_sum{method="totp"} -1`,
+		`otp_validate_duration_seconds_count{func="ValidateCustoms"} 1`,
+		`otp_validate_duration_seconds_count{func="ValidateRecord"} 4`,
+		`otp_store_duration_seconds_count{op="update"} 5`,
+		`otp_store_duration_seconds_count{op="create"} 1`,
+	} {
+		require.Contains(t, out, line+"\n", "Linha ausente: %s", line)
+	}
+
+	// Cada linha que não é comentário é "nome{rótulos} valor".
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		require.Len(t, strings.Fields(line), 2, "Linha mal formada: %s", line)
+	}
+}
+
+// pagerStore conta as chamadas a ListPage, como um SQLStore que pagina no banco.
+type pagerStore struct {
+	*MemoryStore
+	pages int
+}
+
+func (s *pagerStore) ListPage(f KeyFilter) ([]*KeyRecord, error) {
+	s.pages++
+	recs, _, err := ListKeys(s.MemoryStore, f)
+	return recs, err
+}
+
+func TestMetricsStoreListPage(t *testing.T) {
+	s := &pagerStore{MemoryStore: NewMemoryStore()}
+	testListKeys(t, InstrumentStore(s, NewMetrics()))
+	require.Equal(t, 4, s.pages, "ListKeys pagina no store medido")
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	v := NewVerifier(NewMemoryStore(), VerifyOtp{})
+	v.UseMetrics(m)
+	_, err := v.Verify("Brisa:a@b.com", "000000", time.Now())
+	require.Equal(t, ErrKeyNotFound, err)
+
+	var b strings.Builder
+	_, err = m.WriteTo(&b)
+	require.NoError(t, err)
+	require.Empty(t, b.String())
+}
+
+func TestMetricsLabelEscape(t *testing.T) {
+	c := newCounterVec("x_total", "linha 1\nlinha 2", "v")
+	c.inc("a\"b\\c\nd")
+	var b strings.Builder
+	bw := bufio.NewWriter(&b)
+	c.write(bw)
+	require.NoError(t, bw.Flush())
+	require.Equal(t, "# HELP x_total linha 1\\nlinha 2\n# TYPE x_total counter\n"+`x_total{v="a\"b\\c\nd"} 1`+"\n", b.String())
+}
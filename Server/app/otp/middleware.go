@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrMiddlewareNoAccount = newError("middleware.no_account", KindUnauthenticated)
+var ErrMiddlewareNoCode = newError("middleware.no_code", KindUnauthenticated)
+var ErrMiddlewareNoAccountFunc = newError("middleware.no_account_func", KindInternal)
+var ErrMiddlewareShortSessionKey = newError("middleware.short_session_key", KindInternal)
+
+// MiddlewareOtp fornece opções para Middleware.
+type MiddlewareOtp struct {
+	// Header com o código. O padrão é "X-OTP".
+	Header string
+	// Account retorna o ID da chave (issuer:account) de quem fez a requisição,
+	// a partir da autenticação primária. Obrigatório: não há padrão, pois um
+	// cabeçalho enviado pelo cliente permitiria escolher a conta. Sem ele toda
+	// requisição recebe 500. AccountFromHeader só é seguro atrás de um proxy
+	// que define o cabeçalho.
+	Account func(r *http.Request) (string, error)
+	// Com SessionKey definida, um código aceito cria uma sessão step-up em um
+	// cookie assinado, e as próximas requisições da mesma conta dispensam o código.
+	// Ela deve ter ao menos 32 bytes; uma chave menor, mesmo vazia, faz toda
+	// requisição receber 500.
+	SessionKey    []byte
+	SessionCookie string        // O padrão é "otp_stepup".
+	SessionTTL    time.Duration // O padrão é 10 minutos.
+	Secure        bool          // Envia o cookie apenas por HTTPS.
+}
+
+func (o MiddlewareOtp) defaults() MiddlewareOtp {
+	if o.Header == "" {
+		o.Header = "X-OTP"
+	}
+	if o.SessionCookie == "" {
+		o.SessionCookie = "otp_stepup"
+	}
+	if o.SessionTTL == 0 {
+		o.SessionTTL = 10 * time.Minute
+	}
+	return o
+}
+
+// AccountFromHeader lê a conta do cabeçalho name. Com issuer vazio o cabeçalho
+// já deve trazer o ID completo da chave.
+func AccountFromHeader(name, issuer string) func(r *http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		return accountID(issuer, r.Header.Get(name))
+	}
+}
+
+// AccountFromBasicAuth usa o usuário da autenticação HTTP Basic, já conferida
+// por outro handler, como conta do emissor issuer.
+func AccountFromBasicAuth(issuer string) func(r *http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		user, _, _ := r.BasicAuth()
+		return accountID(issuer, user)
+	}
+}
+
+func accountID(issuer, account string) (string, error) {
+	account = strings.TrimSpace(account)
+	if account == "" {
+		return "", ErrMiddlewareNoAccount
+	}
+	if issuer == "" {
+		return account, nil
+	}
+	return KeyID(issuer, account), nil
+}
+
+// Middleware protege handlers net/http exigindo um código válido da chave
+// guardada de quem fez a requisição. A proteção contra reuso e o bloqueio por
+// tentativas são os do Verifier (VerifyOtp.Throttle e UseShared).
+//
+//	mw := app.NewMiddleware(verifier, app.MiddlewareOtp{Account: app.AccountFromBasicAuth("Painel")})
+//	mux.Handle("/admin/", mw.Wrap(admin))
+type Middleware struct {
+	verify *Verifier
+	otp    MiddlewareOtp
+	now    func() time.Time
+}
+
+func NewMiddleware(verify *Verifier, otp MiddlewareOtp) *Middleware {
+	return &Middleware{verify: verify, otp: otp.defaults(), now: time.Now}
+}
+
+type contextKey int
+
+const accountContextKey contextKey = iota
+
+// AccountFromContext retorna a conta verificada pelo Middleware.
+func AccountFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(accountContextKey).(string)
+	return id, ok
+}
+
+// Wrap retorna next protegido. Requisições sem conta, sem código ou com código
+// inválido recebem o status de HTTPStatus e a mensagem no idioma do cliente.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := m.authorize(w, r)
+		if err != nil {
+			http.Error(w, Localize(err, r.Header.Get("Accept-Language")), HTTPStatus(err))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accountContextKey, id)))
+	})
+}
+
+func (m *Middleware) authorize(w http.ResponseWriter, r *http.Request) (string, error) {
+	if m.otp.Account == nil {
+		return "", ErrMiddlewareNoAccountFunc
+	}
+	if m.otp.SessionKey != nil && len(m.otp.SessionKey) < minSessionKey {
+		return "", ErrMiddlewareShortSessionKey
+	}
+	id, err := m.otp.Account(r)
+	if err != nil {
+		return "", err
+	}
+
+	t := m.now()
+	if m.otp.SessionKey != nil {
+		if c, err := r.Cookie(m.otp.SessionCookie); err == nil {
+			if sid, ok := openSession(m.otp.SessionKey, sessionStepUp, c.Value, t); ok && sid == id {
+				return id, nil
+			}
+		}
+	}
+
+	code := strings.TrimSpace(r.Header.Get(m.otp.Header))
+	if code == "" {
+		return "", ErrMiddlewareNoCode
+	}
+	if _, err := m.verify.Verify(id, code, t); err != nil {
+		// Conta sem chave e código errado respondem igual.
+		if err == ErrKeyNotFound || err == ErrKeyNotActive {
+			err = ErrValidateInvalidCode
+		}
+		return "", err
+	}
+
+	if m.otp.SessionKey != nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     m.otp.SessionCookie,
+			Value:    sealSession(m.otp.SessionKey, sessionStepUp, id, t.Add(m.otp.SessionTTL)),
+			Path:     "/",
+			Expires:  t.Add(m.otp.SessionTTL),
+			Secure:   m.otp.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return id, nil
+}
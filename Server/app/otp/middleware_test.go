@@ -0,0 +1,114 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Unix(1700000000, 0).UTC()
+	secret := "JBSWY3DPEHPK3PXP"
+	newActiveRecord(t, s, "otpauth://totp/Painel:ana?secret="+secret+"&issuer=Painel")
+
+	v := NewVerifier(s, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 3}})
+	key := []byte("chave-de-sessao-com-32-bytes-ou-mais")
+	m := NewMiddleware(v, MiddlewareOtp{Account: AccountFromBasicAuth("Painel"), SessionKey: key})
+	m.now = func() time.Time { return now }
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := AccountFromContext(r.Context())
+		require.True(t, ok)
+		w.Write([]byte(id))
+	}))
+
+	do := func(user, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin", nil)
+		if user != "" {
+			r.SetBasicAuth(user, "senha")
+		}
+		if code != "" {
+			r.Header.Set("X-OTP", code)
+		}
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("", "123456", nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), "Conta não identificada")
+	w = do("ana", "", nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), "Código OTP obrigatório")
+	require.Equal(t, http.StatusUnauthorized, do("bruno", "123456", nil).Code, "Conta sem chave")
+
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+	w = do("ana", code, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "Painel:ana", w.Body.String())
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	stepup := cookies[0]
+
+	require.Equal(t, http.StatusUnauthorized, do("ana", code, nil).Code, "Código reutilizado")
+
+	// A sessão step-up dispensa o código, mas só para a mesma conta.
+	require.Equal(t, http.StatusOK, do("ana", "", stepup).Code)
+	require.Equal(t, http.StatusUnauthorized, do("bruno", "", stepup).Code)
+	fa := *stepup
+	fa.Value = sealSession(key, sessionForwardAuth, "Painel:ana", now.Add(time.Hour))
+	require.Equal(t, http.StatusUnauthorized, do("ana", "", &fa).Code, "Cookie do ForwardAuth com a mesma chave")
+	m.now = func() time.Time { return now.Add(11 * time.Minute) }
+	require.Equal(t, http.StatusUnauthorized, do("ana", "", stepup).Code, "Sessão expirada")
+
+	require.Equal(t, http.StatusUnauthorized, do("ana", "000000", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, do("ana", "111111", nil).Code)
+	require.Equal(t, http.StatusTooManyRequests, do("ana", "222222", nil).Code, "Bloqueio após falhas")
+}
+
+func TestAccountFromHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	_, err := AccountFromHeader("X-User", "Painel")(r)
+	require.Equal(t, ErrMiddlewareNoAccount, err)
+
+	r.Header.Set("X-User", " ana ")
+	id, err := AccountFromHeader("X-User", "Painel")(r)
+	require.NoError(t, err)
+	require.Equal(t, "Painel:ana", id)
+}
+
+func TestMiddlewareRequiresAccount(t *testing.T) {
+	// Sem Account não há conta de onde tirar o código, nem de um cabeçalho do cliente.
+	m := NewMiddleware(NewVerifier(NewMemoryStore(), VerifyOtp{}), MiddlewareOtp{})
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("Handler protegido não pode ser chamado")
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-OTP-Account", "Painel:ana")
+	r.Header.Set("X-OTP", "123456")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestMiddlewareShortSessionKey(t *testing.T) {
+	for _, key := range [][]byte{{}, []byte("stepup")} {
+		m := NewMiddleware(NewVerifier(NewMemoryStore(), VerifyOtp{}), MiddlewareOtp{Account: AccountFromBasicAuth("Painel"), SessionKey: key})
+		h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Fatal("Handler protegido não pode ser chamado")
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("ana", "senha")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusInternalServerError, w.Code, "Chave de %d bytes", len(key))
+	}
+}
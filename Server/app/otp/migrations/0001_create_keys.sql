@@ -0,0 +1,21 @@
+CREATE TABLE otp_keys (
+	id            VARCHAR(255) NOT NULL PRIMARY KEY,
+	url           TEXT         NOT NULL,
+	state         VARCHAR(16)  NOT NULL,
+	created_at    BIGINT       NOT NULL,
+	expires_at    BIGINT       NOT NULL,
+	activated_at  BIGINT       NOT NULL,
+	last_used_at  BIGINT       NOT NULL,
+	confirmations INTEGER      NOT NULL,
+	counter       BIGINT       NOT NULL,
+	last_step     BIGINT       NOT NULL,
+	next_url      TEXT         NOT NULL,
+	next_counter  BIGINT       NOT NULL,
+	grace_until   BIGINT       NOT NULL,
+	failures      INTEGER      NOT NULL,
+	locked_until  BIGINT       NOT NULL,
+	recovery      TEXT         NOT NULL,
+	key_version   VARCHAR(64)  NOT NULL,
+	wrapped_key   TEXT         NOT NULL,
+	version       BIGINT       NOT NULL
+);
@@ -0,0 +1,2 @@
+-- Sem DEFAULT, que o MySQL não aceita em TEXT. As linhas antigas ficam com NULL.
+ALTER TABLE otp_keys ADD COLUMN devices TEXT;
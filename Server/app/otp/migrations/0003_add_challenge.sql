@@ -0,0 +1 @@
+ALTER TABLE otp_keys ADD COLUMN challenge TEXT;
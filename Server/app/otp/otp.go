@@ -5,7 +5,6 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"errors"
 	"fmt"
 	"hash"
 	"image"
@@ -17,10 +16,10 @@ import (
 	"github.com/boombuler/barcode/qr"
 )
 
-var ErrValidateSecretInvalidBase32 = errors.New("Falha na decodificação do secredo com a base 32")
-var ErrValidateInputInvalidLength = errors.New("Comprimento de entrada inesperado")
-var ErrGenerateMissingIssuer = errors.New("Emissor deve ser definido")
-var ErrGenerateMissingAccountName = errors.New("AccountName deve ser difinido ")
+var ErrValidateSecretInvalidBase32 = newError("validate.secret_invalid_base32", KindInvalidArgument)
+var ErrValidateInputInvalidLength = newError("validate.input_invalid_length", KindInvalidArgument)
+var ErrGenerateMissingIssuer = newError("generate.missing_issuer", KindInvalidArgument)
+var ErrGenerateMissingAccountName = newError("generate.missing_account_name", KindInvalidArgument)
 
 type Key struct {
 	//Chave representa uma chave TOTP ou HTOP.
@@ -0,0 +1,445 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrPushNotFound = newError("push.not_found", KindNotFound)
+var ErrPushExpired = newError("push.expired", KindUnauthenticated)
+var ErrPushDenied = newError("push.denied", KindUnauthenticated)
+var ErrPushAnswered = newError("push.answered", KindFailedPrecondition)
+var ErrPushTooMany = newError("push.too_many", KindResourceExhausted)
+
+// MethodPush indica um login aprovado no aplicativo companheiro.
+const MethodPush Method = "push"
+
+// PushStatus é a situação de um PushChallenge.
+type PushStatus string
+
+const (
+	PushPending  PushStatus = "pending"
+	PushApproved PushStatus = "approved"
+	PushDenied   PushStatus = "denied"
+)
+
+// PushOtp fornece opções para Push.
+type PushOtp struct {
+	TTL        time.Duration // Validade de um pedido. O padrão é 2 minutos.
+	MaxPending uint          // Pedidos pendentes por conta, contra "push bombing". O padrão é 3.
+	Rand       io.Reader
+}
+
+func (o PushOtp) defaults() PushOtp {
+	if o.TTL == 0 {
+		o.TTL = 2 * time.Minute
+	}
+	if o.MaxPending == 0 {
+		o.MaxPending = 3
+	}
+	if o.Rand == nil {
+		o.Rand = rand.Reader
+	}
+	return o
+}
+
+// PushChallenge é um pedido de aprovação de login. Number aparece apenas na
+// tela de login e nunca é enviado ao aplicativo companheiro: o usuário precisa
+// digitá-lo lá para aprovar, o que impede aprovações por engano.
+type PushChallenge struct {
+	ID        string     `json:"id"`
+	Account   string     `json:"account"`
+	Number    string     `json:"-"`
+	Details   string     `json:"details,omitempty"` // ex.: navegador, IP e local do login
+	Status    PushStatus `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// pushWatch acorda quem espera pedidos de uma conta; n conta quantos esperam.
+type pushWatch struct {
+	ch chan struct{}
+	n  int
+}
+
+type pushState struct {
+	c    PushChallenge
+	done chan struct{} // fecha quando o pedido é respondido
+}
+
+// Push é um segundo fator por aprovação no aplicativo companheiro, com
+// confirmação do número. Os pedidos ficam em memória, pois duram poucos
+// minutos; com várias instâncias a tela de login e o aplicativo precisam ser
+// atendidos pela mesma (sessão fixa). O código OTP do Verifier continua
+// aceito para a mesma conta com Fallback.
+//
+//	c, _ := push.Begin("Brisa:ana", "Firefox, São Paulo", now) // mostra c.Number
+//	m, err := push.Wait(ctx, c.ID)                             // aguarda o aplicativo
+type Push struct {
+	verify *Verifier
+	otp    PushOtp
+	audit  *Auditor
+	now    func() time.Time
+
+	mu         sync.Mutex
+	challenges map[string]*pushState
+	watchers   map[string]*pushWatch // por conta, fecha a cada mudança
+}
+
+func NewPush(verify *Verifier, otp PushOtp) *Push {
+	return &Push{
+		verify:     verify,
+		otp:        otp.defaults(),
+		now:        time.Now,
+		challenges: map[string]*pushState{},
+		watchers:   map[string]*pushWatch{},
+	}
+}
+
+// UseAuditor faz o Push registrar pedidos, respostas e logins em a.
+func (p *Push) UseAuditor(a *Auditor) {
+	p.audit = a
+}
+
+// Begin cria um pedido para a conta id (issuer:account). details é mostrado
+// no aplicativo para o usuário reconhecer o login.
+func (p *Push) Begin(id, details string, t time.Time) (*PushChallenge, error) {
+	c, err := p.begin(id, details, t)
+	p.audit.recordResult(AuditPushBegin, id, t, err)
+	return c, err
+}
+
+func (p *Push) begin(id, details string, t time.Time) (*PushChallenge, error) {
+	if err := p.active(id); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, 16)
+	if _, err := io.ReadFull(p.otp.Rand, raw); err != nil {
+		return nil, err
+	}
+	n, err := rand.Int(p.otp.Rand, big.NewInt(100))
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune(t)
+	pending := uint(0)
+	for _, s := range p.challenges {
+		if s.c.Account == id && s.c.Status == PushPending {
+			pending++
+		}
+	}
+	if pending >= p.otp.MaxPending {
+		return nil, ErrPushTooMany
+	}
+	c := PushChallenge{
+		ID:        base64.RawURLEncoding.EncodeToString(raw),
+		Account:   id,
+		Number:    fmt.Sprintf("%02d", n.Int64()),
+		Details:   details,
+		Status:    PushPending,
+		CreatedAt: t,
+		ExpiresAt: t.Add(p.otp.TTL),
+	}
+	p.challenges[c.ID] = &pushState{c: c, done: make(chan struct{})}
+	p.changed(id)
+	return &c, nil
+}
+
+// active confere se a conta id tem uma chave ativa, a mesma exigência do
+// Verifier: contas desativadas ou com novo cadastro obrigatório não usam push.
+func (p *Push) active(id string) error {
+	rec, err := p.verify.store.Get(id)
+	if err != nil {
+		return err
+	}
+	if rec.State != KeyActive {
+		return ErrKeyNotActive
+	}
+	return nil
+}
+
+// prune remove os pedidos expirados. Deve ser chamado com p.mu.
+func (p *Push) prune(t time.Time) {
+	for k, s := range p.challenges {
+		if !t.Before(s.c.ExpiresAt) {
+			delete(p.challenges, k)
+		}
+	}
+}
+
+// changed acorda quem espera pedidos da conta. Deve ser chamado com p.mu.
+func (p *Push) changed(account string) {
+	if w, ok := p.watchers[account]; ok {
+		close(w.ch)
+		delete(p.watchers, account)
+	}
+}
+
+// pending retorna os pedidos pendentes da conta, um canal que fecha na
+// próxima mudança e a função que quem espera chama ao desistir, para que
+// contas sem ninguém esperando não fiquem em p.watchers.
+func (p *Push) pending(account string) ([]PushChallenge, <-chan struct{}, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune(p.now())
+	out := []PushChallenge{}
+	for _, s := range p.challenges {
+		if s.c.Account == account && s.c.Status == PushPending {
+			c := s.c
+			c.Number = ""
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	w, ok := p.watchers[account]
+	if !ok {
+		w = &pushWatch{ch: make(chan struct{})}
+		p.watchers[account] = w
+	}
+	w.n++
+	release := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		w.n--
+		if cur, ok := p.watchers[account]; ok && cur == w && w.n == 0 {
+			delete(p.watchers, account)
+		}
+	}
+	return out, w.ch, release
+}
+
+// Pending retorna os pedidos pendentes da conta para o aplicativo, sem o
+// número. Se não houver nenhum espera até chegar um ou ctx terminar (long poll).
+func (p *Push) Pending(ctx context.Context, account string) []PushChallenge {
+	for {
+		list, changed, release := p.pending(account)
+		if len(list) > 0 {
+			release()
+			return list
+		}
+		select {
+		case <-changed:
+			release()
+		case <-ctx.Done():
+			release()
+			return list
+		}
+	}
+}
+
+// Respond registra a resposta do aplicativo da conta account. Para aprovar,
+// number precisa ser o mostrado na tela de login; um número errado recusa o
+// pedido, para que não seja possível tentar de novo. Cada pedido aceita uma
+// única resposta.
+func (p *Push) Respond(account, challengeID, number string, approve bool, t time.Time) error {
+	err := p.respond(account, challengeID, number, approve, t)
+	p.audit.recordResult(AuditPushRespond, account, t, err)
+	return err
+}
+
+func (p *Push) respond(account, challengeID, number string, approve bool, t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.challenges[challengeID]
+	if !ok || s.c.Account != account {
+		return ErrPushNotFound
+	}
+	if !t.Before(s.c.ExpiresAt) {
+		return ErrPushExpired
+	}
+	if s.c.Status != PushPending {
+		return ErrPushAnswered
+	}
+
+	var err error
+	s.c.Status = PushDenied
+	if approve {
+		if subtle.ConstantTimeCompare([]byte(number), []byte(s.c.Number)) == 1 {
+			s.c.Status = PushApproved
+		} else {
+			err = ErrValidateInvalidCode
+		}
+	}
+	close(s.done)
+	p.changed(account)
+	return err
+}
+
+// Wait espera a resposta ao pedido challengeID. Uma aprovação só pode ser
+// usada uma vez: o pedido é removido quando Wait retorna.
+func (p *Push) Wait(ctx context.Context, challengeID string) (Match, error) {
+	p.mu.Lock()
+	s, ok := p.challenges[challengeID]
+	p.mu.Unlock()
+	if !ok {
+		return Match{}, ErrPushNotFound
+	}
+
+	timer := time.NewTimer(s.c.ExpiresAt.Sub(p.now()))
+	defer timer.Stop()
+	select {
+	case <-s.done:
+	case <-timer.C:
+	case <-ctx.Done():
+		return Match{}, ctx.Err()
+	}
+
+	t := p.now()
+	p.mu.Lock()
+	cur, ok := p.challenges[challengeID]
+	if ok && cur == s && s.c.Status != PushPending {
+		delete(p.challenges, challengeID)
+	}
+	status := s.c.Status
+	p.mu.Unlock()
+
+	var err error
+	switch {
+	case !ok || cur != s:
+		err = ErrPushNotFound // já usado por outro Wait
+	case status == PushApproved:
+		// A conta pode ter sido desativada enquanto o pedido esperava.
+		err = p.active(s.c.Account)
+	case status == PushDenied:
+		err = ErrPushDenied
+	default:
+		err = ErrPushExpired
+	}
+	e := AuditEntry{Time: t, Event: AuditVerify, Account: s.c.Account, Success: err == nil, Error: auditError(err)}
+	if err == nil {
+		e.Method = MethodPush
+	}
+	p.audit.Record(e)
+	if err != nil {
+		return Match{}, err
+	}
+	return Match{Method: MethodPush}, nil
+}
+
+// Fallback valida um código OTP da conta do pedido challengeID, para quem
+// está sem o aplicativo à mão, e cancela o pedido em caso de sucesso.
+func (p *Push) Fallback(challengeID, passcode string, t time.Time) (Match, error) {
+	p.mu.Lock()
+	s, ok := p.challenges[challengeID]
+	p.mu.Unlock()
+	if !ok {
+		return Match{}, ErrPushNotFound
+	}
+	if !t.Before(s.c.ExpiresAt) {
+		return Match{}, ErrPushExpired
+	}
+	m, err := p.verify.Verify(s.c.Account, passcode, t)
+	if err != nil {
+		return Match{}, err
+	}
+	p.mu.Lock()
+	if s.c.Status == PushPending {
+		s.c.Status = PushDenied
+		close(s.done)
+	}
+	delete(p.challenges, challengeID)
+	p.changed(s.c.Account)
+	p.mu.Unlock()
+	return m, nil
+}
+
+// CompanionHandler atende o aplicativo companheiro. account retorna a conta
+// já autenticada da requisição, como AccountFromHeader. Os caminhos são:
+//
+//	GET  /pending  pedidos pendentes em JSON, esperando até 25 segundos se não houver
+//	GET  /stream   os mesmos pedidos como Server-Sent Events, a cada mudança
+//	POST /respond  {"id": ..., "number": "42", "approve": true}
+func (p *Push) CompanionHandler(account func(r *http.Request) (string, error)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pending", func(w http.ResponseWriter, r *http.Request) {
+		id, err := account(r)
+		if err != nil {
+			http.Error(w, Localize(err, r.Header.Get("Accept-Language")), HTTPStatus(err))
+			return
+		}
+		wait := 25 * time.Second
+		if s, err := strconv.Atoi(r.URL.Query().Get("wait")); err == nil && s >= 0 && s < 60 {
+			wait = time.Duration(s) * time.Second
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Pending(ctx, id))
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		id, err := account(r)
+		if err != nil {
+			http.Error(w, Localize(err, r.Header.Get("Accept-Language")), HTTPStatus(err))
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			list, changed, release := p.pending(id)
+			b, _ := json.Marshal(list)
+			fmt.Fprintf(w, "event: pending\ndata: %s\n\n", b)
+			flusher.Flush()
+			for waiting := true; waiting; {
+				select {
+				case <-changed:
+					waiting = false
+				case <-heartbeat.C:
+					fmt.Fprint(w, ": ping\n\n")
+					flusher.Flush()
+				case <-r.Context().Done():
+					release()
+					return
+				}
+			}
+			release()
+		}
+	})
+	mux.HandleFunc("/respond", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		lang := r.Header.Get("Accept-Language")
+		id, err := account(r)
+		if err != nil {
+			http.Error(w, Localize(err, lang), HTTPStatus(err))
+			return
+		}
+		var req struct {
+			ID      string `json:"id"`
+			Number  string `json:"number"`
+			Approve bool   `json:"approve"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if err := p.Respond(id, req.ID, req.Number, req.Approve, p.now()); err != nil {
+			http.Error(w, Localize(err, lang), HTTPStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
@@ -0,0 +1,208 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPush(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		entries []AuditEntry
+	)
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{Skew: 1})
+	secret := "JBSWY3DPEHPK3PXP"
+	id := newActiveRecord(t, s, "otpauth://totp/Brisa:ana?secret="+secret+"&issuer=Brisa")
+	now := time.Unix(1700000000, 0).UTC()
+	p := NewPush(v, PushOtp{TTL: time.Minute, MaxPending: 2})
+	p.now = func() time.Time { return now }
+	p.UseAuditor(NewAuditor(AuditCallback(func(e AuditEntry) {
+		mu.Lock()
+		entries = append(entries, e)
+		mu.Unlock()
+	})))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// O aplicativo espera (long poll) até o login pedir aprovação.
+	got := make(chan []PushChallenge)
+	go func() { got <- p.Pending(ctx, id) }()
+	c, err := p.Begin(id, "Firefox, São Paulo", now)
+	require.NoError(t, err)
+	require.Regexp(t, `^\d{2}$`, c.Number)
+	list := <-got
+	require.Len(t, list, 1)
+	require.Equal(t, c.ID, list[0].ID)
+	require.Equal(t, "Firefox, São Paulo", list[0].Details)
+	require.Empty(t, list[0].Number, "O número só aparece na tela de login")
+
+	result := make(chan error)
+	go func() {
+		m, err := p.Wait(ctx, c.ID)
+		if err == nil && m.Method != MethodPush {
+			err = ErrValidateInvalidCode
+		}
+		result <- err
+	}()
+	require.ErrorIs(t, p.Respond(KeyID("Brisa", "bia"), c.ID, c.Number, true, now), ErrPushNotFound, "Outra conta")
+	require.NoError(t, p.Respond(id, c.ID, c.Number, true, now))
+	require.NoError(t, <-result)
+	require.ErrorIs(t, p.Respond(id, c.ID, c.Number, true, now), ErrPushNotFound, "Replay")
+	_, err = p.Wait(ctx, c.ID)
+	require.ErrorIs(t, err, ErrPushNotFound, "A aprovação vale para um único login")
+
+	// Número errado recusa o pedido de vez.
+	c, err = p.Begin(id, "", now)
+	require.NoError(t, err)
+	wrong := "00"
+	if c.Number == wrong {
+		wrong = "01"
+	}
+	require.ErrorIs(t, p.Respond(id, c.ID, wrong, true, now), ErrValidateInvalidCode)
+	require.ErrorIs(t, p.Respond(id, c.ID, c.Number, true, now), ErrPushAnswered)
+	_, err = p.Wait(ctx, c.ID)
+	require.ErrorIs(t, err, ErrPushDenied)
+
+	// Recusa explícita, limite de pendentes e expiração.
+	c, err = p.Begin(id, "", now)
+	require.NoError(t, err)
+	require.NoError(t, p.Respond(id, c.ID, "", false, now))
+	_, err = p.Wait(ctx, c.ID)
+	require.ErrorIs(t, err, ErrPushDenied)
+
+	c1, err := p.Begin(id, "", now)
+	require.NoError(t, err)
+	_, err = p.Begin(id, "", now)
+	require.NoError(t, err)
+	_, err = p.Begin(id, "", now)
+	require.ErrorIs(t, err, ErrPushTooMany)
+	require.ErrorIs(t, p.Respond(id, c1.ID, c1.Number, true, now.Add(time.Minute)), ErrPushExpired)
+	now = now.Add(time.Minute)
+	_, err = p.Wait(ctx, c1.ID)
+	require.ErrorIs(t, err, ErrPushExpired)
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	require.Empty(t, p.Pending(short, id), "Expirados não aparecem")
+	p.mu.Lock()
+	require.Empty(t, p.watchers, "Quem desiste de esperar não fica registrado")
+	p.mu.Unlock()
+
+	// Sem o aplicativo, o código TOTP da mesma conta resolve o pedido.
+	c, err = p.Begin(id, "", now)
+	require.NoError(t, err)
+	_, err = p.Fallback(c.ID, "000000", now)
+	require.ErrorIs(t, err, ErrValidateInvalidCode)
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+	m, err := p.Fallback(c.ID, code, now)
+	require.NoError(t, err)
+	require.Equal(t, MethodTOTP, m.Method)
+	require.ErrorIs(t, p.Respond(id, c.ID, c.Number, true, now), ErrPushNotFound)
+
+	// Só contas ativas: nem novos pedidos nem aprovações já dadas valem
+	// depois que a chave é desativada.
+	_, err = p.Begin(KeyID("Brisa", "ninguem"), "", now)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	c, err = p.Begin(id, "", now)
+	require.NoError(t, err)
+	require.NoError(t, p.Respond(id, c.ID, c.Number, true, now))
+	require.NoError(t, v.Disable(id, "suporte", now))
+	_, err = p.Wait(ctx, c.ID)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+	_, err = p.Begin(id, "", now)
+	require.ErrorIs(t, err, ErrKeyNotActive)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, AuditPushBegin, entries[0].Event)
+	require.True(t, entries[0].Success)
+	require.Equal(t, AuditPushRespond, entries[1].Event)
+	require.False(t, entries[1].Success)
+	require.Equal(t, AuditPushRespond, entries[2].Event)
+	require.True(t, entries[2].Success)
+	require.Equal(t, AuditVerify, entries[3].Event)
+	require.Equal(t, MethodPush, entries[3].Method)
+}
+
+func TestPushCompanionHandler(t *testing.T) {
+	s := NewMemoryStore()
+	id := newActiveRecord(t, s, "otpauth://totp/Brisa:ana?secret=JBSWY3DPEHPK3PXP&issuer=Brisa")
+	p := NewPush(NewVerifier(s, VerifyOtp{}), PushOtp{})
+	h := p.CompanionHandler(AccountFromHeader("X-User", "Brisa"))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-User", "ana")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("/pending?wait=0")
+	var list []PushChallenge
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	require.Empty(t, list)
+
+	// O stream manda a lista atual e outra a cada mudança.
+	stream := get("/stream")
+	defer stream.Body.Close()
+	require.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+	events := bufio.NewScanner(stream.Body)
+	next := func() []PushChallenge {
+		for events.Scan() {
+			if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+				var list []PushChallenge
+				require.NoError(t, json.Unmarshal([]byte(data), &list))
+				return list
+			}
+		}
+		require.NoError(t, events.Err())
+		return nil
+	}
+	require.Empty(t, next())
+
+	c, err := p.Begin(id, "Chrome", time.Now())
+	require.NoError(t, err)
+	list = next()
+	require.Len(t, list, 1)
+	require.Equal(t, c.ID, list[0].ID)
+
+	resp = get("/pending")
+	list = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	require.Len(t, list, 1)
+
+	respond := func(user, body string) int {
+		req, err := http.NewRequest("POST", srv.URL+"/respond", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-User", user)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusUnauthorized, respond("", `{}`))
+	require.Equal(t, http.StatusNotFound, respond("bia", `{"id":"`+c.ID+`","number":"`+c.Number+`","approve":true}`))
+	require.Equal(t, http.StatusNoContent, respond("ana", `{"id":"`+c.ID+`","number":"`+c.Number+`","approve":true}`))
+	require.Equal(t, http.StatusForbidden, respond("ana", `{"id":"`+c.ID+`","number":"`+c.Number+`","approve":true}`))
+	require.Empty(t, next(), "Respondido sai da lista")
+
+	m, err := p.Wait(context.Background(), c.ID)
+	require.NoError(t, err)
+	require.Equal(t, MethodPush, m.Method)
+}
@@ -0,0 +1,443 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRadiusMalformed = newError("radius.malformed", KindInvalidArgument)
+var ErrRadiusInvalidState = newError("radius.invalid_state", KindUnauthenticated)
+
+// Códigos e atributos RADIUS usados (RFC 2865 e RFC 3579).
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusReplyMessage         = 18
+	radiusState                = 24
+	radiusMessageAuthenticator = 80
+)
+
+// RadiusMode define o que o cliente envia em User-Password.
+type RadiusMode int
+
+const (
+	// RadiusOTPOnly: User-Password é apenas o código.
+	RadiusOTPOnly RadiusMode = iota
+	// RadiusConcat: User-Password é a senha seguida do código, ex.: "segredo123456".
+	RadiusConcat
+	// RadiusChallenge: o primeiro pedido traz a senha e recebe um Access-Challenge;
+	// o segundo traz o código e o State do desafio.
+	RadiusChallenge
+)
+
+// RadiusOtp fornece opções para RadiusServer.
+type RadiusOtp struct {
+	Issuer string // Emissor das chaves; User-Name é a conta.
+	Mode   RadiusMode
+	// Password confere a senha nos modos RadiusConcat e RadiusChallenge.
+	Password func(user, password string) (bool, error)
+	// Aceita Access-Request sem Message-Authenticator, para clientes antigos.
+	// Sem ele qualquer máquina que alcance a porta pode gastar as tentativas
+	// de qualquer conta, por isso o padrão é exigi-lo.
+	AllowNoMessageAuthenticator bool
+	ChallengeTTL                time.Duration // Validade do desafio. O padrão é 2 minutos.
+	ChallengeMessage            string        // O padrão é "Digite o código OTP".
+	// Pedidos atendidos ao mesmo tempo. O padrão é 64; além disso Serve para
+	// de ler e os pacotes excedentes ficam na fila do sistema.
+	MaxConcurrent int
+}
+
+// RadiusServer atende Access-Request com PAP e valida os códigos com um Verifier.
+// Retransmissões de um pedido já respondido recebem a mesma resposta, para que
+// não contem como reuso do código. O State de um desafio vale para um único
+// pedido com código.
+type RadiusServer struct {
+	verify *Verifier
+	secret []byte
+	otp    RadiusOtp
+	now    func() time.Time
+
+	mu      sync.Mutex
+	replies map[string]*radiusReply // por endereço, Identifier e Request Authenticator
+	used    map[string]time.Time    // nonces de State já usados, até expirarem
+	// Filas em ordem de inserção para remover os itens vencidos sem percorrer
+	// os mapas a cada pacote.
+	replyQueue []radiusExpiry
+	usedQueue  []radiusExpiry
+}
+
+type radiusExpiry struct {
+	key     string
+	reply   *radiusReply // nil em usedQueue
+	expires time.Time
+}
+
+// radiusReply guarda a resposta de um pedido; done fecha quando ela fica pronta.
+type radiusReply struct {
+	data    []byte
+	expires time.Time
+	done    chan struct{}
+}
+
+// NewRadiusServer cria o servidor. secret é o segredo compartilhado com os clientes RADIUS.
+func NewRadiusServer(verify *Verifier, secret []byte, otp RadiusOtp) *RadiusServer {
+	if otp.ChallengeTTL == 0 {
+		otp.ChallengeTTL = 2 * time.Minute
+	}
+	if otp.ChallengeMessage == "" {
+		otp.ChallengeMessage = "Digite o código OTP"
+	}
+	if otp.MaxConcurrent <= 0 {
+		otp.MaxConcurrent = 64
+	}
+	return &RadiusServer{
+		verify:  verify,
+		secret:  append([]byte(nil), secret...),
+		otp:     otp,
+		now:     time.Now,
+		replies: map[string]*radiusReply{},
+		used:    map[string]time.Time{},
+	}
+}
+
+// ListenAndServe escuta em addr via UDP, normalmente ":1812".
+func (s *RadiusServer) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Serve atende pacotes de conn até que ele seja fechado, no máximo
+// MaxConcurrent ao mesmo tempo. Pacotes inválidos ou com autenticação errada
+// são descartados, como pede a RFC 2865.
+func (s *RadiusServer) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 4096)
+	sem := make(chan struct{}, s.otp.MaxConcurrent)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		req := append([]byte(nil), buf[:n]...)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			if resp := s.handle(addr.String(), req); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+type radiusPacket struct {
+	code          byte
+	id            byte
+	authenticator [16]byte
+	attrs         []radiusAttr
+}
+
+type radiusAttr struct {
+	typ   byte
+	value []byte
+}
+
+func parseRadius(b []byte) (*radiusPacket, error) {
+	if len(b) < 20 {
+		return nil, ErrRadiusMalformed
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 20 || length > len(b) || length > 4096 {
+		return nil, ErrRadiusMalformed
+	}
+	p := &radiusPacket{code: b[0], id: b[1]}
+	copy(p.authenticator[:], b[4:20])
+	for rest := b[20:length]; len(rest) > 0; {
+		if len(rest) < 2 || rest[1] < 2 || int(rest[1]) > len(rest) {
+			return nil, ErrRadiusMalformed
+		}
+		p.attrs = append(p.attrs, radiusAttr{typ: rest[0], value: rest[2:rest[1]]})
+		rest = rest[rest[1]:]
+	}
+	return p, nil
+}
+
+func (p *radiusPacket) attr(typ byte) ([]byte, bool) {
+	for _, a := range p.attrs {
+		if a.typ == typ {
+			return a.value, true
+		}
+	}
+	return nil, false
+}
+
+func (p *radiusPacket) add(typ byte, value []byte) {
+	p.attrs = append(p.attrs, radiusAttr{typ: typ, value: value})
+}
+
+// encode serializa p. Se houver Message-Authenticator, ele é calculado com
+// o autenticador atual de p, antes de o chamador trocar o autenticador.
+func (p *radiusPacket) encode(secret []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{p.code, p.id, 0, 0})
+	b.Write(p.authenticator[:])
+	mac := -1
+	for _, a := range p.attrs {
+		if a.typ == radiusMessageAuthenticator {
+			mac = b.Len() + 2
+			a.value = make([]byte, 16)
+		}
+		b.Write([]byte{a.typ, byte(len(a.value) + 2)})
+		b.Write(a.value)
+	}
+	out := b.Bytes()
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+	if mac >= 0 {
+		h := hmac.New(md5.New, secret)
+		h.Write(out)
+		copy(out[mac:mac+16], h.Sum(nil))
+	}
+	return out
+}
+
+// checkMessageAuthenticator confere o atributo 80 de um Access-Request:
+// HMAC-MD5 do pacote com o próprio atributo zerado.
+func checkMessageAuthenticator(raw []byte, secret []byte) (present, ok bool) {
+	length := int(binary.BigEndian.Uint16(raw[2:4]))
+	b := append([]byte(nil), raw[:length]...)
+	for i := 20; i+2 <= len(b); i += int(b[i+1]) {
+		if b[i] != radiusMessageAuthenticator {
+			continue
+		}
+		if b[i+1] != 18 {
+			return true, false
+		}
+		got := append([]byte(nil), b[i+2:i+18]...)
+		copy(b[i+2:i+18], make([]byte, 16))
+		h := hmac.New(md5.New, secret)
+		h.Write(b)
+		return true, hmac.Equal(got, h.Sum(nil))
+	}
+	return false, false
+}
+
+// decryptPAP desfaz a ocultação do User-Password (RFC 2865, seção 5.2).
+func decryptPAP(secret []byte, auth [16]byte, c []byte) ([]byte, error) {
+	if len(c) == 0 || len(c)%16 != 0 || len(c) > 128 {
+		return nil, ErrRadiusMalformed
+	}
+	out := make([]byte, len(c))
+	prev := auth[:]
+	for i := 0; i < len(c); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			out[i+j] = c[i+j] ^ b[j]
+		}
+		prev = c[i : i+16]
+	}
+	return bytes.TrimRight(out, "\x00"), nil
+}
+
+func (s *RadiusServer) handle(from string, raw []byte) []byte {
+	req, err := parseRadius(raw)
+	if err != nil || req.code != radiusAccessRequest {
+		return nil
+	}
+	present, ok := checkMessageAuthenticator(raw, s.secret)
+	if (present && !ok) || (!present && !s.otp.AllowNoMessageAuthenticator) {
+		return nil
+	}
+
+	t := s.now()
+	key := from + string([]byte{req.id}) + string(req.authenticator[:])
+	s.mu.Lock()
+	s.prune(t)
+	if r, ok := s.replies[key]; ok {
+		s.mu.Unlock()
+		<-r.done
+		return r.data
+	}
+	r := &radiusReply{done: make(chan struct{})}
+	s.replies[key] = r
+	s.mu.Unlock()
+
+	resp := s.respond(req, present, t)
+
+	s.mu.Lock()
+	r.data, r.expires = resp, t.Add(30*time.Second)
+	s.replyQueue = append(s.replyQueue, radiusExpiry{key: key, reply: r, expires: r.expires})
+	s.mu.Unlock()
+	close(r.done)
+	return resp
+}
+
+// prune remove respostas e nonces vencidos. Deve ser chamado com s.mu.
+func (s *RadiusServer) prune(t time.Time) {
+	for len(s.replyQueue) > 0 && !t.Before(s.replyQueue[0].expires) {
+		e := s.replyQueue[0]
+		if s.replies[e.key] == e.reply {
+			delete(s.replies, e.key)
+		}
+		s.replyQueue = s.replyQueue[1:]
+	}
+	for len(s.usedQueue) > 0 && !t.Before(s.usedQueue[0].expires) {
+		e := s.usedQueue[0]
+		if exp, ok := s.used[e.key]; ok && !t.Before(exp) {
+			delete(s.used, e.key)
+		}
+		s.usedQueue = s.usedQueue[1:]
+	}
+}
+
+// challengeState gera o State de um desafio para id: um nonce aleatório e id,
+// assinados e com validade.
+func (s *RadiusServer) challengeState(id string, t time.Time) ([]byte, error) {
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(raw)
+	return []byte(sealSession(s.secret, sessionRadiusState, nonce+"|"+id, t.Add(s.otp.ChallengeTTL))), nil
+}
+
+// consumeState confere o State de um desafio para id e o marca como usado.
+func (s *RadiusServer) consumeState(state []byte, id string, t time.Time) bool {
+	v, ok := openSession(s.secret, sessionRadiusState, string(state), t)
+	if !ok {
+		return false
+	}
+	nonce, sid, ok := strings.Cut(v, "|")
+	if !ok || sid != id {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.used[nonce]; ok {
+		return false
+	}
+	// O nonce fica guardado pelo maior tempo que o State ainda poderia valer.
+	exp := t.Add(s.otp.ChallengeTTL)
+	s.used[nonce] = exp
+	s.usedQueue = append(s.usedQueue, radiusExpiry{key: nonce, expires: exp})
+	return true
+}
+
+func (s *RadiusServer) respond(req *radiusPacket, withMAC bool, t time.Time) []byte {
+	code, msg, state := s.authenticate(req, t)
+
+	resp := &radiusPacket{code: code, id: req.id, authenticator: req.authenticator}
+	if msg != "" {
+		resp.add(radiusReplyMessage, []byte(msg))
+	}
+	if state != nil {
+		resp.add(radiusState, state)
+	}
+	if withMAC {
+		resp.add(radiusMessageAuthenticator, nil)
+	}
+
+	// Response Authenticator = MD5(Code+ID+Length+RequestAuth+Atributos+Segredo).
+	out := resp.encode(s.secret)
+	h := md5.New()
+	h.Write(out)
+	h.Write(s.secret)
+	copy(out[4:20], h.Sum(nil))
+	return out
+}
+
+// authenticate retorna o código da resposta, a Reply-Message e o State de um desafio.
+func (s *RadiusServer) authenticate(req *radiusPacket, t time.Time) (byte, string, []byte) {
+	user, ok := req.attr(radiusUserName)
+	if !ok || len(user) == 0 {
+		return radiusAccessReject, "", nil
+	}
+	cipher, ok := req.attr(radiusUserPassword)
+	if !ok {
+		return radiusAccessReject, "", nil
+	}
+	password, err := decryptPAP(s.secret, req.authenticator, cipher)
+	if err != nil {
+		return radiusAccessReject, "", nil
+	}
+	id := KeyID(s.otp.Issuer, string(user))
+
+	var code string
+	switch s.otp.Mode {
+	case RadiusOTPOnly:
+		code = string(password)
+
+	case RadiusConcat:
+		digits, err := keyDigits(s.verify.store, id)
+		if err != nil || len(password) < digits {
+			return radiusAccessReject, s.message(ErrValidateInvalidCode), nil
+		}
+		pass, c := password[:len(password)-digits], password[len(password)-digits:]
+		if ok, err := s.checkPassword(string(user), string(pass)); !ok || err != nil {
+			return radiusAccessReject, s.message(ErrValidateInvalidCode), nil
+		}
+		code = string(c)
+
+	case RadiusChallenge:
+		state, ok := req.attr(radiusState)
+		if !ok {
+			if ok, err := s.checkPassword(string(user), string(password)); !ok || err != nil {
+				return radiusAccessReject, s.message(ErrValidateInvalidCode), nil
+			}
+			st, err := s.challengeState(id, t)
+			if err != nil {
+				return radiusAccessReject, "", nil
+			}
+			return radiusAccessChallenge, s.otp.ChallengeMessage, st
+		}
+		if !s.consumeState(state, id, t) {
+			return radiusAccessReject, s.message(ErrRadiusInvalidState), nil
+		}
+		code = string(password)
+	}
+
+	if _, err := s.verify.Verify(id, strings.TrimSpace(code), t); err != nil {
+		if err == ErrKeyNotFound || err == ErrKeyNotActive {
+			err = ErrValidateInvalidCode
+		}
+		return radiusAccessReject, s.message(err), nil
+	}
+	return radiusAccessAccept, "", nil
+}
+
+func (s *RadiusServer) checkPassword(user, password string) (bool, error) {
+	if s.otp.Password == nil {
+		return false, nil
+	}
+	return s.otp.Password(user, password)
+}
+
+// message limita a Reply-Message ao tamanho de um atributo.
+func (s *RadiusServer) message(err error) string {
+	m := Localize(err, DefaultLanguage)
+	if len(m) > 253 {
+		m = m[:253]
+	}
+	return m
+}
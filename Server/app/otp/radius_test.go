@@ -0,0 +1,263 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// radiusClient é um cliente RADIUS mínimo para os testes.
+type radiusClient struct {
+	t      *testing.T
+	conn   net.Conn
+	secret []byte
+	id     byte
+}
+
+func newTestRadius(t *testing.T, otp RadiusOtp, now time.Time) (*radiusClient, string) {
+	s := NewMemoryStore()
+	secret := "JBSWY3DPEHPK3PXP"
+	newActiveRecord(t, s, "otpauth://totp/VPN:ana?secret="+secret+"&issuer=VPN")
+	otp.Issuer = "VPN"
+	srv := NewRadiusServer(NewVerifier(s, VerifyOtp{Skew: 1}), []byte("testing123"), otp)
+	srv.now = func() time.Time { return now }
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(pc)
+	t.Cleanup(func() { pc.Close() })
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &radiusClient{t: t, conn: conn, secret: []byte("testing123")}, secret
+}
+
+// request monta um Access-Request com User-Name e User-Password (PAP).
+func (c *radiusClient) request(user, password string, state []byte, withMAC bool) []byte {
+	c.id++
+	p := &radiusPacket{code: radiusAccessRequest, id: c.id}
+	rand.Read(p.authenticator[:])
+	p.add(radiusUserName, []byte(user))
+	p.add(radiusUserPassword, encryptPAP(c.secret, p.authenticator, []byte(password)))
+	if state != nil {
+		p.add(radiusState, state)
+	}
+	if withMAC {
+		p.add(radiusMessageAuthenticator, nil)
+	}
+	return p.encode(c.secret)
+}
+
+// send envia raw e retorna a resposta já conferida, ou nil se não houver resposta.
+func (c *radiusClient) send(raw []byte) *radiusPacket {
+	_, err := c.conn.Write(raw)
+	require.NoError(c.t, err)
+	c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 4096)
+	n, err := c.conn.Read(buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	require.NoError(c.t, err)
+	resp := buf[:n]
+
+	// Response Authenticator = MD5(pacote com o autenticador do pedido + segredo).
+	check := append([]byte(nil), resp...)
+	copy(check[4:20], raw[4:20])
+	h := md5.New()
+	h.Write(check)
+	h.Write(c.secret)
+	require.Equal(c.t, h.Sum(nil), resp[4:20], "Response Authenticator")
+
+	p, err := parseRadius(resp)
+	require.NoError(c.t, err)
+	require.Equal(c.t, raw[1], p.id)
+	if mac, ok := p.attr(radiusMessageAuthenticator); ok {
+		copy(check[n-16:], make([]byte, 16))
+		m := hmac.New(md5.New, c.secret)
+		m.Write(check)
+		require.Equal(c.t, m.Sum(nil), mac, "Message-Authenticator da resposta")
+	}
+	return p
+}
+
+func TestRadiusOTPOnly(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	c, secret := newTestRadius(t, RadiusOtp{}, now)
+
+	resp := c.send(c.request("ana", "000000", nil, true))
+	require.Equal(t, byte(radiusAccessReject), resp.code)
+	msg, _ := resp.attr(radiusReplyMessage)
+	require.Equal(t, "Código inválido", string(msg))
+
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+	req := c.request("ana", code, nil, true)
+	resp = c.send(req)
+	require.Equal(t, byte(radiusAccessAccept), resp.code)
+
+	// Retransmissão recebe a mesma resposta; um pedido novo com o mesmo código é reuso.
+	require.Equal(t, byte(radiusAccessAccept), c.send(req).code)
+	require.Equal(t, byte(radiusAccessReject), c.send(c.request("ana", code, nil, true)).code)
+
+	require.Equal(t, byte(radiusAccessReject), c.send(c.request("bruno", code, nil, true)).code)
+}
+
+func TestRadiusConcat(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	password := func(user, password string) (bool, error) { return user == "ana" && password == "segredo", nil }
+	c, secret := newTestRadius(t, RadiusOtp{Mode: RadiusConcat, Password: password}, now)
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+
+	require.Equal(t, byte(radiusAccessReject), c.send(c.request("ana", "errada"+code, nil, true)).code)
+	require.Equal(t, byte(radiusAccessReject), c.send(c.request("ana", code, nil, true)).code, "Sem senha")
+	require.Equal(t, byte(radiusAccessAccept), c.send(c.request("ana", "segredo"+code, nil, true)).code)
+}
+
+func TestRadiusChallenge(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	password := func(user, password string) (bool, error) { return password == "segredo", nil }
+	c, secret := newTestRadius(t, RadiusOtp{Mode: RadiusChallenge, Password: password}, now)
+
+	require.Equal(t, byte(radiusAccessReject), c.send(c.request("ana", "errada", nil, true)).code)
+
+	resp := c.send(c.request("ana", "segredo", nil, true))
+	require.Equal(t, byte(radiusAccessChallenge), resp.code)
+	msg, _ := resp.attr(radiusReplyMessage)
+	require.Equal(t, "Digite o código OTP", string(msg))
+	state, ok := resp.attr(radiusState)
+	require.True(t, ok)
+
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+	require.Equal(t, byte(radiusAccessReject), c.send(c.request("bruno", code, state, true)).code, "State de outro usuário")
+	require.Equal(t, byte(radiusAccessReject), c.send(c.request("ana", code, []byte("forjado"), true)).code)
+	require.Equal(t, byte(radiusAccessAccept), c.send(c.request("ana", code, state, true)).code)
+
+	// O State vale uma única vez, mesmo ainda dentro da validade.
+	resp = c.send(c.request("ana", code, state, true))
+	require.Equal(t, byte(radiusAccessReject), resp.code)
+	msg, _ = resp.attr(radiusReplyMessage)
+	require.Equal(t, Localize(ErrRadiusInvalidState, DefaultLanguage), string(msg))
+}
+
+func TestRadiusMessageAuthenticator(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	c, secret := newTestRadius(t, RadiusOtp{}, now)
+	code, err := GenerateCodes(secret, now)
+	require.NoError(t, err)
+
+	require.Nil(t, c.send(c.request("ana", code, nil, false)), "Sem Message-Authenticator é descartado por padrão")
+
+	forged := c.request("ana", code, nil, true)
+	forged[len(forged)-1] ^= 1
+	require.Nil(t, c.send(forged), "Message-Authenticator errado é descartado")
+
+	other := &radiusClient{t: t, conn: c.conn, secret: []byte("outro"), id: 100}
+	require.Nil(t, other.send(other.request("ana", code, nil, true)), "Segredo errado")
+
+	require.Equal(t, byte(radiusAccessAccept), c.send(c.request("ana", code, nil, true)).code)
+
+	// Clientes antigos só com a opção explícita.
+	old, _ := newTestRadius(t, RadiusOtp{AllowNoMessageAuthenticator: true}, now)
+	require.Equal(t, byte(radiusAccessReject), old.send(old.request("ana", "000000", nil, false)).code)
+}
+
+func TestRadiusMaxConcurrent(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	var (
+		mu           sync.Mutex
+		active, peak int
+	)
+	password := func(user, password string) (bool, error) {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return false, nil
+	}
+	c, _ := newTestRadius(t, RadiusOtp{Mode: RadiusConcat, Password: password, MaxConcurrent: 2}, now)
+
+	for i := 0; i < 6; i++ {
+		_, err := c.conn.Write(c.request("ana", "errada123456", nil, true))
+		require.NoError(t, err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	for i := 0; i < 6; i++ {
+		_, err := c.conn.Read(buf)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, peak, "Pedidos simultâneos limitados por MaxConcurrent")
+}
+
+func TestRadiusPAP(t *testing.T) {
+	var auth [16]byte
+	rand.Read(auth[:])
+	for _, pw := range []string{"1", "123456", "uma senha com mais de dezesseis bytes"} {
+		c := encryptPAP([]byte("s"), auth, []byte(pw))
+		require.Zero(t, len(c)%16)
+		p, err := decryptPAP([]byte("s"), auth, c)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal([]byte(pw), p))
+	}
+	_, err := decryptPAP([]byte("s"), auth, []byte("curto"))
+	require.Equal(t, ErrRadiusMalformed, err)
+
+	_, err = parseRadius([]byte{1, 1, 0, 30, 0})
+	require.Equal(t, ErrRadiusMalformed, err)
+}
+
+// encryptPAP é o inverso de decryptPAP, usado por clientes.
+func encryptPAP(secret []byte, auth [16]byte, password []byte) []byte {
+	n := (len(password) + 15) / 16 * 16
+	if n == 0 {
+		n = 16
+	}
+	p := make([]byte, n)
+	copy(p, password)
+	out := make([]byte, n)
+	prev := auth[:]
+	for i := 0; i < n; i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			out[i+j] = p[i+j] ^ b[j]
+		}
+		prev = out[i : i+16]
+	}
+	return out
+}
+
+func TestRadiusStateSingleUse(t *testing.T) {
+	s := NewRadiusServer(nil, []byte("s"), RadiusOtp{})
+	now := time.Unix(1700000000, 0).UTC()
+	state, err := s.challengeState("Brisa:ana", now)
+	require.NoError(t, err)
+	require.False(t, s.consumeState(state, "Brisa:bia", now), "Outra conta")
+	require.True(t, s.consumeState(state, "Brisa:ana", now))
+	require.False(t, s.consumeState(state, "Brisa:ana", now), "Já usado")
+
+	// Nonces só são guardados enquanto o State poderia valer.
+	s.mu.Lock()
+	s.prune(now.Add(s.otp.ChallengeTTL))
+	require.Empty(t, s.used)
+	require.Empty(t, s.usedQueue)
+	s.mu.Unlock()
+	require.False(t, s.consumeState(state, "Brisa:ana", now.Add(s.otp.ChallengeTTL)), "Expirado")
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrRecoveryInvalidHash = newError("recovery.invalid_hash", KindInternal)
+
+// Alfabeto sem caracteres ambíguos (0/o, 1/l/i) para facilitar a digitação.
+const recoveryAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// Method identifica qual fator foi usado em uma validação.
+type Method string
+
+const (
+	MethodTOTP     Method = "totp"
+	MethodHOTP     Method = "hotp"
+	MethodRecovery Method = "recovery"
+)
+
+// RecoveryOtp fornece opções para os códigos de recuperação.
+type RecoveryOtp struct {
+	Count      uint // Quantidade de códigos. O padrão é 10.
+	Groups     uint // Grupos por código separados por "-". O padrão é 2.
+	GroupSize  uint // Caracteres por grupo. O padrão é 5.
+	Iterations uint // Iterações do PBKDF2. O padrão é 100000.
+	Throttle   ThrottleOtp
+	Rand       io.Reader
+}
+
+// RecoveryCodes guarda apenas os hashes dos códigos ainda não usados.
+type RecoveryCodes struct {
+	Hashes   []string
+	Throttle Throttle
+}
+
+func (o RecoveryOtp) defaults() RecoveryOtp {
+	if o.Count == 0 {
+		o.Count = 10
+	}
+	if o.Groups == 0 {
+		o.Groups = 2
+	}
+	if o.GroupSize == 0 {
+		o.GroupSize = 5
+	}
+	if o.Iterations == 0 {
+		o.Iterations = 100000
+	}
+	if o.Rand == nil {
+		o.Rand = rand.Reader
+	}
+	return o
+}
+
+// GenerateRecoveryCodes gera um novo conjunto de códigos de uso único.
+// Os códigos em texto são retornados apenas aqui para serem exibidos ao usuário.
+func GenerateRecoveryCodes(otp RecoveryOtp) (*RecoveryCodes, []string, error) {
+	rc := &RecoveryCodes{}
+	codes, err := rc.Regenerate(otp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, codes, nil
+}
+
+// Regenerate substitui todos os códigos, invalidando o conjunto anterior.
+func (rc *RecoveryCodes) Regenerate(otp RecoveryOtp) ([]string, error) {
+	otp = otp.defaults()
+
+	codes := make([]string, 0, otp.Count)
+	hashes := make([]string, 0, otp.Count)
+	for i := uint(0); i < otp.Count; i++ {
+		code, err := randomRecoveryCode(otp)
+		if err != nil {
+			return nil, err
+		}
+		h, err := hashRecoveryCode(code, otp)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, h)
+	}
+
+	rc.Hashes = hashes
+	rc.Throttle.Reset()
+	return codes, nil
+}
+
+// Remaining retorna quantos códigos ainda podem ser usados.
+func (rc *RecoveryCodes) Remaining() int {
+	return len(rc.Hashes)
+}
+
+// ValidateRecoveryCode verifica um código de recuperação e o consome em caso de sucesso.
+func ValidateRecoveryCode(code string, rc *RecoveryCodes, t time.Time, otp RecoveryOtp) (bool, error) {
+	if err := rc.Throttle.Allow(t); err != nil {
+		return false, err
+	}
+
+	code = normalizeRecoveryCode(code)
+	for i, h := range rc.Hashes {
+		ok, err := checkRecoveryHash(code, h)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			rc.Hashes = append(rc.Hashes[:i:i], rc.Hashes[i+1:]...)
+			rc.Throttle.Reset()
+			return true, nil
+		}
+	}
+
+	rc.Throttle.Fail(t, otp.Throttle)
+	return false, nil
+}
+
+// ValidateCustomsOrRecovery aceita um TOTP ou um código de recuperação no mesmo campo.
+// Retorna o método que validou a senha.
+func ValidateCustomsOrRecovery(passcode string, secret string, t time.Time, otp ValidateOtp, rc *RecoveryCodes, ropt RecoveryOtp) (Method, bool, error) {
+	passcode = strings.TrimSpace(passcode)
+
+	if rc == nil || looksLikePasscode(passcode, otp.Digits) {
+		ok, err := ValidateCustoms(passcode, secret, t, otp)
+		if !ok || err != nil {
+			return "", ok, err
+		}
+		return MethodTOTP, true, nil
+	}
+
+	ok, err := ValidateRecoveryCode(passcode, rc, t, ropt)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	return MethodRecovery, true, nil
+}
+
+func looksLikePasscode(passcode string, d Digits) bool {
+	if len(passcode) != d.Length() {
+		return false
+	}
+	for _, c := range passcode {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func randomRecoveryCode(otp RecoveryOtp) (string, error) {
+	buf := make([]byte, otp.Groups*otp.GroupSize)
+	if _, err := io.ReadFull(otp.Rand, buf); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for i, b := range buf {
+		if i > 0 && uint(i)%otp.GroupSize == 0 {
+			sb.WriteByte('-')
+		}
+		// 256 não é múltiplo de 31, o pequeno viés é aceitável para códigos de uso único.
+		sb.WriteByte(recoveryAlphabet[int(b)%len(recoveryAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+// normalizeRecoveryCode ignora espaços, hífens e maiúsculas digitados pelo usuário.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// O hash é guardado como pbkdf2-sha256$iterações$salt$hash.
+func hashRecoveryCode(code string, otp RecoveryOtp) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(otp.Rand, salt); err != nil {
+		return "", err
+	}
+	dk := pbkdf2SHA256([]byte(normalizeRecoveryCode(code)), salt, int(otp.Iterations), sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s",
+		otp.Iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(dk)), nil
+}
+
+func checkRecoveryHash(code string, encoded string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false, ErrRecoveryInvalidHash
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false, ErrRecoveryInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, ErrRecoveryInvalidHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, ErrRecoveryInvalidHash
+	}
+
+	got := pbkdf2SHA256([]byte(code), salt, iter, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// pbkdf2SHA256 implementa a RFC 8018 usando o mesmo HMAC de GenerateCodeCustom.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	dk := make([]byte, 0, blocks*hashLen)
+	buf := make([]byte, 4)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, uint32(block))
+		prf.Write(buf)
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// VerifyRecovery valida e consome um código de recuperação guardado na chave id.
+func (v *Verifier) VerifyRecovery(id string, code string, t time.Time, otp RecoveryOtp) error {
+	var ok bool
+	err := v.store.Update(id, func(rec *KeyRecord) error {
+		ok = false
+		if rec.State != KeyActive {
+			return ErrKeyNotActive
+		}
+		if rec.Recovery == nil {
+			return nil
+		}
+		var err error
+		ok, err = ValidateRecoveryCode(code, rec.Recovery, t, otp)
+		return err
+	})
+	if err == nil && !ok {
+		err = ErrValidateInvalidCode
+	}
+
+	e := AuditEntry{Time: t, Event: AuditRecovery, Account: id, Success: err == nil, Error: auditError(err)}
+	if err == nil {
+		e.Method = MethodRecovery
+	}
+	v.audit.Record(e)
+	return err
+}
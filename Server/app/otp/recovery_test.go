@@ -0,0 +1,97 @@
+package app
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testRecoveryOtp = RecoveryOtp{Count: 4, Iterations: 10}
+
+func TestPBKDF2Vector(t *testing.T) {
+	// RFC 7914, seção 11
+	dk := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	require.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"+
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783", hex.EncodeToString(dk))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	rc, codes, err := GenerateRecoveryCodes(testRecoveryOtp)
+	require.NoError(t, err, "Gerar códigos de recuperação")
+	require.Len(t, codes, 4)
+	require.Equal(t, 4, rc.Remaining())
+	for _, c := range codes {
+		require.Len(t, c, 11, "Dois grupos de cinco separados por hífen")
+		require.Equal(t, "-", c[5:6])
+		for _, h := range rc.Hashes {
+			require.NotContains(t, h, c, "O código não pode ser guardado em texto")
+		}
+	}
+
+	now := time.Now()
+	ok, err := ValidateRecoveryCode(strings.ToUpper(codes[1]), rc, now, testRecoveryOtp)
+	require.NoError(t, err)
+	require.True(t, ok, "Código válido ignorando maiúsculas")
+	require.Equal(t, 3, rc.Remaining())
+
+	ok, err = ValidateRecoveryCode(codes[1], rc, now, testRecoveryOtp)
+	require.NoError(t, err)
+	require.False(t, ok, "Código já usado não pode ser aceito novamente")
+
+	old := codes
+	codes, err = rc.Regenerate(testRecoveryOtp)
+	require.NoError(t, err)
+	require.Equal(t, 4, rc.Remaining())
+	ok, err = ValidateRecoveryCode(old[0], rc, now, testRecoveryOtp)
+	require.NoError(t, err)
+	require.False(t, ok, "Códigos antigos devem ser invalidados")
+
+	ok, err = ValidateRecoveryCode(strings.ReplaceAll(codes[0], "-", " "), rc, now, testRecoveryOtp)
+	require.NoError(t, err)
+	require.True(t, ok, "Separadores são ignorados")
+}
+
+func TestRecoveryThrottle(t *testing.T) {
+	opts := testRecoveryOtp
+	opts.Throttle = ThrottleOtp{MaxFailures: 2, Lockout: time.Minute}
+	rc, codes, err := GenerateRecoveryCodes(opts)
+	require.NoError(t, err)
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		ok, err := ValidateRecoveryCode("aaaaa-aaaaa", rc, now, opts)
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+
+	_, err = ValidateRecoveryCode(codes[0], rc, now, opts)
+	require.Equal(t, ErrValidateThrottled, err, "Bloqueado após falhas seguidas")
+
+	ok, err := ValidateRecoveryCode(codes[0], rc, now.Add(2*time.Minute), opts)
+	require.NoError(t, err)
+	require.True(t, ok, "Liberado após o bloqueio")
+}
+
+func TestValidateCustomsOrRecovery(t *testing.T) {
+	rc, codes, err := GenerateRecoveryCodes(testRecoveryOtp)
+	require.NoError(t, err)
+
+	opts := ValidateOtp{Period: 30, Skew: 1, Digits: DigitsSix, Algorithm: AlgorithmSHA1}
+	now := time.Now().UTC()
+	code, err := GenerateCodeCustoms(secSha1, now, opts)
+	require.NoError(t, err)
+
+	m, ok, err := ValidateCustomsOrRecovery(code, secSha1, now, opts, rc, testRecoveryOtp)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, MethodTOTP, m)
+
+	m, ok, err = ValidateCustomsOrRecovery(codes[2], secSha1, now, opts, rc, testRecoveryOtp)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, MethodRecovery, m)
+	require.Equal(t, 3, rc.Remaining())
+}
@@ -0,0 +1,268 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRedisProtocol = newError("redis.protocol", KindInternal)
+
+// SharedState guarda o estado que precisa ser comum a várias instâncias de
+// validação atrás de um balanceador: os passos TOTP já usados e as falhas.
+type SharedState interface {
+	// MarkUsed registra o passo como usado e retorna false se ele já estava.
+	MarkUsed(id string, step int64, ttl time.Duration) (bool, error)
+	// Failures retorna as falhas da conta dentro da janela atual.
+	Failures(id string) (uint, error)
+	// Fail soma uma falha, renova a janela e retorna o total. O Verifier a
+	// chama antes de validar o código e zera o total com Reset se ele conferir.
+	Fail(id string, window time.Duration) (uint, error)
+	Reset(id string) error
+}
+
+// RedisState é um SharedState em um servidor compatível com o protocolo Redis.
+// As operações usam SET NX e MULTI/EXEC para serem atômicas entre instâncias.
+type RedisState struct {
+	Addr     string
+	Password string
+	Prefix   string // Prefixo das chaves. O padrão é "otp:".
+	Timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func NewRedisState(addr string) *RedisState {
+	return &RedisState{Addr: addr, Prefix: "otp:", Timeout: 5 * time.Second}
+}
+
+func (r *RedisState) MarkUsed(id string, step int64, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+	v, err := r.do("SET", r.Prefix+"used:"+id+":"+strconv.FormatInt(step, 10), "1", "NX", "PX", ms)
+	if err != nil {
+		return false, err
+	}
+	// SET NX retorna nil quando a chave já existia.
+	return v != nil, nil
+}
+
+func (r *RedisState) Failures(id string) (uint, error) {
+	v, err := r.do("GET", r.Prefix+"fail:"+id)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, ErrRedisProtocol
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, ErrRedisProtocol
+	}
+	return uint(n), nil
+}
+
+func (r *RedisState) Fail(id string, window time.Duration) (uint, error) {
+	key := r.Prefix + "fail:" + id
+	v, err := r.multi(
+		[]string{"INCR", key},
+		[]string{"PEXPIRE", key, strconv.FormatInt(window.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v[0].(int64)
+	if !ok {
+		return 0, ErrRedisProtocol
+	}
+	return uint(n), nil
+}
+
+func (r *RedisState) Reset(id string) error {
+	_, err := r.do("DEL", r.Prefix+"fail:"+id)
+	return err
+}
+
+// Close fecha a conexão com o servidor.
+func (r *RedisState) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// RedisError é uma resposta de erro enviada pelo servidor.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (r *RedisState) do(args ...string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	if err := r.send(args); err != nil {
+		return nil, r.drop(err)
+	}
+	v, err := r.read()
+	if _, ok := err.(RedisError); err != nil && !ok {
+		return nil, r.drop(err)
+	}
+	return v, err
+}
+
+// multi executa os comandos em uma transação MULTI/EXEC e retorna as respostas.
+func (r *RedisState) multi(cmds ...[]string) ([]interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+
+	all := append([][]string{{"MULTI"}}, cmds...)
+	all = append(all, []string{"EXEC"})
+	for _, c := range all {
+		if err := r.send(c); err != nil {
+			return nil, r.drop(err)
+		}
+	}
+
+	var (
+		v   interface{}
+		err error
+	)
+	// Respostas de MULTI e de cada comando enfileirado ("+QUEUED").
+	for i := 0; i < len(all); i++ {
+		v, err = r.read()
+		if _, ok := err.(RedisError); err != nil && !ok {
+			return nil, r.drop(err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, ok := v.([]interface{})
+	if !ok || len(res) != len(cmds) {
+		return nil, ErrRedisProtocol
+	}
+	return res, nil
+}
+
+func (r *RedisState) connect() error {
+	if r.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", r.Addr, r.Timeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.rd = bufio.NewReader(conn)
+	if r.Password == "" {
+		return nil
+	}
+	if err := r.send([]string{"AUTH", r.Password}); err != nil {
+		return r.drop(err)
+	}
+	if _, err := r.read(); err != nil {
+		return r.drop(err)
+	}
+	return nil
+}
+
+// drop descarta a conexão após um erro de rede, a próxima operação reconecta.
+func (r *RedisState) drop(err error) error {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return err
+}
+
+func (r *RedisState) send(args []string) error {
+	if r.Timeout > 0 {
+		r.conn.SetDeadline(time.Now().Add(r.Timeout))
+	}
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"+a+"\r\n"...)
+	}
+	_, err := r.conn.Write(buf)
+	return err
+}
+
+// read lê uma resposta RESP: string simples, erro, inteiro, bulk ou array.
+func (r *RedisState) read() (interface{}, error) {
+	return readRESP(r.rd)
+}
+
+func readRESP(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrRedisProtocol
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, ErrRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			v, err := readRESP(rd)
+			if _, ok := err.(RedisError); err != nil && !ok {
+				return nil, err
+			}
+			out[i] = v
+			if err != nil {
+				out[i] = err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrRedisProtocol, line[0])
+}
@@ -0,0 +1,300 @@
+package app
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis é um servidor em processo que entende o subconjunto do protocolo
+// Redis usado por RedisState: SET NX PX, GET, INCR, PEXPIRE, DEL, AUTH e MULTI/EXEC.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	data    map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{ln: ln, data: map[string]string{}, expires: map[string]time.Time{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	f.mu.Lock()
+	password := f.password
+	f.mu.Unlock()
+	authed := password == ""
+	var queue [][]string
+	inMulti := false
+
+	for {
+		v, err := readRESP(rd)
+		if err != nil {
+			return
+		}
+		items, _ := v.([]interface{})
+		args := make([]string, len(items))
+		for i, it := range items {
+			args[i], _ = it.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+
+		switch {
+		case cmd == "AUTH":
+			if args[1] != password {
+				c.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+			authed = true
+			c.Write([]byte("+OK\r\n"))
+		case !authed:
+			c.Write([]byte("-NOAUTH Authentication required.\r\n"))
+		case cmd == "MULTI":
+			inMulti = true
+			queue = nil
+			c.Write([]byte("+OK\r\n"))
+		case cmd == "EXEC":
+			f.mu.Lock()
+			out := "*" + strconv.Itoa(len(queue)) + "\r\n"
+			for _, q := range queue {
+				out += f.exec(q)
+			}
+			f.mu.Unlock()
+			inMulti = false
+			c.Write([]byte(out))
+		case inMulti:
+			queue = append(queue, args)
+			c.Write([]byte("+QUEUED\r\n"))
+		default:
+			f.mu.Lock()
+			out := f.exec(args)
+			f.mu.Unlock()
+			c.Write([]byte(out))
+		}
+	}
+}
+
+func (f *fakeRedis) get(k string) (string, bool) {
+	if exp, ok := f.expires[k]; ok && time.Now().After(exp) {
+		delete(f.data, k)
+		delete(f.expires, k)
+	}
+	v, ok := f.data[k]
+	return v, ok
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		k := args[1]
+		nx := false
+		var px time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				px = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, ok := f.get(k); ok && nx {
+			return "$-1\r\n"
+		}
+		f.data[k] = args[2]
+		delete(f.expires, k)
+		if px > 0 {
+			f.expires[k] = time.Now().Add(px)
+		}
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+	case "INCR":
+		v, _ := f.get(args[1])
+		n, _ := strconv.Atoi(v)
+		n++
+		f.data[args[1]] = strconv.Itoa(n)
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "PEXPIRE":
+		if _, ok := f.get(args[1]); !ok {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := f.get(k); ok {
+				delete(f.data, k)
+				delete(f.expires, k)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisState(t *testing.T) {
+	f := newFakeRedis(t)
+	f.mu.Lock()
+	f.password = "segredo"
+	f.mu.Unlock()
+	r := NewRedisState(f.ln.Addr().String())
+	r.Password = "segredo"
+	defer r.Close()
+
+	fresh, err := r.MarkUsed("Brisa:a@b.com", 100, time.Minute)
+	require.NoError(t, err)
+	require.True(t, fresh, "Primeiro uso do passo")
+	fresh, err = r.MarkUsed("Brisa:a@b.com", 100, time.Minute)
+	require.NoError(t, err)
+	require.False(t, fresh, "Passo já usado")
+
+	fresh, err = r.MarkUsed("Brisa:a@b.com", 101, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, fresh)
+	time.Sleep(20 * time.Millisecond)
+	fresh, err = r.MarkUsed("Brisa:a@b.com", 101, time.Minute)
+	require.NoError(t, err)
+	require.True(t, fresh, "Passo expirado pode ser marcado de novo")
+
+	n, err := r.Failures("Brisa:a@b.com")
+	require.NoError(t, err)
+	require.Zero(t, n)
+	for i := uint(1); i <= 3; i++ {
+		n, err = r.Fail("Brisa:a@b.com", time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, i, n)
+	}
+	n, err = r.Failures("Brisa:a@b.com")
+	require.NoError(t, err)
+	require.Equal(t, uint(3), n)
+
+	require.NoError(t, r.Reset("Brisa:a@b.com"))
+	n, err = r.Failures("Brisa:a@b.com")
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	bad := NewRedisState(f.ln.Addr().String())
+	bad.Password = "errada"
+	_, err = bad.Failures("x")
+	require.IsType(t, RedisError(""), err, "Senha errada é repassada como erro")
+}
+
+func TestVerifierSharedState(t *testing.T) {
+	f := newFakeRedis(t)
+	url := `otpauth://totp/Brisa:a@b.com?secret=JBSWY3DPEHPK3PXP&issuer=Brisa`
+	opts := VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 3}}
+
+	// Duas instâncias com cópias locais da chave e o mesmo Redis.
+	var vs []*Verifier
+	var id string
+	for i := 0; i < 2; i++ {
+		s := NewMemoryStore()
+		id = newActiveRecord(t, s, url)
+		v := NewVerifier(s, opts)
+		v.UseShared(NewRedisState(f.ln.Addr().String()))
+		vs = append(vs, v)
+	}
+
+	now := time.Now()
+	code, err := GenerateCodes("JBSWY3DPEHPK3PXP", now)
+	require.NoError(t, err)
+	_, err = vs[0].Verify(id, code, now)
+	require.NoError(t, err)
+	_, err = vs[1].Verify(id, code, now)
+	require.Equal(t, ErrValidateReplayed, err, "Código usado em outra instância")
+
+	// O reuso acima já contou como a primeira falha.
+	_, err = vs[0].Verify(id, "000000", now)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = vs[1].Verify(id, "000000", now)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = vs[0].Verify(id, "000000", now)
+	require.Equal(t, ErrValidateThrottled, err, "Falhas somadas entre as instâncias")
+}
+
+// retryStore executa fn uma vez a mais sobre uma cópia descartada, como o
+// SQLStore faz após um conflito.
+type retryStore struct {
+	KeyStore
+}
+
+func (s retryStore) Update(id string, fn func(rec *KeyRecord) error) error {
+	rec, err := s.KeyStore.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := fn(rec.clone()); err != nil {
+		return err
+	}
+	return s.KeyStore.Update(id, fn)
+}
+
+func TestVerifierSharedStateRetry(t *testing.T) {
+	f := newFakeRedis(t)
+	s := NewMemoryStore()
+	id := newActiveRecord(t, s, `otpauth://totp/Brisa:a@b.com?secret=JBSWY3DPEHPK3PXP&issuer=Brisa`)
+	v := NewVerifier(retryStore{s}, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 3}})
+	v.UseShared(NewRedisState(f.ln.Addr().String()))
+
+	now := time.Now()
+	code, err := GenerateCodes("JBSWY3DPEHPK3PXP", now)
+	require.NoError(t, err)
+	_, err = v.Verify(id, code, now)
+	require.NoError(t, err, "Repetir fn não marca o passo como usado")
+
+	// Tentativas concorrentes não passam do limite compartilhado.
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		invalid int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.Verify(id, "000000", now)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == ErrValidateInvalidCode {
+				invalid++
+			}
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, invalid, 3)
+}
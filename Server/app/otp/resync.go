@@ -0,0 +1,90 @@
+package app
+
+import (
+	"time"
+)
+
+var ErrResyncNotHOTP = newError("resync.not_hotp", KindFailedPrecondition)
+var ErrResyncInvalidWindow = newError("resync.invalid_window", KindInvalidArgument)
+
+// maxResyncWindow limita a busca de Resync, que calcula até dois HMACs por
+// contador com o registro travado no store.
+const maxResyncWindow = 1000
+
+// Resync reposiciona o contador da chave HOTP id quando o aplicativo avançou
+// além do LookAhead. first e second devem ser dois códigos seguidos; eles são
+// procurados nos window contadores seguintes ao esperado (100 se window for 0,
+// no máximo 1000). Retorna o próximo contador esperado. Falhas contam para o bloqueio.
+func (v *Verifier) Resync(id string, first, second string, window uint, t time.Time) (uint64, error) {
+	counter, locked, err := v.resync(id, first, second, window, t)
+	v.audit.recordResult(AuditResync, id, t, err)
+	if locked {
+		v.audit.Record(AuditEntry{Time: t, Event: AuditLockout, Account: id, Success: true})
+	}
+	return counter, err
+}
+
+func (v *Verifier) resync(id string, first, second string, window uint, t time.Time) (uint64, bool, error) {
+	if window == 0 {
+		window = 100
+	}
+	if window > maxResyncWindow {
+		return 0, false, ErrResyncInvalidWindow
+	}
+
+	var (
+		counter uint64
+		found   bool
+		locked  bool
+	)
+	err := v.store.Update(id, func(rec *KeyRecord) error {
+		counter, found, locked = 0, false, false
+		if rec.State != KeyActive {
+			return ErrKeyNotActive
+		}
+		if err := rec.Throttle.Allow(t); err != nil {
+			return err
+		}
+		key, err := rec.Key()
+		if err != nil {
+			return err
+		}
+		if key.Type() != "hotp" {
+			return ErrResyncNotHOTP
+		}
+
+		opts := ValidateOtps{Digits: key.Digits(), Algorithm: key.Algorithm()}
+		for i := uint64(0); i <= uint64(window); i++ {
+			c := rec.Counter + i
+			ok, err := ValidateCustom(first, c, key.Secret(), opts)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if ok, err = ValidateCustom(second, c+1, key.Secret(), opts); err != nil {
+				return err
+			}
+			if ok {
+				found = true
+				rec.Counter = c + 2
+				rec.LastUsedAt = t
+				rec.Throttle.Reset()
+				counter = rec.Counter
+				return nil
+			}
+		}
+
+		// A falha precisa ser gravada, por isso fn não retorna o erro.
+		locked = rec.Throttle.Fail(t, v.otp.Throttle)
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if !found {
+		return 0, locked, ErrValidateInvalidCode
+	}
+	return counter, false, nil
+}
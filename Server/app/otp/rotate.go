@@ -0,0 +1,104 @@
+package app
+
+import (
+	"time"
+)
+
+// SecretSlot indica qual segredo de um registro validou o código.
+type SecretSlot string
+
+const (
+	SecretCurrent SecretSlot = "current"
+	SecretNext    SecretSlot = "next" // segredo novo de uma rotação em andamento
+)
+
+// Rotate gera um novo segredo para a chave ativa id, mantendo emissor, conta,
+// dígitos, algoritmo e período. Até t+grace os códigos dos dois segredos são
+// aceitos; o novo é promovido no primeiro uso ou quando o prazo acabar.
+func (v *Verifier) Rotate(id string, grace time.Duration, t time.Time) (*Key, error) {
+	next, err := v.rotate(id, grace, t)
+	v.audit.recordResult(AuditRotate, id, t, err)
+	return next, err
+}
+
+func (v *Verifier) rotate(id string, grace time.Duration, t time.Time) (*Key, error) {
+	var next *Key
+	err := v.store.Update(id, func(rec *KeyRecord) error {
+		if rec.State != KeyActive {
+			return ErrKeyNotActive
+		}
+		k, err := rec.Key()
+		if err != nil {
+			return err
+		}
+		next, err = rotatedKey(k)
+		if err != nil {
+			return err
+		}
+
+		rec.NextURL = next.String()
+		rec.NextCounter = 0
+		rec.GraceUntil = t.Add(grace)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// rotatedKey gera uma chave igual a k, mas com um segredo aleatório novo do mesmo tamanho.
+func rotatedKey(k *Key) (*Key, error) {
+	size := uint(len(k.Secret()) * 5 / 8)
+
+	switch k.Type() {
+	case "totp":
+		return Generates(GeneratesOtp{
+			Issuer:      k.Issuer(),
+			AccountName: k.AccountName(),
+			Period:      uint(k.Period()),
+			SecretSize:  size,
+			Digits:      k.Digits(),
+			Algorithm:   k.Algorithm(),
+		})
+	case "hotp":
+		return Generate(GenerateOtp{
+			Issuer:      k.Issuer(),
+			AccountName: k.AccountName(),
+			SecretSize:  size,
+			Digits:      k.Digits(),
+			Algorithm:   k.Algorithm(),
+		})
+	}
+	return nil, ErrKeyUnknownType
+}
+
+// promote troca o segredo atual pelo segredo novo da rotação.
+func (r *KeyRecord) promote() {
+	r.URL = r.NextURL
+	r.Counter = r.NextCounter
+	r.NextURL = ""
+	r.NextCounter = 0
+	r.GraceUntil = time.Time{}
+}
+
+func validateNext(passcode string, rec *KeyRecord, t time.Time, otp VerifyOtp) (Match, bool, error) {
+	key, err := NewKeyFromURL(rec.NextURL)
+	if err != nil {
+		return Match{}, false, err
+	}
+
+	shadow := *rec
+	shadow.Counter = rec.NextCounter
+	m, ok, err := validateKey(passcode, key, &shadow, t, otp)
+	if !ok || err != nil {
+		return m, ok, err
+	}
+
+	rec.LastStep = shadow.LastStep
+	rec.LastUsedAt = shadow.LastUsedAt
+	rec.NextCounter = shadow.Counter
+	rec.promote()
+	m.Secret = SecretNext
+	return m, true, nil
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newActiveRecord(t *testing.T, s KeyStore, url string) string {
+	k, err := NewKeyFromURL(url)
+	require.NoError(t, err)
+	id := KeyID(k.Issuer(), k.AccountName())
+	require.NoError(t, s.Put(&KeyRecord{ID: id, URL: url, State: KeyActive}))
+	return id
+}
+
+func TestRotateTOTP(t *testing.T) {
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{Skew: 1})
+	id := newActiveRecord(t, s, `otpauth://totp/Brisa:matiasdias@gmail.com?secret=JBSWY3DPEHPK3PXP&issuer=Brisa&digits=8&algorithm=SHA256`)
+	now := time.Unix(1700000000, 0).UTC()
+
+	next, err := v.Rotate(id, time.Hour, now)
+	require.NoError(t, err, "Iniciar rotação")
+	require.NotEqual(t, "JBSWY3DPEHPK3PXP", next.Secret())
+	require.Equal(t, DigitsEight, next.Digits(), "Parâmetros da chave são mantidos")
+	require.Equal(t, AlgorithmSHA256, next.Algorithm())
+	require.Len(t, next.Secret(), 16)
+
+	opts := ValidateOtp{Period: 30, Digits: DigitsEight, Algorithm: AlgorithmSHA256}
+	code, err := GenerateCodeCustoms("JBSWY3DPEHPK3PXP", now, opts)
+	require.NoError(t, err)
+	m, err := v.Verify(id, code, now)
+	require.NoError(t, err, "Segredo antigo aceito durante a carência")
+	require.Equal(t, SecretCurrent, m.Secret)
+
+	now = now.Add(30 * time.Second)
+	code, err = GenerateCodeCustoms(next.Secret(), now, opts)
+	require.NoError(t, err)
+	m, err = v.Verify(id, code, now)
+	require.NoError(t, err, "Segredo novo aceito")
+	require.Equal(t, SecretNext, m.Secret)
+
+	rec, err := s.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, next.String(), rec.URL, "Segredo novo promovido após o uso")
+	require.Empty(t, rec.NextURL)
+
+	now = now.Add(30 * time.Second)
+	code, err = GenerateCodeCustoms("JBSWY3DPEHPK3PXP", now, opts)
+	require.NoError(t, err)
+	_, err = v.Verify(id, code, now)
+	require.Equal(t, ErrValidateInvalidCode, err, "Segredo antigo não vale mais")
+}
+
+func TestRotateGraceExpired(t *testing.T) {
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{})
+	id := newActiveRecord(t, s, `otpauth://hotp/Zenir:flavia@gmail.com?secret=JBSWY3DPEHPK3PXP&issuer=Zenir`)
+	now := time.Now()
+
+	next, err := v.Rotate(id, time.Minute, now)
+	require.NoError(t, err)
+	require.Equal(t, "hotp", next.Type())
+
+	code, err := GenerateCode("JBSWY3DPEHPK3PXP", 0)
+	require.NoError(t, err)
+	_, err = v.Verify(id, code, now.Add(2*time.Minute))
+	require.Equal(t, ErrValidateInvalidCode, err, "Segredo antigo expirado após a carência")
+
+	code, err = GenerateCode(next.Secret(), 0)
+	require.NoError(t, err)
+	m, err := v.Verify(id, code, now.Add(3*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, SecretCurrent, m.Secret, "Segredo novo já foi promovido")
+}
+
+func TestVerifierReplayAndThrottle(t *testing.T) {
+	s := NewMemoryStore()
+	v := NewVerifier(s, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 2, Lockout: time.Minute}})
+	id := newActiveRecord(t, s, `otpauth://totp/Brisa:a@b.com?secret=JBSWY3DPEHPK3PXP&issuer=Brisa`)
+	now := time.Unix(1700000000, 0).UTC()
+
+	code, err := GenerateCodes("JBSWY3DPEHPK3PXP", now)
+	require.NoError(t, err)
+	m, err := v.Verify(id, code, now)
+	require.NoError(t, err)
+	require.Equal(t, MethodTOTP, m.Method)
+
+	_, err = v.Verify(id, code, now)
+	require.Equal(t, ErrValidateReplayed, err, "Código não pode ser reutilizado")
+	_, err = v.Verify(id, "123456", now)
+	require.Equal(t, ErrValidateInvalidCode, err)
+	_, err = v.Verify(id, "123456", now)
+	require.Equal(t, ErrValidateThrottled, err, "Conta bloqueada após falhas seguidas")
+}
@@ -0,0 +1,391 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+var ErrSMPPProtocol = newError("smpp.protocol", KindInternal)
+var ErrSMSTooLong = newError("sms.too_long", KindInvalidArgument)
+
+// Comandos SMPP 3.4 usados.
+const (
+	smppGenericNack     = 0x80000000
+	smppBindTransceiver = 0x00000009
+	smppSubmitSM        = 0x00000004
+	smppDeliverSM       = 0x00000005
+	smppUnbind          = 0x00000006
+	smppEnquireLink     = 0x00000015
+	smppResp            = 0x80000000
+	smppInvalidCommand  = 0x00000003 // ESME_RINVCMDID
+
+	smppMaxPDU = 64 << 10
+)
+
+type smppPDU struct {
+	command uint32
+	status  uint32
+	seq     uint32
+	body    []byte
+}
+
+func (p smppPDU) encode() []byte {
+	b := make([]byte, 16, 16+len(p.body))
+	binary.BigEndian.PutUint32(b[0:], uint32(16+len(p.body)))
+	binary.BigEndian.PutUint32(b[4:], p.command)
+	binary.BigEndian.PutUint32(b[8:], p.status)
+	binary.BigEndian.PutUint32(b[12:], p.seq)
+	return append(b, p.body...)
+}
+
+func readSMPP(r io.Reader) (smppPDU, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return smppPDU{}, err
+	}
+	n := binary.BigEndian.Uint32(head)
+	if n < 16 || n > smppMaxPDU {
+		return smppPDU{}, ErrSMPPProtocol
+	}
+	p := smppPDU{
+		command: binary.BigEndian.Uint32(head[4:]),
+		status:  binary.BigEndian.Uint32(head[8:]),
+		seq:     binary.BigEndian.Uint32(head[12:]),
+		body:    make([]byte, n-16),
+	}
+	_, err := io.ReadFull(r, p.body)
+	return p, err
+}
+
+// smppReader lê os campos de um corpo de PDU.
+type smppReader struct {
+	b   []byte
+	err error
+}
+
+func (r *smppReader) cstring() string {
+	i := bytes.IndexByte(r.b, 0)
+	if r.err != nil || i < 0 {
+		r.err = ErrSMPPProtocol
+		return ""
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+func (r *smppReader) octets(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = ErrSMPPProtocol
+		return nil
+	}
+	s := r.b[:n]
+	r.b = r.b[n:]
+	return s
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// SMPPClient é um SMSProvider que fala SMPP 3.4 com um SMSC. A conexão
+// (bind_transceiver) é aberta no primeiro envio e mantida para receber as
+// confirmações de entrega (deliver_sm); se cair, o próximo envio reconecta.
+type SMPPClient struct {
+	Addr       string
+	SystemID   string
+	Password   string
+	SystemType string
+	Source     string        // remetente: número ou nome alfanumérico
+	Timeout    time.Duration // Espera por cada resposta. O padrão é 10 segundos.
+
+	dial    sync.Mutex // serializa conexão e bind
+	mu      sync.Mutex
+	conn    net.Conn
+	seq     uint32
+	pending map[uint32]chan smppPDU
+	report  SMSReport
+}
+
+func (c *SMPPClient) OnReport(r SMSReport) {
+	c.mu.Lock()
+	c.report = r
+	c.mu.Unlock()
+}
+
+func (c *SMPPClient) SendSMS(ctx context.Context, to, body string) (string, error) {
+	coding, msg := smppEncode(body)
+	if len(msg) > 140 {
+		return "", ErrSMSTooLong
+	}
+	if err := c.connect(ctx); err != nil {
+		return "", err
+	}
+
+	srcTON, srcNPI := byte(1), byte(1) // internacional, E.164
+	if strings.Trim(c.Source, "+0123456789") != "" {
+		srcTON, srcNPI = 5, 0 // alfanumérico
+	}
+	var b bytes.Buffer
+	b.Write(cstring(c.SystemType))
+	b.Write([]byte{srcTON, srcNPI})
+	b.Write(cstring(strings.TrimPrefix(c.Source, "+")))
+	b.Write([]byte{1, 1})
+	b.Write(cstring(strings.TrimPrefix(to, "+")))
+	b.Write([]byte{0, 0, 0}) // esm_class, protocol_id, priority_flag
+	b.Write(cstring(""))     // schedule_delivery_time
+	b.Write(cstring(""))     // validity_period
+	b.Write([]byte{1, 0, coding, 0, byte(len(msg))})
+	b.Write(msg)
+
+	resp, err := c.request(ctx, smppSubmitSM, b.Bytes())
+	if err != nil {
+		return "", err
+	}
+	if resp.status != 0 {
+		return "", ErrSMSRejected
+	}
+	r := &smppReader{b: resp.body}
+	id := r.cstring()
+	if r.err != nil || id == "" {
+		return "", ErrSMPPProtocol
+	}
+	return id, nil
+}
+
+// smppEncode usa o alfabeto padrão para ASCII e UCS-2 para o resto (acentos).
+func smppEncode(s string) (byte, []byte) {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return 0, []byte(s)
+	}
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u>>8), byte(u))
+	}
+	return 8, b
+}
+
+func (c *SMPPClient) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
+
+func (c *SMPPClient) connect(ctx context.Context) error {
+	c.dial.Lock()
+	defer c.dial.Unlock()
+	c.mu.Lock()
+	if c.conn != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.conn = conn
+	c.pending = map[uint32]chan smppPDU{}
+	c.mu.Unlock()
+	go c.read(conn)
+
+	var b bytes.Buffer
+	b.Write(cstring(c.SystemID))
+	b.Write(cstring(c.Password))
+	b.Write(cstring(c.SystemType))
+	b.Write([]byte{0x34, 0, 0}) // interface_version, addr_ton, addr_npi
+	b.Write(cstring(""))        // address_range
+	resp, err := c.request(ctx, smppBindTransceiver, b.Bytes())
+	if err == nil && resp.status != 0 {
+		err = ErrSMSRejected
+	}
+	if err != nil {
+		c.drop(conn)
+	}
+	return err
+}
+
+// request envia um PDU e espera a resposta de mesmo sequence_number.
+func (c *SMPPClient) request(ctx context.Context, command uint32, body []byte) (smppPDU, error) {
+	c.mu.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mu.Unlock()
+		return smppPDU{}, ErrSMPPProtocol
+	}
+	c.seq++
+	seq := c.seq
+	ch := make(chan smppPDU, 1)
+	c.pending[seq] = ch
+	_, err := conn.Write(smppPDU{command: command, seq: seq, body: body}.encode())
+	c.mu.Unlock()
+	if err != nil {
+		c.drop(conn)
+		return smppPDU{}, err
+	}
+
+	timer := time.NewTimer(c.timeout())
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return smppPDU{}, ErrSMPPProtocol
+		}
+		if resp.command == smppGenericNack {
+			return smppPDU{}, ErrSMPPProtocol
+		}
+		return resp, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	delete(c.pending, seq)
+	c.mu.Unlock()
+	if ctx.Err() != nil {
+		return smppPDU{}, ctx.Err()
+	}
+	return smppPDU{}, ErrSMPPProtocol
+}
+
+// read entrega as respostas aos pedidos pendentes e responde aos pedidos do SMSC.
+func (c *SMPPClient) read(conn net.Conn) {
+	defer c.drop(conn)
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readSMPP(r)
+		if err != nil {
+			return
+		}
+		if p.command&smppResp != 0 {
+			c.mu.Lock()
+			ch, ok := c.pending[p.seq]
+			delete(c.pending, p.seq)
+			c.mu.Unlock()
+			if ok {
+				ch <- p
+			}
+			continue
+		}
+
+		switch p.command {
+		case smppDeliverSM:
+			c.deliver(p.body)
+			c.write(conn, smppPDU{command: p.command | smppResp, seq: p.seq, body: cstring("")})
+		case smppEnquireLink:
+			c.write(conn, smppPDU{command: p.command | smppResp, seq: p.seq})
+		case smppUnbind:
+			c.write(conn, smppPDU{command: p.command | smppResp, seq: p.seq})
+			return
+		default:
+			c.write(conn, smppPDU{command: smppGenericNack, status: smppInvalidCommand, seq: p.seq})
+		}
+	}
+}
+
+func (c *SMPPClient) write(conn net.Conn, p smppPDU) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn.Write(p.encode())
+}
+
+// deliver trata um deliver_sm; só confirmações de entrega (esm_class 0x04) interessam.
+func (c *SMPPClient) deliver(body []byte) {
+	r := &smppReader{b: body}
+	r.cstring() // service_type
+	r.octets(2) // source_addr_ton, source_addr_npi
+	r.cstring() // source_addr
+	r.octets(2) // dest_addr_ton, dest_addr_npi
+	r.cstring() // destination_addr
+	esm := r.octets(1)
+	r.octets(2) // protocol_id, priority_flag
+	r.cstring() // schedule_delivery_time
+	r.cstring() // validity_period
+	r.octets(4) // registered_delivery, replace_if_present_flag, data_coding, sm_default_msg_id
+	n := r.octets(1)
+	if r.err != nil {
+		return
+	}
+	text := r.octets(int(n[0]))
+	if r.err != nil || esm[0]&0x04 == 0 {
+		return
+	}
+
+	// Formato do apêndice B: "id:... sub:... dlvrd:... stat:DELIVRD err:000 text:..."
+	var id, stat, errCode string
+	for _, f := range strings.Fields(string(text)) {
+		k, v, _ := strings.Cut(f, ":")
+		switch strings.ToLower(k) {
+		case "id":
+			id = v
+		case "stat":
+			stat = v
+		case "err":
+			errCode = v
+		}
+	}
+	status := SMSFailed
+	switch stat {
+	case "DELIVRD":
+		status = SMSDelivered
+	case "ENROUTE", "ACCEPTD":
+		status = SMSSent
+	}
+	detail := stat
+	if errCode != "" && errCode != "000" {
+		detail += " err:" + errCode
+	}
+
+	c.mu.Lock()
+	report := c.report
+	c.mu.Unlock()
+	if id != "" && report != nil {
+		report(id, status, detail)
+	}
+}
+
+// drop fecha conn e falha os pedidos pendentes.
+func (c *SMPPClient) drop(conn net.Conn) {
+	conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return
+	}
+	for seq, ch := range c.pending {
+		close(ch)
+		delete(c.pending, seq)
+	}
+	c.conn = nil
+}
+
+// Close envia unbind e encerra a conexão.
+func (c *SMPPClient) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	c.request(ctx, smppUnbind, nil)
+	c.drop(conn)
+	return nil
+}
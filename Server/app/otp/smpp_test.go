@@ -0,0 +1,160 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/require"
+)
+
+// smscStub é um SMSC falso: aceita o bind de "brisa"/"senha", responde cada
+// submit_sm com um message_id e logo envia a confirmação de entrega.
+type smscStub struct {
+	addr     string
+	messages chan smscMessage
+}
+
+type smscMessage struct {
+	source, dest string
+	coding       byte
+	text         string
+}
+
+func newSMSCStub(t *testing.T) *smscStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	s := &smscStub{addr: l.Addr().String(), messages: make(chan smscMessage, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *smscStub) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	var seq uint32 = 1000
+	n := 0
+	for {
+		p, err := readSMPP(r)
+		if err != nil {
+			return
+		}
+		switch p.command {
+		case smppBindTransceiver:
+			f := &smppReader{b: p.body}
+			system, password := f.cstring(), f.cstring()
+			resp := smppPDU{command: p.command | smppResp, seq: p.seq, body: cstring("stub")}
+			if system != "brisa" || password != "senha" {
+				resp.status = 0x0e // ESME_RINVPASWD
+			}
+			c.Write(resp.encode())
+		case smppSubmitSM:
+			f := &smppReader{b: p.body}
+			f.cstring()
+			f.octets(2)
+			src := f.cstring()
+			f.octets(2)
+			dst := f.cstring()
+			f.octets(3)
+			f.cstring()
+			f.cstring()
+			opts := f.octets(5)
+			text := f.octets(int(opts[4]))
+			msg := smscMessage{source: src, dest: dst, coding: opts[2], text: string(text)}
+			if msg.coding == 8 {
+				u := make([]uint16, len(text)/2)
+				for i := range u {
+					u[i] = uint16(text[2*i])<<8 | uint16(text[2*i+1])
+				}
+				msg.text = string(utf16.Decode(u))
+			}
+			s.messages <- msg
+			n++
+			id := "m" + strconv.Itoa(n)
+			c.Write(smppPDU{command: p.command | smppResp, seq: p.seq, body: cstring(id)}.encode())
+
+			// Confirmação de entrega (esm_class 0x04).
+			var b bytes.Buffer
+			b.Write(cstring(""))
+			b.Write([]byte{1, 1})
+			b.Write(cstring(dst))
+			b.Write([]byte{5, 0})
+			b.Write(cstring(src))
+			b.Write([]byte{0x04, 0, 0})
+			b.Write(cstring(""))
+			b.Write(cstring(""))
+			b.Write([]byte{0, 0, 0, 0})
+			receipt := "id:" + id + " sub:001 dlvrd:001 submit date:2311141213 done date:2311141213 stat:DELIVRD err:000 text:"
+			b.WriteByte(byte(len(receipt)))
+			b.WriteString(receipt)
+			seq++
+			c.Write(smppPDU{command: smppDeliverSM, seq: seq, body: b.Bytes()}.encode())
+		case smppUnbind:
+			c.Write(smppPDU{command: p.command | smppResp, seq: p.seq}.encode())
+			return
+		default:
+			if p.command&smppResp == 0 {
+				c.Write(smppPDU{command: smppGenericNack, status: smppInvalidCommand, seq: p.seq}.encode())
+			}
+		}
+	}
+}
+
+func TestSMPPClient(t *testing.T) {
+	smsc := newSMSCStub(t)
+	client := &SMPPClient{Addr: smsc.addr, SystemID: "brisa", Password: "senha", Source: "Brisa", Timeout: 5 * time.Second}
+	defer client.Close()
+	sms := NewSMSSender(client, SMSOtp{})
+
+	c, err := NewChannel(NewMemoryStore(), sms, ChannelOtp{Method: MethodSMS})
+	require.NoError(t, err)
+	id := KeyID("Brisa", "ana")
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, c.Send(ctx, id, "+5511987654321", now))
+	msg := <-smsc.messages
+	require.Equal(t, "Brisa", msg.source)
+	require.Equal(t, "5511987654321", msg.dest)
+	require.Equal(t, byte(8), msg.coding, "Acentos vão em UCS-2")
+	require.Regexp(t, `^\d{6} é seu código Brisa`, msg.text)
+
+	m, err := c.Verify(id, codePattern.FindString(msg.text), now)
+	require.NoError(t, err)
+	require.Equal(t, MethodSMS, m.Method)
+
+	require.Eventually(t, func() bool {
+		d, ok := sms.Delivery("m1")
+		return ok && d.Status == SMSDelivered
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A mesma conexão serve o próximo envio, em ASCII.
+	msgID, err := client.SendSMS(ctx, "+5511987654321", "Codigo 123456")
+	require.NoError(t, err)
+	require.Equal(t, "m2", msgID)
+	msg = <-smsc.messages
+	require.Equal(t, byte(0), msg.coding)
+	require.Equal(t, "Codigo 123456", msg.text)
+
+	_, err = client.SendSMS(ctx, "+5511987654321", string(bytes.Repeat([]byte("é"), 71)))
+	require.ErrorIs(t, err, ErrSMSTooLong)
+
+	bad := &SMPPClient{Addr: smsc.addr, SystemID: "brisa", Password: "errada"}
+	_, err = bad.SendSMS(ctx, "+5511987654321", "x")
+	require.ErrorIs(t, err, ErrSMSRejected)
+}
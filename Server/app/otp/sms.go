@@ -0,0 +1,343 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSMSRateLimited = newError("sms.rate_limited", KindResourceExhausted)
+var ErrSMSRejected = newError("sms.rejected", KindInternal)
+
+// MethodSMS indica um código enviado por SMS.
+const MethodSMS Method = "sms"
+
+// SMSStatus é a situação de entrega de um SMS.
+type SMSStatus string
+
+const (
+	SMSSent      SMSStatus = "sent"      // aceito pelo provedor
+	SMSDelivered SMSStatus = "delivered" // confirmado pelo aparelho
+	SMSFailed    SMSStatus = "failed"
+)
+
+// SMSReport recebe as confirmações de entrega de um provedor.
+type SMSReport func(id string, status SMSStatus, detail string)
+
+// SMSProvider envia um SMS e retorna o identificador dado pelo provedor.
+// Provedores com confirmação de entrega também implementam OnReport.
+type SMSProvider interface {
+	SendSMS(ctx context.Context, to, body string) (string, error)
+}
+
+type smsReporter interface {
+	OnReport(r SMSReport)
+}
+
+// SMSDelivery é o registro de um SMS enviado.
+type SMSDelivery struct {
+	ID        string
+	To        string
+	Status    SMSStatus
+	Detail    string
+	SentAt    time.Time
+	UpdatedAt time.Time
+}
+
+// SMSOtp fornece opções para SMSSender.
+type SMSOtp struct {
+	RateLimit  uint          // Mensagens por número em RateWindow. O padrão é 5.
+	RateWindow time.Duration // O padrão é 1 hora.
+	Retention  time.Duration // Por quanto tempo as entregas são lembradas. O padrão é 24 horas.
+}
+
+func (o SMSOtp) defaults() SMSOtp {
+	if o.RateLimit == 0 {
+		o.RateLimit = 5
+	}
+	if o.RateWindow == 0 {
+		o.RateWindow = time.Hour
+	}
+	if o.Retention == 0 {
+		o.Retention = 24 * time.Hour
+	}
+	return o
+}
+
+// SMSSender é o Sender de um Channel por SMS. Ele normaliza o número para
+// E.164, limita as mensagens por número (contra abuso da conta do provedor) e
+// acompanha a entrega de cada mensagem. Os limites ficam em memória, por
+// instância.
+//
+//	sms := app.NewSMSSender(&app.WebhookSMS{URL: "https://sms.example.com/send", Secret: secret}, app.SMSOtp{})
+//	ch, err := app.NewChannel(store, sms, app.ChannelOtp{Method: app.MethodSMS})
+type SMSSender struct {
+	provider SMSProvider
+	otp      SMSOtp
+	now      func() time.Time
+
+	mu         sync.Mutex
+	sent       map[string][]time.Time // envios recentes por número
+	deliveries map[string]*SMSDelivery
+	inflight   int                     // envios aguardando a resposta do provedor
+	early      map[string]*SMSDelivery // confirmações que chegaram antes dessa resposta
+}
+
+func NewSMSSender(provider SMSProvider, otp SMSOtp) *SMSSender {
+	s := &SMSSender{
+		provider:   provider,
+		otp:        otp.defaults(),
+		now:        time.Now,
+		sent:       map[string][]time.Time{},
+		deliveries: map[string]*SMSDelivery{},
+		early:      map[string]*SMSDelivery{},
+	}
+	if r, ok := provider.(smsReporter); ok {
+		r.OnReport(s.report)
+	}
+	return s
+}
+
+// NormalizePhone retorna number em E.164 ("+5511987654321"), ignorando
+// espaços, hífens, pontos e parênteses.
+func NormalizePhone(number string) (string, error) {
+	n := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, number)
+	if !strings.HasPrefix(n, "+") || len(n) < 9 || len(n) > 16 || n[1] == '0' {
+		return "", ErrChannelInvalidAddress
+	}
+	for _, c := range n[1:] {
+		if c < '0' || c > '9' {
+			return "", ErrChannelInvalidAddress
+		}
+	}
+	return n, nil
+}
+
+func (s *SMSSender) Send(ctx context.Context, m Message) error {
+	to, err := NormalizePhone(m.To)
+	if err != nil {
+		return err
+	}
+	t := s.now()
+
+	s.mu.Lock()
+	recent := s.sent[to][:0]
+	for _, at := range s.sent[to] {
+		if t.Sub(at) < s.otp.RateWindow {
+			recent = append(recent, at)
+		}
+	}
+	if uint(len(recent)) >= s.otp.RateLimit {
+		s.sent[to] = recent
+		s.mu.Unlock()
+		return ErrSMSRateLimited
+	}
+	s.sent[to] = append(recent, t)
+	s.inflight++
+	s.mu.Unlock()
+
+	id, err := s.provider.SendSMS(ctx, to, m.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.early[id]
+	s.inflight--
+	if s.inflight == 0 {
+		s.early = map[string]*SMSDelivery{}
+	}
+	if err != nil {
+		return err
+	}
+
+	for k, d := range s.deliveries {
+		if t.Sub(d.SentAt) >= s.otp.Retention {
+			delete(s.deliveries, k)
+		}
+	}
+	for n, times := range s.sent {
+		if len(times) == 0 || t.Sub(times[len(times)-1]) >= s.otp.RateWindow {
+			delete(s.sent, n)
+		}
+	}
+	if d != nil {
+		// A confirmação chegou antes da resposta do envio.
+		delete(s.early, id)
+		d.To, d.SentAt = to, t
+		s.deliveries[id] = d
+		return nil
+	}
+	s.deliveries[id] = &SMSDelivery{ID: id, To: to, Status: SMSSent, SentAt: t, UpdatedAt: t}
+	return nil
+}
+
+// report atualiza a entrega id. Confirmações de IDs que este SMSSender não
+// enviou são ignoradas; enquanto há envios sem resposta do provedor, guarda
+// no máximo uma confirmação antecipada por envio.
+func (s *SMSSender) report(id string, status SMSStatus, detail string) {
+	t := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		if d, ok = s.early[id]; !ok {
+			if len(s.early) >= s.inflight {
+				return
+			}
+			d = &SMSDelivery{ID: id}
+			s.early[id] = d
+		}
+	}
+	// Uma entrega confirmada ou falha não volta a "sent".
+	if status == SMSSent && d.Status != "" && d.Status != SMSSent {
+		return
+	}
+	d.Status, d.Detail, d.UpdatedAt = status, detail, t
+}
+
+// Delivery retorna a situação do SMS id.
+func (s *SMSSender) Delivery(id string) (SMSDelivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		return SMSDelivery{}, false
+	}
+	return *d, true
+}
+
+// Deliveries lista os SMS recentes para number, do mais novo ao mais antigo.
+func (s *SMSSender) Deliveries(number string) []SMSDelivery {
+	to, err := NormalizePhone(number)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []SMSDelivery
+	for _, d := range s.deliveries {
+		if d.To == to {
+			out = append(out, *d)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SentAt.After(out[j].SentAt) })
+	return out
+}
+
+// WebhookSMS envia SMS por um gateway HTTP genérico: um POST em URL com
+// {"to": ..., "body": ...} que responde 2xx com {"id": ...}. Com Secret o corpo
+// é assinado em X-Signature ("sha256=" e o HMAC-SHA256 em hexadecimal).
+//
+// ServeHTTP recebe as confirmações de entrega do gateway, um POST com
+// {"id": ..., "status": "sent"|"delivered"|"failed", "detail": ...}, assinado
+// da mesma forma. Sem Secret ele não tem como autenticar o gateway e recusa
+// todas as confirmações.
+type WebhookSMS struct {
+	URL    string
+	Token  string // Enviado como "Authorization: Bearer".
+	Secret []byte
+	Client *http.Client // O padrão é http.DefaultClient.
+
+	report SMSReport
+}
+
+func (w *WebhookSMS) OnReport(r SMSReport) {
+	w.report = r
+}
+
+func (w *WebhookSMS) SendSMS(ctx context.Context, to, body string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"to": to, "body": body})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.Token)
+	}
+	if w.Secret != nil {
+		req.Header.Set("X-Signature", signBody(w.Secret, payload))
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", ErrSMSRejected
+	}
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil || out.ID == "" {
+		return "", ErrSMSRejected
+	}
+	return out.ID, nil
+}
+
+func (w *WebhookSMS) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(w.Secret) == 0 {
+		http.Error(rw, "WebhookSMS sem Secret", http.StatusInternalServerError)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Signature")), []byte(signBody(w.Secret, body))) {
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var st struct {
+		ID     string    `json:"id"`
+		Status SMSStatus `json:"status"`
+		Detail string    `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &st); err != nil || st.ID == "" {
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch st.Status {
+	case SMSSent, SMSDelivered, SMSFailed:
+	default:
+		http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if w.report != nil {
+		w.report(st.ID, st.Status, st.Detail)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// signBody retorna "sha256=" seguido do HMAC-SHA256 de body em hexadecimal.
+func signBody(key, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
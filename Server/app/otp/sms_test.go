@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// smsGateway é um gateway HTTP falso que guarda as mensagens recebidas.
+type smsGateway struct {
+	mu   sync.Mutex
+	sent []map[string]string
+	sigs []string
+}
+
+func (g *smsGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	var m map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	g.mu.Lock()
+	g.sent = append(g.sent, m)
+	g.sigs = append(g.sigs, r.Header.Get("X-Signature"))
+	id := "msg-" + strconv.Itoa(len(g.sent))
+	g.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+func TestNormalizePhone(t *testing.T) {
+	for in, want := range map[string]string{
+		"+55 (11) 98765-4321": "+5511987654321",
+		"+1.415.555.2671":     "+14155552671",
+		"11987654321":         "",
+		"+0123456789":         "",
+		"+55 11 9876x4321":    "",
+		"+123":                "",
+	} {
+		got, err := NormalizePhone(in)
+		if want == "" {
+			require.ErrorIs(t, err, ErrChannelInvalidAddress, in)
+			continue
+		}
+		require.NoError(t, err, in)
+		require.Equal(t, want, got)
+	}
+}
+
+func TestWebhookSMS(t *testing.T) {
+	gw := &smsGateway{}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	hook := &WebhookSMS{URL: srv.URL, Token: "tok", Secret: []byte("segredo")}
+	sms := NewSMSSender(hook, SMSOtp{RateLimit: 2})
+	now := time.Unix(1700000000, 0).UTC()
+	sms.now = func() time.Time { return now }
+
+	c, err := NewChannel(NewMemoryStore(), sms, ChannelOtp{Method: MethodSMS})
+	require.NoError(t, err)
+	c.now = sms.now
+	id := KeyID("Brisa", "ana")
+	ctx := context.Background()
+
+	require.NoError(t, c.Send(ctx, id, "+55 11 98765-4321", now))
+	require.Len(t, gw.sent, 1)
+	require.Equal(t, "+5511987654321", gw.sent[0]["to"])
+	require.Regexp(t, `^\d{6} é seu código Brisa\. Vale por 10 min\.$`, gw.sent[0]["body"])
+	require.True(t, strings.HasPrefix(gw.sigs[0], "sha256="))
+
+	code := codePattern.FindString(gw.sent[0]["body"])
+	m, err := c.Verify(id, code, now)
+	require.NoError(t, err)
+	require.Equal(t, MethodSMS, m.Method)
+
+	d, ok := sms.Delivery("msg-1")
+	require.True(t, ok)
+	require.Equal(t, SMSSent, d.Status)
+	require.Equal(t, "+5511987654321", d.To)
+
+	// Confirmação de entrega assinada.
+	report := func(body, sig string) int {
+		r := httptest.NewRequest("POST", "/sms/status", strings.NewReader(body))
+		r.Header.Set("X-Signature", sig)
+		w := httptest.NewRecorder()
+		hook.ServeHTTP(w, r)
+		return w.Code
+	}
+	body := `{"id":"msg-1","status":"delivered"}`
+	require.Equal(t, http.StatusUnauthorized, report(body, "sha256=00"))
+	require.Equal(t, http.StatusNoContent, report(body, signBody([]byte("segredo"), []byte(body))))
+	d, _ = sms.Delivery("msg-1")
+	require.Equal(t, SMSDelivered, d.Status)
+	late := `{"id":"msg-1","status":"sent"}`
+	require.Equal(t, http.StatusNoContent, report(late, signBody([]byte("segredo"), []byte(late))))
+	d, _ = sms.Delivery("msg-1")
+	require.Equal(t, SMSDelivered, d.Status, "Não volta a sent")
+	bad := `{"id":"msg-1","status":"lido"}`
+	require.Equal(t, http.StatusBadRequest, report(bad, signBody([]byte("segredo"), []byte(bad))))
+	unknown := `{"id":"msg-99","status":"delivered"}`
+	require.Equal(t, http.StatusNoContent, report(unknown, signBody([]byte("segredo"), []byte(unknown))))
+	_, ok = sms.Delivery("msg-99")
+	require.False(t, ok, "IDs que não foram enviados são ignorados")
+
+	// Limite por número, mesmo entre contas diferentes.
+	require.NoError(t, sms.Send(ctx, Message{To: "+5511987654321", Body: "x"}))
+	require.ErrorIs(t, sms.Send(ctx, Message{To: "+55 11 98765 4321", Body: "x"}), ErrSMSRateLimited)
+	require.NoError(t, sms.Send(ctx, Message{To: "+5511900000000", Body: "x"}))
+	now = now.Add(time.Hour)
+	require.NoError(t, sms.Send(ctx, Message{To: "+5511987654321", Body: "x"}))
+	require.Len(t, sms.Deliveries("+5511987654321"), 3)
+	sms.mu.Lock()
+	require.NotContains(t, sms.sent, "+5511900000000", "Números fora da janela são esquecidos")
+	sms.mu.Unlock()
+
+	require.ErrorIs(t, sms.Send(ctx, Message{To: "ana@example.com"}), ErrChannelInvalidAddress)
+	hook.Token = "errado"
+	require.ErrorIs(t, sms.Send(ctx, Message{To: "+5511911111111", Body: "x"}), ErrSMSRejected)
+}
+
+// earlySMS confirma a entrega antes de responder ao envio.
+type earlySMS struct {
+	report SMSReport
+}
+
+func (e *earlySMS) OnReport(r SMSReport) { e.report = r }
+
+func (e *earlySMS) SendSMS(ctx context.Context, to, body string) (string, error) {
+	e.report("msg-1", SMSDelivered, "")
+	e.report("msg-2", SMSDelivered, "")
+	return "msg-1", nil
+}
+
+func TestSMSEarlyReport(t *testing.T) {
+	sms := NewSMSSender(&earlySMS{}, SMSOtp{})
+	require.NoError(t, sms.Send(context.Background(), Message{To: "+5511987654321", Body: "x"}))
+	d, ok := sms.Delivery("msg-1")
+	require.True(t, ok)
+	require.Equal(t, SMSDelivered, d.Status, "Confirmação antecipada")
+	require.Equal(t, "+5511987654321", d.To)
+	_, ok = sms.Delivery("msg-2")
+	require.False(t, ok, "Uma confirmação antecipada por envio")
+	require.Empty(t, sms.early)
+
+	// Sem Secret não há como autenticar o gateway.
+	w := httptest.NewRecorder()
+	(&WebhookSMS{}).ServeHTTP(w, httptest.NewRequest("POST", "/sms/status", strings.NewReader(`{"id":"msg-1","status":"failed"}`)))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var ErrSMTPNoTLS = newError("smtp.no_tls", KindInternal)
+
+// SMTPSender entrega mensagens de um Channel por SMTP, em texto puro UTF-8.
+// A mensagem leva o código, por isso TLS é obrigatório: sem ImplicitTLS, um
+// servidor que não oferece STARTTLS (ou um atacante que remove a oferta)
+// recebe ErrSMTPNoTLS antes de qualquer dado, a menos que AllowPlaintext esteja
+// definido.
+type SMTPSender struct {
+	Addr           string // host:porta do servidor, ex.: "smtp.example.com:587"
+	From           string // remetente, ex.: "Brisa <nao-responda@brisa.com>"
+	Auth           smtp.Auth
+	TLSConfig      *tls.Config // O padrão usa o host de Addr como ServerName.
+	ImplicitTLS    bool        // TLS desde a conexão (SMTPS, porta 465) em vez de STARTTLS.
+	AllowPlaintext bool        // Envia sem TLS se o servidor não oferecer STARTTLS, ex.: um relay local.
+
+	now func() time.Time
+}
+
+func (s *SMTPSender) Send(ctx context.Context, m Message) error {
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return ErrChannelInvalidAddress
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return ErrChannelInvalidAddress
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	cfg := s.TLSConfig
+	if cfg == nil {
+		cfg = &tls.Config{ServerName: host}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if s.ImplicitTLS {
+		conn = tls.Client(conn, cfg)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !s.ImplicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(cfg); err != nil {
+				return err
+			}
+		} else if !s.AllowPlaintext {
+			return ErrSMTPNoTLS
+		}
+	}
+	if s.Auth != nil {
+		if err := c.Auth(s.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg, err := s.build(from, to, m)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// build monta a mensagem RFC 5322. Os endereços já foram validados por
+// mail.ParseAddress, então não há como injetar cabeçalhos.
+func (s *SMTPSender) build(from, to *mail.Address, m Message) ([]byte, error) {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	var b bytes.Buffer
+	header := func(k, v string) { b.WriteString(k + ": " + v + "\r\n") }
+	header("From", from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+hex.EncodeToString(id)+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "quoted-printable")
+	header("Auto-Submitted", "auto-generated")
+	b.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := qp.Write([]byte(m.Body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
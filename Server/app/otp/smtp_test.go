@@ -0,0 +1,138 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// smtpStub é um servidor SMTP mínimo que entrega cada mensagem em msgs.
+type smtpStub struct {
+	addr string
+	msgs chan string
+	rcpt chan string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	s := &smtpStub{addr: l.Addr().String(), msgs: make(chan string, 10), rcpt: make(chan string, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStub) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(line string) { io.WriteString(c, line+"\r\n") }
+	reply("220 stub ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250-stub")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.rcpt <- strings.TrimSpace(line[len("RCPT TO:"):])
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 fim com .")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			s.msgs <- data.String()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 tchau")
+			return
+		default:
+			reply("502 não implementado")
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	stub := newSMTPStub(t)
+	sender := &SMTPSender{Addr: stub.addr, From: "Brisa <nao-responda@brisa.com>", AllowPlaintext: true}
+	now := time.Unix(1700000000, 0).UTC()
+	sender.now = func() time.Time { return now }
+
+	c, err := NewChannel(NewMemoryStore(), sender, ChannelOtp{})
+	require.NoError(t, err)
+	id := KeyID("Brisa", "ana")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, c.Send(ctx, id, "Ana <ana@example.com>", now))
+
+	require.Equal(t, "<ana@example.com>", <-stub.rcpt)
+	msg, err := mail.ReadMessage(strings.NewReader(<-stub.msgs))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Seu código de verificação", subject)
+	require.Equal(t, `"Ana" <ana@example.com>`, msg.Header.Get("To"))
+	require.Equal(t, now.Format(time.RFC1123Z), msg.Header.Get("Date"))
+	require.True(t, strings.HasSuffix(msg.Header.Get("Message-ID"), "@brisa.com>"))
+
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	require.NoError(t, err)
+	require.Contains(t, string(body), "Ele vale por 10 minutos")
+	code := codePattern.FindString(string(body))
+	require.NotEmpty(t, code)
+
+	m, err := c.Verify(id, code, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, MethodEmail, m.Method)
+
+	// Endereços inválidos não chegam ao servidor.
+	err = sender.Send(ctx, Message{To: "ana@example.com\r\nBcc: todos@example.com", Body: "x"})
+	require.ErrorIs(t, err, ErrChannelInvalidAddress)
+}
+
+func TestSMTPSenderRequiresTLS(t *testing.T) {
+	// O stub não anuncia STARTTLS, como um servidor cuja oferta foi removida
+	// no caminho: o código não pode sair em texto puro.
+	stub := newSMTPStub(t)
+	sender := &SMTPSender{Addr: stub.addr, From: "Brisa <nao-responda@brisa.com>"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := sender.Send(ctx, Message{To: "ana@example.com", Subject: "Código", Body: "123456"})
+	require.ErrorIs(t, err, ErrSMTPNoTLS)
+	select {
+	case rcpt := <-stub.rcpt:
+		t.Fatalf("Destinatário enviado sem TLS: %s", rcpt)
+	default:
+	}
+}
@@ -0,0 +1,471 @@
+package app
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSQLConflict = newError("sql.conflict", KindAborted)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// SQLDialect descreve as diferenças entre bancos usadas pelo SQLStore.
+// As consultas são escritas com "?" e reescritas com Placeholder.
+type SQLDialect struct {
+	Name        string
+	Placeholder func(n int) string // n começa em 1
+}
+
+var (
+	DialectSQLite   = SQLDialect{Name: "sqlite", Placeholder: func(int) string { return "?" }}
+	DialectMySQL    = SQLDialect{Name: "mysql", Placeholder: func(int) string { return "?" }}
+	DialectPostgres = SQLDialect{Name: "postgres", Placeholder: func(n int) string { return "$" + strconv.Itoa(n) }}
+)
+
+// Número de tentativas de Update quando outra transação altera o mesmo registro.
+const sqlUpdateRetries = 10
+
+const sqlKeyColumns = `id, url, state, created_at, expires_at, activated_at, last_used_at,
+	confirmations, counter, last_step, next_url, next_counter, grace_until,
+	failures, locked_until, recovery, key_version, wrapped_key, devices, challenge`
+
+// SQLStore é um KeyStore sobre database/sql.
+//
+// Update usa controle de concorrência otimista: cada linha tem uma coluna
+// version e a gravação só acontece se ela não mudou desde a leitura. Assim duas
+// validações concorrentes do mesmo código nunca são aceitas, em qualquer banco.
+// No SQLite use um DSN com busy_timeout e _txlock=immediate.
+type SQLStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+// NewSQLStore aplica as migrações pendentes e retorna o store.
+func NewSQLStore(db *sql.DB, dialect SQLDialect) (*SQLStore, error) {
+	s := &SQLStore{db: db, dialect: dialect}
+	if err := s.Migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Migrate aplica em ordem os arquivos de migrations/ ainda não registrados
+// na tabela otp_schema_migrations, cada um em sua própria transação.
+func (s *SQLStore) Migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS otp_schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	applied := map[int]bool{}
+	rows, err := s.db.Query(`SELECT version FROM otp_schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		base := strings.TrimPrefix(name, "migrations/")
+		v, err := strconv.Atoi(strings.SplitN(base, "_", 2)[0])
+		if err != nil {
+			return err
+		}
+		if applied[v] {
+			continue
+		}
+		data, err := migrationsFS.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := s.applyMigration(v, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) applyMigration(version int, script string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Nem todo driver aceita vários comandos em um Exec.
+	for _, stmt := range strings.Split(script, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(s.q(`INSERT INTO otp_schema_migrations (version) VALUES (?)`), version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// q troca os "?" da consulta pelos placeholders do dialeto.
+func (s *SQLStore) q(query string) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString(s.dialect.Placeholder(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func (s *SQLStore) Get(id string) (*KeyRecord, error) {
+	rec, _, err := scanKeyRecord(s.db.QueryRow(s.q(`SELECT `+sqlKeyColumns+`, version FROM otp_keys WHERE id = ?`), id))
+	return rec, err
+}
+
+func (s *SQLStore) List() ([]*KeyRecord, error) {
+	rows, err := s.db.Query(`SELECT ` + sqlKeyColumns + `, version FROM otp_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*KeyRecord
+	for rows.Next() {
+		rec, _, err := scanKeyRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+// ListPage filtra e pagina no banco, ver ListKeys. O filtro por emissor usa
+// um intervalo de IDs (":" e ";" são vizinhos em ASCII) para aproveitar a
+// chave primária sem escapar LIKE.
+func (s *SQLStore) ListPage(f KeyFilter) ([]*KeyRecord, error) {
+	query := `SELECT ` + sqlKeyColumns + `, version FROM otp_keys WHERE id > ?`
+	args := []any{f.After}
+	if f.Issuer != "" {
+		query += ` AND id > ? AND id < ?`
+		args = append(args, f.Issuer+":", f.Issuer+";")
+	}
+	if f.State != "" {
+		query += ` AND state = ?`
+		args = append(args, string(f.State))
+	}
+	query += ` ORDER BY id LIMIT ?`
+	args = append(args, f.Limit)
+
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*KeyRecord
+	for rows.Next() {
+		rec, _, err := scanKeyRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+// Put grava rec com um único INSERT ... ON CONFLICT (ON DUPLICATE KEY no MySQL),
+// sem a corrida entre procurar e inserir.
+func (s *SQLStore) Put(rec *KeyRecord) error {
+	args, err := keyRecordArgs(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.q(s.upsert()), args...)
+	return err
+}
+
+// Create grava rec só se o ID estiver livre, sem depender do erro de chave
+// duplicada de cada driver.
+func (s *SQLStore) Create(rec *KeyRecord) error {
+	args, err := keyRecordArgs(rec)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO otp_keys (` + sqlKeyColumns + `, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`
+	if s.dialect.Name == DialectMySQL.Name {
+		query += ` ON DUPLICATE KEY UPDATE id = id`
+	} else {
+		query += ` ON CONFLICT (id) DO NOTHING`
+	}
+	res, err := s.db.Exec(s.q(query), args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+func (s *SQLStore) upsert() string {
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO otp_keys (` + sqlKeyColumns + `, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`)
+	if s.dialect.Name == DialectMySQL.Name {
+		sb.WriteString(` ON DUPLICATE KEY UPDATE `)
+	} else {
+		sb.WriteString(` ON CONFLICT (id) DO UPDATE SET `)
+	}
+	for _, c := range strings.Split(sqlKeyColumns, ",")[1:] {
+		c = strings.TrimSpace(c)
+		if s.dialect.Name == DialectMySQL.Name {
+			sb.WriteString(c + ` = VALUES(` + c + `), `)
+		} else {
+			sb.WriteString(c + ` = excluded.` + c + `, `)
+		}
+	}
+	sb.WriteString(`version = otp_keys.version + 1`)
+	return sb.String()
+}
+
+const sqlUpdateKey = `UPDATE otp_keys SET url = ?, state = ?, created_at = ?, expires_at = ?,
+	activated_at = ?, last_used_at = ?, confirmations = ?, counter = ?, last_step = ?,
+	next_url = ?, next_counter = ?, grace_until = ?, failures = ?, locked_until = ?,
+	recovery = ?, key_version = ?, wrapped_key = ?, devices = ?, challenge = ?, version = version + 1`
+
+// Update repete fn, relida sobre o registro atual, quando outra transação grava
+// o mesmo registro entre a leitura e a escrita; veja KeyStore.Update.
+func (s *SQLStore) Update(id string, fn func(rec *KeyRecord) error) error {
+	for i := 0; i < sqlUpdateRetries; i++ {
+		err := s.tryUpdate(id, fn)
+		if err != ErrSQLConflict {
+			return err
+		}
+	}
+	return ErrSQLConflict
+}
+
+func (s *SQLStore) tryUpdate(id string, fn func(rec *KeyRecord) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rec, version, err := scanKeyRecord(tx.QueryRow(s.q(`SELECT `+sqlKeyColumns+`, version FROM otp_keys WHERE id = ?`), id))
+	if err != nil {
+		return err
+	}
+	if err := fn(rec); err != nil {
+		return err
+	}
+	rec.ID = id
+
+	args, err := keyRecordArgs(rec)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(s.q(sqlUpdateKey+` WHERE id = ? AND version = ?`), append(args[1:], id, version)...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSQLConflict
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Delete(id string) error {
+	res, err := s.db.Exec(s.q(`DELETE FROM otp_keys WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// DeleteIf remove id só se a versão conferida por fn ainda for a atual,
+// repetindo como Update quando outra transação grava o registro no meio.
+func (s *SQLStore) DeleteIf(id string, fn func(rec *KeyRecord) error) error {
+	for i := 0; i < sqlUpdateRetries; i++ {
+		err := s.tryDeleteIf(id, fn)
+		if err != ErrSQLConflict {
+			return err
+		}
+	}
+	return ErrSQLConflict
+}
+
+func (s *SQLStore) tryDeleteIf(id string, fn func(rec *KeyRecord) error) error {
+	rec, version, err := scanKeyRecord(s.db.QueryRow(s.q(`SELECT `+sqlKeyColumns+`, version FROM otp_keys WHERE id = ?`), id))
+	if err != nil {
+		return err
+	}
+	if err := fn(rec); err != nil {
+		return err
+	}
+	res, err := s.db.Exec(s.q(`DELETE FROM otp_keys WHERE id = ? AND version = ?`), id, version)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSQLConflict
+	}
+	return nil
+}
+
+// keyRecordArgs retorna os valores na ordem de sqlKeyColumns.
+func keyRecordArgs(rec *KeyRecord) ([]interface{}, error) {
+	recovery := ""
+	if rec.Recovery != nil {
+		b, err := json.Marshal(rec.Recovery)
+		if err != nil {
+			return nil, err
+		}
+		recovery = string(b)
+	}
+	devices := ""
+	if len(rec.Devices) > 0 {
+		b, err := json.Marshal(rec.Devices)
+		if err != nil {
+			return nil, err
+		}
+		devices = string(b)
+	}
+	challenge := ""
+	if rec.Challenge != nil {
+		b, err := json.Marshal(rec.Challenge)
+		if err != nil {
+			return nil, err
+		}
+		challenge = string(b)
+	}
+
+	return []interface{}{
+		rec.ID, rec.URL, string(rec.State),
+		sqlTime(rec.CreatedAt), sqlTime(rec.ExpiresAt), sqlTime(rec.ActivatedAt), sqlTime(rec.LastUsedAt),
+		int64(rec.Confirmations), int64(rec.Counter), rec.LastStep,
+		rec.NextURL, int64(rec.NextCounter), sqlTime(rec.GraceUntil),
+		int64(rec.Throttle.Failures), sqlTime(rec.Throttle.LockedUntil),
+		recovery, rec.KeyVersion, rec.WrappedKey, devices, challenge,
+	}, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKeyRecord(row rowScanner) (*KeyRecord, int64, error) {
+	var (
+		rec                                   KeyRecord
+		state, recovery                       string
+		devices, challenge                    sql.NullString
+		created, expires, activated, lastUsed int64
+		confirmations, counter, nextCounter   int64
+		grace, failures, lockedUntil, version int64
+	)
+	err := row.Scan(&rec.ID, &rec.URL, &state,
+		&created, &expires, &activated, &lastUsed,
+		&confirmations, &counter, &rec.LastStep,
+		&rec.NextURL, &nextCounter, &grace,
+		&failures, &lockedUntil,
+		&recovery, &rec.KeyVersion, &rec.WrappedKey, &devices, &challenge, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rec.State = KeyState(state)
+	rec.CreatedAt = goTime(created)
+	rec.ExpiresAt = goTime(expires)
+	rec.ActivatedAt = goTime(activated)
+	rec.LastUsedAt = goTime(lastUsed)
+	rec.Confirmations = uint(confirmations)
+	rec.Counter = uint64(counter)
+	rec.NextCounter = uint64(nextCounter)
+	rec.GraceUntil = goTime(grace)
+	rec.Throttle.Failures = uint(failures)
+	rec.Throttle.LockedUntil = goTime(lockedUntil)
+	if recovery != "" {
+		rec.Recovery = &RecoveryCodes{}
+		if err := json.Unmarshal([]byte(recovery), rec.Recovery); err != nil {
+			return nil, 0, err
+		}
+	}
+	if devices.String != "" {
+		if err := json.Unmarshal([]byte(devices.String), &rec.Devices); err != nil {
+			return nil, 0, err
+		}
+	}
+	if challenge.String != "" {
+		rec.Challenge = &Challenge{}
+		if err := json.Unmarshal([]byte(challenge.String), rec.Challenge); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &rec, version, nil
+}
+
+// Os tempos são guardados como nanossegundos Unix, 0 para o tempo zero.
+func sqlTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func goTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
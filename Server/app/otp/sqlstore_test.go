@@ -0,0 +1,78 @@
+package app
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func openTestSQLite(t *testing.T) *sql.DB {
+	dsn := "file:" + filepath.Join(t.TempDir(), "otp.db") +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLStore(t *testing.T) {
+	db := openTestSQLite(t)
+	s, err := NewSQLStore(db, DialectSQLite)
+	require.NoError(t, err, "Aplicar migrações")
+	testKeyStore(t, s)
+
+	_, err = NewSQLStore(db, DialectSQLite)
+	require.NoError(t, err, "Migrações já aplicadas são ignoradas")
+
+	var n int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM otp_schema_migrations`).Scan(&n))
+	require.Equal(t, 3, n)
+
+	s, err = NewSQLStore(openTestSQLite(t), DialectSQLite)
+	require.NoError(t, err)
+	testListKeys(t, s)
+}
+
+func TestSQLStoreNoDoubleAccept(t *testing.T) {
+	s, err := NewSQLStore(openTestSQLite(t), DialectSQLite)
+	require.NoError(t, err)
+	v := NewVerifier(s, VerifyOtp{Skew: 1, Throttle: ThrottleOtp{MaxFailures: 100}})
+	id := newActiveRecord(t, s, `otpauth://totp/Brisa:a@b.com?secret=JBSWY3DPEHPK3PXP&issuer=Brisa`)
+
+	now := time.Now()
+	code, err := GenerateCodes("JBSWY3DPEHPK3PXP", now)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.Verify(id, code, now)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			require.Equal(t, ErrValidateReplayed, err)
+		} else {
+			accepted++
+		}
+	}
+	require.Equal(t, 1, accepted, "O código só pode ser aceito uma vez")
+}
+
+func TestSQLDialectPlaceholders(t *testing.T) {
+	s := &SQLStore{dialect: DialectPostgres}
+	require.Equal(t, "UPDATE t SET a = $1 WHERE id = $2", s.q("UPDATE t SET a = ? WHERE id = ?"))
+	s.dialect = DialectMySQL
+	require.Equal(t, "SELECT ? FROM t", s.q("SELECT ? FROM t"))
+}
@@ -0,0 +1,297 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrStepUpInvalidKey = newError("stepup.invalid_key", KindInvalidArgument)
+var ErrStepUpInvalidToken = newError("stepup.invalid_token", KindUnauthenticated)
+var ErrStepUpUnknownKey = newError("stepup.unknown_key", KindUnauthenticated)
+var ErrStepUpExpired = newError("stepup.expired", KindUnauthenticated)
+
+// Algoritmos JWS suportados.
+const (
+	StepUpEdDSA = "EdDSA"
+	StepUpHS256 = "HS256"
+)
+
+// StepUpOtp fornece opções para emitir e conferir tokens step-up.
+type StepUpOtp struct {
+	Issuer   string        // Claim "iss". O padrão é "otp".
+	Audience string        // Claim "aud"; se definida é exigida na verificação.
+	TTL      time.Duration // Validade do token. O padrão é 5 minutos.
+	Leeway   time.Duration // Tolerância de relógio na verificação.
+}
+
+func (o StepUpOtp) defaults() StepUpOtp {
+	if o.Issuer == "" {
+		o.Issuer = "otp"
+	}
+	if o.TTL == 0 {
+		o.TTL = 5 * time.Minute
+	}
+	return o
+}
+
+// StepUpClaims é o conteúdo de um token step-up. Subject é o ID da chave
+// (issuer:account) e AuthTime o momento em que o código foi aceito.
+type StepUpClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud,omitempty"`
+	Account   string   `json:"account"`
+	KeyIssuer string   `json:"key_issuer"`
+	Method    Method   `json:"method"`
+	AMR       []string `json:"amr"`
+	AuthTime  int64    `json:"auth_time"`
+	IssuedAt  int64    `json:"iat"`
+	Expires   int64    `json:"exp"`
+	ID        string   `json:"jti"`
+}
+
+// JWK é uma chave pública no formato da RFC 7517. Apenas OKP/Ed25519 é usada.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+// JWKS é um conjunto de chaves públicas, como servido por StepUpSigner.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// ParseJWKS lê um JWKS em JSON, por exemplo baixado do endpoint do emissor.
+func ParseJWKS(r io.Reader) (*JWKS, error) {
+	var set JWKS
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// StepUpSigner emite tokens JWS curtos que provam que uma conta acabou de
+// validar um código, para que outros serviços não precisem validá-lo de novo.
+//
+//	m, err := verifier.Verify(id, code, now)
+//	token, err := signer.Sign(id, m, now)
+//
+// Com Ed25519 os serviços conferem os tokens offline com a chave pública do
+// JWKS (ServeHTTP); com HMAC o segredo precisa ser compartilhado.
+type StepUpSigner struct {
+	kid    string
+	alg    string
+	ed     ed25519.PrivateKey
+	secret []byte
+	otp    StepUpOtp
+	now    func() time.Time
+}
+
+func NewStepUpSignerEd25519(kid string, key ed25519.PrivateKey, otp StepUpOtp) (*StepUpSigner, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, ErrStepUpInvalidKey
+	}
+	return &StepUpSigner{kid: kid, alg: StepUpEdDSA, ed: key, otp: otp.defaults(), now: time.Now}, nil
+}
+
+// NewStepUpSignerHMAC usa HS256; key deve ter ao menos 32 bytes.
+func NewStepUpSignerHMAC(kid string, key []byte, otp StepUpOtp) (*StepUpSigner, error) {
+	if len(key) < sha256.Size {
+		return nil, ErrStepUpInvalidKey
+	}
+	return &StepUpSigner{kid: kid, alg: StepUpHS256, secret: append([]byte(nil), key...), otp: otp.defaults(), now: time.Now}, nil
+}
+
+// Sign emite um token para a chave id, cujo código foi aceito em t com m.
+func (s *StepUpSigner) Sign(id string, m Match, t time.Time) (string, error) {
+	keyIssuer, account, _ := strings.Cut(id, ":")
+	amr := []string{"otp"}
+	if m.Method == MethodRecovery {
+		amr = []string{"recovery"}
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	iat := s.now()
+	claims := StepUpClaims{
+		Issuer:    s.otp.Issuer,
+		Subject:   id,
+		Audience:  s.otp.Audience,
+		Account:   account,
+		KeyIssuer: keyIssuer,
+		Method:    m.Method,
+		AMR:       amr,
+		AuthTime:  t.Unix(),
+		IssuedAt:  iat.Unix(),
+		Expires:   iat.Add(s.otp.TTL).Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(jti),
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	if s.alg == StepUpEdDSA {
+		sig = ed25519.Sign(s.ed, []byte(input))
+	} else {
+		sig = hs256(s.secret, input)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// JWKS retorna as chaves públicas do emissor. Chaves HMAC não são publicadas.
+func (s *StepUpSigner) JWKS() *JWKS {
+	set := &JWKS{Keys: []JWK{}}
+	if s.alg == StepUpEdDSA {
+		pub := s.ed.Public().(ed25519.PublicKey)
+		set.Keys = append(set.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+			Kid: s.kid,
+			Alg: StepUpEdDSA,
+			Use: "sig",
+		})
+	}
+	return set
+}
+
+// ServeHTTP serve o JWKS, normalmente em /.well-known/jwks.json.
+func (s *StepUpSigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.JWKS())
+}
+
+// Verifier retorna um StepUpVerifier que aceita os tokens deste emissor.
+func (s *StepUpSigner) Verifier() *StepUpVerifier {
+	v := NewStepUpVerifier(s.JWKS(), s.otp)
+	if s.alg == StepUpHS256 {
+		v.AddHMAC(s.kid, s.secret)
+	}
+	return v
+}
+
+type stepUpKey struct {
+	alg    string
+	pub    ed25519.PublicKey
+	secret []byte
+}
+
+// StepUpVerifier confere tokens step-up offline, com as chaves de um JWKS
+// e, opcionalmente, segredos HMAC compartilhados.
+type StepUpVerifier struct {
+	keys map[string]stepUpKey
+	otp  StepUpOtp
+	now  func() time.Time
+}
+
+// NewStepUpVerifier usa as chaves Ed25519 de set; as demais são ignoradas.
+// otp.Issuer e otp.Audience devem ser os mesmos do emissor.
+func NewStepUpVerifier(set *JWKS, otp StepUpOtp) *StepUpVerifier {
+	v := &StepUpVerifier{keys: map[string]stepUpKey{}, otp: otp.defaults(), now: time.Now}
+	if set == nil {
+		return v
+	}
+	for _, k := range set.Keys {
+		if k.Kty != "OKP" || k.Crv != "Ed25519" || (k.Alg != "" && k.Alg != StepUpEdDSA) {
+			continue
+		}
+		pub, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			continue
+		}
+		v.keys[k.Kid] = stepUpKey{alg: StepUpEdDSA, pub: pub}
+	}
+	return v
+}
+
+// AddHMAC aceita tokens HS256 com o identificador kid.
+func (v *StepUpVerifier) AddHMAC(kid string, key []byte) {
+	v.keys[kid] = stepUpKey{alg: StepUpHS256, secret: append([]byte(nil), key...)}
+}
+
+// Verify confere assinatura, emissor, audiência e validade de token. O
+// algoritmo é o da chave indicada por "kid", nunca o declarado no token.
+func (v *StepUpVerifier) Verify(token string) (*StepUpClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrStepUpInvalidToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrStepUpInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, ErrStepUpInvalidToken
+	}
+	key, ok := v.keys[header.Kid]
+	if !ok {
+		return nil, ErrStepUpUnknownKey
+	}
+	if header.Alg != key.alg {
+		return nil, ErrStepUpInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrStepUpInvalidToken
+	}
+	input := parts[0] + "." + parts[1]
+	if key.alg == StepUpEdDSA {
+		ok = ed25519.Verify(key.pub, []byte(input), sig)
+	} else {
+		ok = hmac.Equal(sig, hs256(key.secret, input))
+	}
+	if !ok {
+		return nil, ErrStepUpInvalidToken
+	}
+
+	raw, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrStepUpInvalidToken
+	}
+	var claims StepUpClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, ErrStepUpInvalidToken
+	}
+	if claims.Issuer != v.otp.Issuer || claims.Audience != v.otp.Audience || claims.Subject == "" {
+		return nil, ErrStepUpInvalidToken
+	}
+	t := v.now()
+	if !t.Before(time.Unix(claims.Expires, 0).Add(v.otp.Leeway)) {
+		return nil, ErrStepUpExpired
+	}
+	if t.Add(v.otp.Leeway).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, ErrStepUpInvalidToken
+	}
+	return &claims, nil
+}
+
+func hs256(key []byte, input string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(input))
+	return h.Sum(nil)
+}
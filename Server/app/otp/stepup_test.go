@@ -0,0 +1,93 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepUpEd25519(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	otp := StepUpOtp{Issuer: "https://otp.example.com", Audience: "pagamentos"}
+	s, err := NewStepUpSignerEd25519("k1", priv, otp)
+	require.NoError(t, err)
+	s.now = func() time.Time { return now }
+
+	token, err := s.Sign("Banco:ana", Match{Method: MethodTOTP}, now.Add(-time.Second))
+	require.NoError(t, err)
+
+	// Outro serviço baixa o JWKS e confere o token offline.
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	set, err := ParseJWKS(w.Body)
+	require.NoError(t, err)
+	require.Len(t, set.Keys, 1)
+	require.Equal(t, "OKP", set.Keys[0].Kty)
+
+	v := NewStepUpVerifier(set, otp)
+	v.now = func() time.Time { return now.Add(time.Minute) }
+	claims, err := v.Verify(token)
+	require.NoError(t, err)
+	require.Equal(t, "Banco:ana", claims.Subject)
+	require.Equal(t, "ana", claims.Account)
+	require.Equal(t, "Banco", claims.KeyIssuer)
+	require.Equal(t, MethodTOTP, claims.Method)
+	require.Equal(t, []string{"otp"}, claims.AMR)
+	require.Equal(t, now.Add(-time.Second).Unix(), claims.AuthTime)
+	require.Equal(t, now.Add(5*time.Minute).Unix(), claims.Expires)
+
+	v.now = func() time.Time { return now.Add(5 * time.Minute) }
+	_, err = v.Verify(token)
+	require.ErrorIs(t, err, ErrStepUpExpired)
+	v.now = func() time.Time { return now }
+
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://otp.example.com","aud":"pagamentos","sub":"Banco:bruno","exp":9999999999}`)) + "." + parts[2]
+	_, err = v.Verify(forged)
+	require.ErrorIs(t, err, ErrStepUpInvalidToken, "Payload adulterado")
+
+	_, err = NewStepUpVerifier(set, StepUpOtp{Issuer: "https://otp.example.com", Audience: "outro"}).Verify(token)
+	require.ErrorIs(t, err, ErrStepUpInvalidToken, "Outra audiência")
+	_, err = NewStepUpVerifier(nil, otp).Verify(token)
+	require.ErrorIs(t, err, ErrStepUpUnknownKey)
+
+	_, err = NewStepUpSignerEd25519("k1", priv[:10], otp)
+	require.ErrorIs(t, err, ErrStepUpInvalidKey)
+}
+
+func TestStepUpHMAC(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s, err := NewStepUpSignerHMAC("h1", key, StepUpOtp{})
+	require.NoError(t, err)
+	require.Empty(t, s.JWKS().Keys, "Segredo HMAC não é publicado")
+
+	token, err := s.Sign("Banco:ana", Match{Method: MethodRecovery}, time.Now())
+	require.NoError(t, err)
+	claims, err := s.Verifier().Verify(token)
+	require.NoError(t, err)
+	require.Equal(t, "otp", claims.Issuer)
+	require.Equal(t, []string{"recovery"}, claims.AMR)
+
+	_, err = NewStepUpSignerHMAC("h1", key[:16], StepUpOtp{})
+	require.ErrorIs(t, err, ErrStepUpInvalidKey)
+
+	// Um token HS256 assinado com a chave pública Ed25519 como segredo não
+	// pode passar por uma chave EdDSA com o mesmo kid.
+	pub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	confused, err := NewStepUpSignerHMAC("k1", append(pub, pub...), StepUpOtp{})
+	require.NoError(t, err)
+	token, err = confused.Sign("Banco:ana", Match{Method: MethodTOTP}, time.Now())
+	require.NoError(t, err)
+	set := &JWKS{Keys: []JWK{{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub), Kid: "k1"}}}
+	_, err = NewStepUpVerifier(set, StepUpOtp{}).Verify(token)
+	require.ErrorIs(t, err, ErrStepUpInvalidToken)
+}
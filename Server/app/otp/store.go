@@ -0,0 +1,419 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrKeyNotFound = newError("key.not_found", KindNotFound)
+var ErrKeyExists = newError("key.exists", KindAlreadyExists)
+
+// KeyState representa a etapa do ciclo de vida de uma chave guardada.
+type KeyState string
+
+const (
+	KeyPending  KeyState = "pending" // aguardando confirmação do usuário
+	KeyActive   KeyState = "active"
+	KeyDisabled KeyState = "disabled" // desativada por um administrador, ver Verifier.Disable
+	KeyReenroll KeyState = "reenroll" // o usuário precisa cadastrar uma chave nova
+)
+
+// KeyRecord é a forma persistida de uma Key junto com o estado de validação.
+type KeyRecord struct {
+	ID            string
+	URL           string
+	State         KeyState
+	CreatedAt     time.Time
+	ExpiresAt     time.Time // apenas chaves pendentes expiram
+	ActivatedAt   time.Time
+	LastUsedAt    time.Time
+	Confirmations uint
+	Counter       uint64 // próximo contador HOTP esperado
+	LastStep      int64  // último passo TOTP aceito, usado contra reuso
+	NextURL       string `json:",omitempty"` // segredo novo durante uma rotação
+	NextCounter   uint64 `json:",omitempty"`
+	GraceUntil    time.Time
+	Throttle      Throttle
+	Recovery      *RecoveryCodes  `json:",omitempty"`
+	Devices       []TrustedDevice `json:",omitempty"` // dispositivos confiáveis, ver TrustDevice
+	Challenge     *Challenge      `json:",omitempty"` // código pendente de um Channel
+	KeyVersion    string          `json:",omitempty"` // versão da chave mestra, ver EncryptedStore
+	WrappedKey    string          `json:",omitempty"`
+}
+
+// KeyID retorna o identificador de uma chave no formato issuer:account.
+func KeyID(issuer, accountName string) string {
+	return issuer + ":" + accountName
+}
+
+// Key retorna a Key representada pela URL do registro.
+func (r *KeyRecord) Key() (*Key, error) {
+	return NewKeyFromURL(r.URL)
+}
+
+func (r *KeyRecord) clone() *KeyRecord {
+	c := *r
+	if r.Recovery != nil {
+		rc := *r.Recovery
+		rc.Hashes = append([]string(nil), r.Recovery.Hashes...)
+		c.Recovery = &rc
+	}
+	c.Devices = append([]TrustedDevice(nil), r.Devices...)
+	if r.Challenge != nil {
+		ch := *r.Challenge
+		c.Challenge = &ch
+	}
+	return &c
+}
+
+// KeyStore guarda registros de chaves de forma persistente.
+// Update deve ser atômico: fn é executada sobre o registro atual e o resultado
+// só é gravado se fn não retornar erro, de forma que duas validações
+// concorrentes nunca aceitem o mesmo código.
+//
+// fn pode ser executada mais de uma vez (o SQLStore a repete em caso de
+// conflito) e deve ser idempotente: toda variável externa que ela altera precisa
+// ser reiniciada no começo de cada execução, e efeitos fora do registro (como o
+// estado compartilhado) devem ficar para depois que Update retornar.
+type KeyStore interface {
+	Get(id string) (*KeyRecord, error)
+	Put(rec *KeyRecord) error
+	Update(id string, fn func(rec *KeyRecord) error) error
+	Delete(id string) error
+	List() ([]*KeyRecord, error)
+}
+
+// MemoryStore é um KeyStore em memória, útil para testes e instâncias únicas.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]*KeyRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]*KeyRecord{}}
+}
+
+func (s *MemoryStore) Get(id string) (*KeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return r.clone(), nil
+}
+
+func (s *MemoryStore) Put(rec *KeyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.ID] = rec.clone()
+	return nil
+}
+
+// Create grava rec se ainda não houver um registro com o mesmo ID.
+func (s *MemoryStore) Create(rec *KeyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[rec.ID]; ok {
+		return ErrKeyExists
+	}
+	s.records[rec.ID] = rec.clone()
+	return nil
+}
+
+func (s *MemoryStore) Update(id string, fn func(rec *KeyRecord) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	c := r.clone()
+	if err := fn(c); err != nil {
+		return err
+	}
+	c.ID = id
+	s.records[id] = c
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[id]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(s.records, id)
+	return nil
+}
+
+// DeleteIf remove o registro id se fn, chamada sobre ele, retornar nil.
+func (s *MemoryStore) DeleteIf(id string, fn func(rec *KeyRecord) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if err := fn(r.clone()); err != nil {
+		return err
+	}
+	delete(s.records, id)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]*KeyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedRecords(s.records), nil
+}
+
+// keyCreator é implementado por stores que gravam um registro novo de forma
+// atômica, sem sobrescrever um existente.
+type keyCreator interface {
+	Create(rec *KeyRecord) error
+}
+
+// createKey grava rec se o ID estiver livre e retorna ErrKeyExists caso
+// contrário. Stores sem Create recebem Get e Put, sem a mesma garantia.
+func createKey(store KeyStore, rec *KeyRecord) error {
+	if c, ok := store.(keyCreator); ok {
+		return c.Create(rec)
+	}
+	if _, err := store.Get(rec.ID); err != ErrKeyNotFound {
+		if err == nil {
+			err = ErrKeyExists
+		}
+		return err
+	}
+	return store.Put(rec)
+}
+
+// keyDeleter é implementado por stores que removem um registro de forma
+// atômica só depois de conferi-lo.
+type keyDeleter interface {
+	DeleteIf(id string, fn func(rec *KeyRecord) error) error
+}
+
+// deleteKeyIf remove id se fn aceitar o registro atual e retorna o erro de fn
+// caso contrário. Stores sem DeleteIf recebem Get e Delete, sem a mesma garantia.
+func deleteKeyIf(store KeyStore, id string, fn func(rec *KeyRecord) error) error {
+	if d, ok := store.(keyDeleter); ok {
+		return d.DeleteIf(id, fn)
+	}
+	rec, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := fn(rec); err != nil {
+		return err
+	}
+	return store.Delete(id)
+}
+
+// KeyFilter seleciona uma página de registros para ListKeys.
+type KeyFilter struct {
+	Issuer string   // apenas chaves deste emissor
+	State  KeyState // apenas chaves neste estado
+	After  string   // começa após este ID, o cursor da página anterior
+	Limit  int      // O padrão é 50.
+}
+
+func (f KeyFilter) match(rec *KeyRecord) bool {
+	return rec.ID > f.After &&
+		(f.Issuer == "" || strings.HasPrefix(rec.ID, f.Issuer+":")) &&
+		(f.State == "" || rec.State == f.State)
+}
+
+// keyPager é implementado por stores que filtram e paginam no próprio banco.
+type keyPager interface {
+	ListPage(f KeyFilter) ([]*KeyRecord, error)
+}
+
+// ListKeys retorna uma página de registros em ordem de ID e o cursor da
+// próxima página, vazio na última. Stores com ListPage, como o SQLStore,
+// filtram no banco; os demais são filtrados a partir de List.
+func ListKeys(store KeyStore, f KeyFilter) ([]*KeyRecord, string, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	want := f
+	want.Limit++ // um a mais para saber se há outra página
+
+	var (
+		recs []*KeyRecord
+		err  error
+	)
+	if p, ok := store.(keyPager); ok {
+		recs, err = p.ListPage(want)
+	} else {
+		var all []*KeyRecord
+		all, err = store.List()
+		sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+		for _, rec := range all {
+			if len(recs) == want.Limit {
+				break
+			}
+			if f.match(rec) {
+				recs = append(recs, rec)
+			}
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(recs) <= f.Limit {
+		return recs, "", nil
+	}
+	recs = recs[:f.Limit]
+	return recs, recs[f.Limit-1].ID, nil
+}
+
+func sortedRecords(m map[string]*KeyRecord) []*KeyRecord {
+	out := make([]*KeyRecord, 0, len(m))
+	for _, r := range m {
+		out = append(out, r.clone())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// FileStore é um KeyStore que grava todos os registros em um arquivo JSON.
+// Cada alteração reescreve o arquivo de forma atômica (arquivo temporário + rename).
+type FileStore struct {
+	mem  MemoryStore
+	path string
+}
+
+// NewFileStore abre o arquivo em path, criando um vazio se ele não existir.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, mem: MemoryStore{records: map[string]*KeyRecord{}}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.mem.records); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *FileStore) Get(id string) (*KeyRecord, error) {
+	return s.mem.Get(id)
+}
+
+func (s *FileStore) List() ([]*KeyRecord, error) {
+	return s.mem.List()
+}
+
+func (s *FileStore) Put(rec *KeyRecord) error {
+	return s.mutate(func(m map[string]*KeyRecord) error {
+		m[rec.ID] = rec.clone()
+		return nil
+	})
+}
+
+func (s *FileStore) Create(rec *KeyRecord) error {
+	return s.mutate(func(m map[string]*KeyRecord) error {
+		if _, ok := m[rec.ID]; ok {
+			return ErrKeyExists
+		}
+		m[rec.ID] = rec.clone()
+		return nil
+	})
+}
+
+func (s *FileStore) Update(id string, fn func(rec *KeyRecord) error) error {
+	return s.mutate(func(m map[string]*KeyRecord) error {
+		r, ok := m[id]
+		if !ok {
+			return ErrKeyNotFound
+		}
+		c := r.clone()
+		if err := fn(c); err != nil {
+			return err
+		}
+		c.ID = id
+		m[id] = c
+		return nil
+	})
+}
+
+func (s *FileStore) Delete(id string) error {
+	return s.mutate(func(m map[string]*KeyRecord) error {
+		if _, ok := m[id]; !ok {
+			return ErrKeyNotFound
+		}
+		delete(m, id)
+		return nil
+	})
+}
+
+func (s *FileStore) DeleteIf(id string, fn func(rec *KeyRecord) error) error {
+	return s.mutate(func(m map[string]*KeyRecord) error {
+		r, ok := m[id]
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if err := fn(r.clone()); err != nil {
+			return err
+		}
+		delete(m, id)
+		return nil
+	})
+}
+
+// mutate aplica fn em uma cópia dos registros e só a mantém se o arquivo foi gravado.
+func (s *FileStore) mutate(fn func(m map[string]*KeyRecord) error) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+
+	next := make(map[string]*KeyRecord, len(s.mem.records))
+	for id, r := range s.mem.records {
+		next[id] = r
+	}
+	if err := fn(next); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	s.mem.records = next
+	return nil
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKeyStore executa os mesmos cenários para qualquer implementação de KeyStore.
+func testKeyStore(t *testing.T, s KeyStore) {
+	now := time.Unix(1600000000, 0).UTC()
+	rec := &KeyRecord{
+		ID:        KeyID("Brisa", "matiasdias@gmail.com"),
+		URL:       `otpauth://totp/Brisa:matiasdias@gmail.com?secret=JBSWY3DPEHPK3PXP&issuer=Brisa`,
+		State:     KeyPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Minute),
+		Recovery:  &RecoveryCodes{Hashes: []string{"a", "b"}},
+		Devices:   []TrustedDevice{{ID: "d1", Hash: "h", ExpiresAt: now.Add(time.Hour)}},
+	}
+
+	_, err := s.Get(rec.ID)
+	require.Equal(t, ErrKeyNotFound, err, "Chave ainda não existe")
+	require.NoError(t, s.Put(rec), "Gravar registro")
+
+	got, err := s.Get(rec.ID)
+	require.NoError(t, err)
+	require.Equal(t, rec.URL, got.URL)
+	require.Equal(t, KeyPending, got.State)
+	require.True(t, now.Equal(got.CreatedAt))
+	require.Equal(t, []string{"a", "b"}, got.Recovery.Hashes)
+	require.Len(t, got.Devices, 1)
+	require.Equal(t, "h", got.Devices[0].Hash)
+
+	err = s.Update(rec.ID, func(r *KeyRecord) error {
+		r.State = KeyActive
+		r.LastStep = 42
+		return nil
+	})
+	require.NoError(t, err, "Atualizar registro")
+
+	err = s.Update(rec.ID, func(r *KeyRecord) error {
+		r.LastStep = 7
+		return ErrValidateInvalidCode
+	})
+	require.Equal(t, ErrValidateInvalidCode, err, "Erro de fn é repassado")
+
+	got, err = s.Get(rec.ID)
+	require.NoError(t, err)
+	require.Equal(t, KeyActive, got.State)
+	require.Equal(t, int64(42), got.LastStep, "Alteração com erro não pode ser gravada")
+
+	require.Equal(t, ErrKeyNotFound, s.Update("nada", func(r *KeyRecord) error { return nil }))
+
+	// Incrementos concorrentes não podem se perder.
+	// As goroutines só guardam o erro: require precisa da goroutine do teste.
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Update(rec.ID, func(r *KeyRecord) error {
+				r.Counter++
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, <-errs)
+	}
+	got, err = s.Get(rec.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), got.Counter)
+
+	require.NoError(t, s.Put(&KeyRecord{ID: "A:b", State: KeyActive}))
+	list, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "A:b", list[0].ID, "Lista ordenada por ID")
+
+	// Put sobre um registro existente o substitui, mesmo com gravações concorrentes.
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Put(&KeyRecord{ID: "A:b", State: KeyDisabled})
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-errs)
+	}
+	got, err = s.Get("A:b")
+	require.NoError(t, err)
+	require.Equal(t, KeyDisabled, got.State)
+
+	// deleteKeyIf só remove quando fn aceita o registro atual.
+	require.Equal(t, ErrKeyExists, deleteKeyIf(s, "A:b", func(r *KeyRecord) error {
+		if r.State != KeyPending {
+			return ErrKeyExists
+		}
+		return nil
+	}))
+	_, err = s.Get("A:b")
+	require.NoError(t, err, "Registro recusado por fn continua")
+	require.NoError(t, deleteKeyIf(s, "A:b", func(r *KeyRecord) error { return nil }))
+	require.Equal(t, ErrKeyNotFound, deleteKeyIf(s, "A:b", func(r *KeyRecord) error { return nil }))
+	require.NoError(t, s.Put(&KeyRecord{ID: "A:b", State: KeyDisabled}))
+
+	require.NoError(t, s.Delete("A:b"))
+	require.Equal(t, ErrKeyNotFound, s.Delete("A:b"))
+
+	// createKey não sobrescreve, nem com criações concorrentes.
+	require.Equal(t, ErrKeyExists, createKey(s, &KeyRecord{ID: rec.ID, State: KeyPending}))
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- createKey(s, &KeyRecord{ID: "A:c", State: KeyActive})
+		}()
+	}
+	wg.Wait()
+	created := 0
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			require.Equal(t, ErrKeyExists, err)
+		} else {
+			created++
+		}
+	}
+	require.Equal(t, 1, created)
+	require.NoError(t, s.Delete("A:c"))
+}
+
+// testListKeys confere filtros e paginação de ListKeys sobre s vazio.
+func testListKeys(t *testing.T, s KeyStore) {
+	for _, id := range []string{"Brisa:ana", "Brisa:bia", "Brisa:caio", "Brisas:dani", "Outro:eva"} {
+		issuer, account, _ := strings.Cut(id, ":")
+		state := KeyActive
+		if account == "bia" {
+			state = KeyPending
+		}
+		require.NoError(t, s.Put(&KeyRecord{ID: id, URL: "otpauth://totp/" + id + "?secret=JBSWY3DPEHPK3PXP&issuer=" + issuer, State: state}))
+	}
+	ids := func(recs []*KeyRecord) []string {
+		var out []string
+		for _, r := range recs {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+
+	recs, next, err := ListKeys(s, KeyFilter{Issuer: "Brisa", Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Brisa:ana", "Brisa:bia"}, ids(recs))
+	require.Equal(t, "Brisa:bia", next)
+	recs, next, err = ListKeys(s, KeyFilter{Issuer: "Brisa", Limit: 2, After: next})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Brisa:caio"}, ids(recs), "Brisas não é Brisa")
+	require.Empty(t, next)
+
+	recs, _, err = ListKeys(s, KeyFilter{State: KeyPending})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Brisa:bia"}, ids(recs))
+	recs, next, err = ListKeys(s, KeyFilter{})
+	require.NoError(t, err)
+	require.Len(t, recs, 5)
+	require.Empty(t, next)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testKeyStore(t, NewMemoryStore())
+	testListKeys(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+	testKeyStore(t, s)
+
+	s, err = NewFileStore(path)
+	require.NoError(t, err, "Reabrir o arquivo")
+	got, err := s.Get(KeyID("Brisa", "matiasdias@gmail.com"))
+	require.NoError(t, err)
+	require.Equal(t, KeyActive, got.State, "Estado persistido no arquivo")
+	require.Equal(t, uint64(20), got.Counter)
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"time"
+)
+
+var ErrValidateThrottled = newError("validate.throttled", KindResourceExhausted)
+
+// ThrottleOtp fornece os limites de tentativas inválidas antes do bloqueio.
+type ThrottleOtp struct {
+	MaxFailures uint          // Falhas seguidas até bloquear. O padrão é 5.
+	Lockout     time.Duration // Duração do bloqueio. O padrão é 15 minutos.
+}
+
+// Throttle guarda o estado de tentativas inválidas de uma conta ou conjunto de códigos.
+type Throttle struct {
+	Failures    uint
+	LockedUntil time.Time
+}
+
+func (o ThrottleOtp) defaults() ThrottleOtp {
+	if o.MaxFailures == 0 {
+		o.MaxFailures = 5
+	}
+	if o.Lockout == 0 {
+		o.Lockout = 15 * time.Minute
+	}
+	return o
+}
+
+// Allow retorna ErrValidateThrottled enquanto o bloqueio estiver ativo em t.
+func (th *Throttle) Allow(t time.Time) error {
+	if t.Before(th.LockedUntil) {
+		return ErrValidateThrottled
+	}
+	return nil
+}
+
+// Fail registra uma tentativa inválida e retorna true se ela causou um bloqueio.
+func (th *Throttle) Fail(t time.Time, otp ThrottleOtp) bool {
+	otp = otp.defaults()
+	th.Failures++
+	if th.Failures < otp.MaxFailures {
+		return false
+	}
+	th.Failures = 0
+	th.LockedUntil = t.Add(otp.Lockout)
+	return true
+}
+
+// Reset limpa as falhas após uma validação com sucesso ou desbloqueio manual.
+func (th *Throttle) Reset() {
+	th.Failures = 0
+	th.LockedUntil = time.Time{}
+}
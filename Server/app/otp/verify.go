@@ -0,0 +1,274 @@
+package app
+
+import (
+	"time"
+)
+
+var ErrValidateInvalidCode = newError("validate.invalid_code", KindUnauthenticated)
+var ErrValidateReplayed = newError("validate.replayed", KindUnauthenticated)
+var ErrKeyUnknownType = newError("key.unknown_type", KindInvalidArgument)
+var ErrKeyNotActive = newError("key.not_active", KindFailedPrecondition)
+
+// VerifyOtp fornece opções para validar um código contra um KeyRecord.
+type VerifyOtp struct {
+	Skew      uint // Passos TOTP aceitos antes e depois do atual.
+	LookAhead uint // Contadores HOTP aceitos à frente do esperado.
+	Throttle  ThrottleOtp
+}
+
+// Match descreve como um código foi aceito.
+type Match struct {
+	Method Method
+	Offset int // desvio em passos (TOTP) ou contadores à frente (HOTP)
+	Secret SecretSlot
+}
+
+// ValidateRecord valida um código usando os parâmetros da chave guardada em rec.
+// Em caso de sucesso o estado anti-reuso (LastStep ou Counter) e LastUsedAt são
+// atualizados em rec; cabe a quem chama gravar o registro.
+// Durante uma rotação os códigos do segredo novo também são aceitos.
+func ValidateRecord(passcode string, rec *KeyRecord, t time.Time, otp VerifyOtp) (Match, bool, error) {
+	if rec.NextURL != "" && !t.Before(rec.GraceUntil) {
+		rec.promote()
+	}
+
+	key, err := rec.Key()
+	if err != nil {
+		return Match{}, false, err
+	}
+	m, ok, err := validateKey(passcode, key, rec, t, otp)
+	if ok || err != nil || rec.NextURL == "" {
+		m.Secret = SecretCurrent
+		return m, ok, err
+	}
+
+	return validateNext(passcode, rec, t, otp)
+}
+
+func validateKey(passcode string, key *Key, rec *KeyRecord, t time.Time, otp VerifyOtp) (Match, bool, error) {
+	opts := ValidateOtps{
+		Digits:    key.Digits(),
+		Algorithm: key.Algorithm(),
+	}
+
+	switch key.Type() {
+	case "totp":
+		counter := t.Unix() / int64(key.Period())
+		for _, off := range skewOffsets(otp.Skew) {
+			step := counter + int64(off)
+			ok, err := ValidateCustom(passcode, uint64(step), key.Secret(), opts)
+			if err != nil {
+				return Match{}, false, err
+			}
+			if !ok {
+				continue
+			}
+			if step <= rec.LastStep {
+				return Match{}, false, ErrValidateReplayed
+			}
+			rec.LastStep = step
+			rec.LastUsedAt = t
+			return Match{Method: MethodTOTP, Offset: off}, true, nil
+		}
+
+	case "hotp":
+		for i := uint64(0); i <= uint64(otp.LookAhead); i++ {
+			ok, err := ValidateCustom(passcode, rec.Counter+i, key.Secret(), opts)
+			if err != nil {
+				return Match{}, false, err
+			}
+			if ok {
+				rec.Counter += i + 1
+				rec.LastUsedAt = t
+				return Match{Method: MethodHOTP, Offset: int(i)}, true, nil
+			}
+		}
+
+	default:
+		return Match{}, false, ErrKeyUnknownType
+	}
+
+	return Match{}, false, nil
+}
+
+// skewOffsets retorna 0, 1, -1, 2, -2... para testar primeiro o passo atual.
+func skewOffsets(skew uint) []int {
+	offs := []int{0}
+	for i := 1; i <= int(skew); i++ {
+		offs = append(offs, i, -i)
+	}
+	return offs
+}
+
+// Verifier valida códigos de chaves ativas guardadas em um KeyStore,
+// aplicando o bloqueio por tentativas e a proteção contra reuso.
+type Verifier struct {
+	store   KeyStore
+	otp     VerifyOtp
+	shared  SharedState
+	audit   *Auditor
+	metrics *Metrics
+}
+
+func NewVerifier(store KeyStore, otp VerifyOtp) *Verifier {
+	return &Verifier{store: store, otp: otp}
+}
+
+// UseShared faz o Verifier também consultar st para reuso de códigos e falhas,
+// necessário quando várias instâncias validam as mesmas contas.
+func (v *Verifier) UseShared(st SharedState) {
+	v.shared = st
+}
+
+// UseAuditor faz o Verifier registrar validações, bloqueios, rotações e remoções em a.
+func (v *Verifier) UseAuditor(a *Auditor) {
+	v.audit = a
+}
+
+// UseMetrics faz o Verifier contar validações, reusos e bloqueios em m.
+func (v *Verifier) UseMetrics(m *Metrics) {
+	v.metrics = m
+}
+
+// Verify valida o código da chave id no tempo t.
+// Retorna ErrValidateInvalidCode se o código não confere e ErrValidateReplayed
+// se ele já foi usado.
+func (v *Verifier) Verify(id string, passcode string, t time.Time) (Match, error) {
+	m, info, err := v.verify(id, passcode, t)
+	v.metrics.verified(info.algorithm, m, err)
+	v.audit.Record(AuditEntry{
+		Time:    t,
+		Event:   AuditVerify,
+		Account: id,
+		Success: err == nil,
+		Method:  m.Method,
+		Offset:  m.Offset,
+		Secret:  m.Secret,
+		Error:   auditError(err),
+	})
+	if info.locked {
+		v.metrics.lockedOut("verify")
+		v.audit.Record(AuditEntry{Time: t, Event: AuditLockout, Account: id, Success: true})
+	}
+	return m, err
+}
+
+// verifyInfo é o que verify sabe além do Match, para auditoria e métricas.
+type verifyInfo struct {
+	locked    bool   // a falha causou o bloqueio da conta
+	algorithm string // algoritmo da chave, vazio se ela não foi lida
+}
+
+func (v *Verifier) verify(id string, passcode string, t time.Time) (Match, verifyInfo, error) {
+	throttle := v.otp.Throttle.defaults()
+	// A tentativa é contada no estado compartilhado antes da validação, num
+	// único INCR: consultar e depois somar deixaria instâncias concorrentes
+	// passarem do limite. Um acerto zera o contador.
+	var shared uint
+	if v.shared != nil {
+		n, err := v.shared.Fail(id, throttle.Lockout)
+		if err != nil {
+			return Match{}, verifyInfo{}, err
+		}
+		if n > throttle.MaxFailures {
+			return Match{}, verifyInfo{}, ErrValidateThrottled
+		}
+		shared = n
+	}
+
+	var (
+		m      Match
+		result error
+		info   verifyInfo
+		step   int64
+		period uint64
+	)
+	err := v.store.Update(id, func(rec *KeyRecord) error {
+		m, result, info, step, period = Match{}, nil, verifyInfo{}, 0, 0
+		if rec.State != KeyActive {
+			return ErrKeyNotActive
+		}
+		if k, err := rec.Key(); err == nil {
+			info.algorithm = k.Algorithm().String()
+			period = k.Period()
+		}
+		if err := rec.Throttle.Allow(t); err != nil {
+			return err
+		}
+
+		var (
+			ok  bool
+			err error
+		)
+		start := time.Now()
+		m, ok, err = ValidateRecord(passcode, rec, t, v.otp)
+		v.metrics.observeValidate("ValidateRecord", start)
+		switch {
+		case err == ErrValidateReplayed:
+			result = err
+		case err != nil:
+			return err
+		case !ok:
+			result = ErrValidateInvalidCode
+		}
+
+		// A falha precisa ser gravada, por isso fn não retorna o erro.
+		if result != nil {
+			info.locked = rec.Throttle.Fail(t, v.otp.Throttle)
+			return nil
+		}
+		step = rec.LastStep
+		rec.Throttle.Reset()
+		return nil
+	})
+	if err != nil {
+		return Match{}, info, err
+	}
+
+	if result == nil && m.Method == MethodTOTP && v.shared != nil {
+		// O passo só é marcado depois que o registro foi gravado: feito dentro
+		// de fn, uma nova execução ou uma gravação que falhasse recusaria o
+		// próprio código como reutilizado.
+		fresh, err := v.markUsed(id, step, period)
+		if err != nil {
+			return Match{}, info, err
+		}
+		if !fresh {
+			result = ErrValidateReplayed
+			err = v.store.Update(id, func(rec *KeyRecord) error {
+				info.locked = rec.Throttle.Fail(t, v.otp.Throttle)
+				return nil
+			})
+			if err != nil {
+				return Match{}, info, err
+			}
+		}
+	}
+
+	if v.shared != nil {
+		if result != nil {
+			info.locked = info.locked || shared == throttle.MaxFailures
+		} else if err := v.shared.Reset(id); err != nil {
+			return Match{}, info, err
+		}
+	}
+
+	if result != nil {
+		return Match{}, info, result
+	}
+	return m, info, nil
+}
+
+// markUsed registra no estado compartilhado o passo aceito. O passo fica
+// guardado enquanto ainda poderia ser aceito por causa do Skew.
+func (v *Verifier) markUsed(id string, step int64, period uint64) (bool, error) {
+	ttl := time.Duration(period*uint64(2*v.otp.Skew+2)) * time.Second
+	return v.shared.MarkUsed(id, step, ttl)
+}
+
+// Delete remove a chave id. actor identifica quem pediu a remoção na auditoria.
+func (v *Verifier) Delete(id string, actor string, t time.Time) error {
+	err := v.store.Delete(id)
+	v.audit.Record(AuditEntry{Time: t, Event: AuditDelete, Account: id, Actor: actor, Success: err == nil, Error: auditError(err)})
+	return err
+}
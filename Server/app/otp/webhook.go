@@ -0,0 +1,657 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrWebhookInvalid = newError("webhook.invalid", KindInvalidArgument)
+var ErrWebhookNotFound = newError("webhook.not_found", KindNotFound)
+
+var (
+	webhookSubsBucket  = []byte("webhook_subscriptions")
+	webhookQueueBucket = []byte("webhook_queue")
+	webhookDeadBucket  = []byte("webhook_dead")
+)
+
+// WebhookSecurityEvents são os eventos de interesse de um SOC: novos
+// dispositivos, bloqueios e uso de códigos de recuperação.
+var WebhookSecurityEvents = []AuditEvent{AuditEnroll, AuditDeviceTrust, AuditLockout, AuditRecovery}
+
+// WebhookOtp fornece opções para Webhooks.
+type WebhookOtp struct {
+	MinBackoff  time.Duration // Espera após a primeira falha, dobrada a cada nova falha. O padrão é 10 segundos.
+	MaxBackoff  time.Duration // O padrão é 1 hora.
+	MaxAttempts uint          // Tentativas antes de ir para a lista de mortos. O padrão é 12.
+	Client      *http.Client  // O padrão tem timeout de 10 segundos.
+	Logger      *slog.Logger  // Recebe os erros de Run. O padrão é slog.Default().
+}
+
+func (o WebhookOtp) defaults() WebhookOtp {
+	if o.MinBackoff == 0 {
+		o.MinBackoff = 10 * time.Second
+	}
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = time.Hour
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 12
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	return o
+}
+
+// WebhookSubscription é um destino de webhooks. Sem Events recebe todos os
+// eventos de auditoria. Secret só é retornado por Subscribe.
+type WebhookSubscription struct {
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	Secret    string       `json:"secret,omitempty"`
+	Events    []AuditEvent `json:"events,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+func (s WebhookSubscription) wants(e AuditEvent) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, x := range s.Events {
+		if x == e {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent é o corpo JSON enviado. ID é o mesmo em todas as tentativas,
+// para o receptor descartar repetições.
+type WebhookEvent struct {
+	ID      string     `json:"id"`
+	Time    time.Time  `json:"time"`
+	Event   AuditEvent `json:"event"`
+	Account string     `json:"account"`
+	Actor   string     `json:"actor,omitempty"`
+	Success bool       `json:"success"`
+	Method  Method     `json:"method,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// WebhookDelivery é um evento a entregar a uma assinatura, na fila ou na
+// lista de mortos.
+type WebhookDelivery struct {
+	Seq          uint64       `json:"seq"`
+	Subscription string       `json:"subscription"`
+	Event        WebhookEvent `json:"event"`
+	Attempts     uint         `json:"attempts"`
+	NextAt       time.Time    `json:"next_at"`
+	LastError    string       `json:"last_error,omitempty"`
+}
+
+// Webhooks envia eventos de auditoria para URLs externas. É um destino de
+// auditoria (use com NewAuditor) que grava cada evento em uma fila no arquivo
+// bbolt em path, de onde Run os entrega. Assim os eventos sobrevivem a
+// reinícios e a receptores fora do ar.
+//
+// Cada POST leva o WebhookEvent em JSON e os cabeçalhos X-Webhook-ID,
+// X-Webhook-Event, X-Webhook-Timestamp (segundos Unix do envio) e X-Signature
+// ("sha256=" e o HMAC-SHA256 de "timestamp.corpo" com o segredo da
+// assinatura, ver VerifyWebhook). Falhas são repetidas com espera exponencial; após MaxAttempts a entrega vai para a lista de mortos, de onde
+// pode ser reenviada com Redeliver.
+type Webhooks struct {
+	db   *bolt.DB
+	otp  WebhookOtp
+	now  func() time.Time
+	wake chan struct{}
+}
+
+// OpenWebhooks abre ou cria a fila em path. Não use o mesmo arquivo de um BoltStore.
+func OpenWebhooks(path string, otp WebhookOtp) (*Webhooks, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{webhookSubsBucket, webhookQueueBucket, webhookDeadBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Webhooks{db: db, otp: otp.defaults(), now: time.Now, wake: make(chan struct{}, 1)}, nil
+}
+
+func (w *Webhooks) Close() error {
+	return w.db.Close()
+}
+
+// Subscribe cria uma assinatura. Sem s.Secret um segredo aleatório é gerado;
+// ele vem no retorno e não pode ser lido depois.
+func (w *Webhooks) Subscribe(s WebhookSubscription) (WebhookSubscription, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return WebhookSubscription{}, ErrWebhookInvalid
+	}
+	for _, e := range s.Events {
+		if strings.TrimSpace(string(e)) == "" {
+			return WebhookSubscription{}, ErrWebhookInvalid
+		}
+	}
+	id, err := webhookRandom(8)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	if s.Secret == "" {
+		if s.Secret, err = webhookRandom(32); err != nil {
+			return WebhookSubscription{}, err
+		}
+	}
+	s.ID = id
+	s.CreatedAt = w.now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	err = w.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookSubsBucket).Put([]byte(s.ID), data)
+	})
+	return s, err
+}
+
+// Subscriptions retorna as assinaturas, sem os segredos.
+func (w *Webhooks) Subscriptions() ([]WebhookSubscription, error) {
+	subs, err := w.subscriptions()
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return subs, err
+}
+
+func (w *Webhooks) subscriptions() ([]WebhookSubscription, error) {
+	out := []WebhookSubscription{}
+	err := w.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookSubsBucket).ForEach(func(k, v []byte) error {
+			var s WebhookSubscription
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			out = append(out, s)
+			return nil
+		})
+	})
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, err
+}
+
+// Unsubscribe remove a assinatura id e as entregas pendentes para ela.
+func (w *Webhooks) Unsubscribe(id string) error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookSubsBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrWebhookNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		q := tx.Bucket(webhookQueueBucket)
+		var drop [][]byte
+		err := q.ForEach(func(k, v []byte) error {
+			var d WebhookDelivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.Subscription == id {
+				drop = append(drop, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range drop {
+			if err := q.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (w *Webhooks) Enabled(context.Context, slog.Level) bool { return true }
+func (w *Webhooks) WithAttrs([]slog.Attr) slog.Handler       { return w }
+func (w *Webhooks) WithGroup(string) slog.Handler            { return w }
+
+func (w *Webhooks) Handle(ctx context.Context, r slog.Record) error {
+	var e AuditEntry
+	callbackHandler(func(x AuditEntry) { e = x }).Handle(ctx, r)
+	return w.Publish(e)
+}
+
+// Publish enfileira e para cada assinatura interessada. Sem nenhuma, retorna
+// sem abrir uma transação de escrita: Handle roda a cada evento de auditoria e
+// cada commit do bbolt é um fsync.
+func (w *Webhooks) Publish(e AuditEntry) error {
+	all, err := w.subscriptions()
+	if err != nil {
+		return err
+	}
+	var subs []WebhookSubscription
+	for _, s := range all {
+		if s.wants(e.Event) {
+			subs = append(subs, s)
+		}
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+
+	id, err := webhookRandom(16)
+	if err != nil {
+		return err
+	}
+	ev := WebhookEvent{ID: id, Time: e.Time, Event: e.Event, Account: e.Account, Actor: e.Actor, Success: e.Success, Method: e.Method, Error: e.Error}
+	if ev.Time.IsZero() {
+		ev.Time = w.now()
+	}
+	err = w.db.Update(func(tx *bolt.Tx) error {
+		q := tx.Bucket(webhookQueueBucket)
+		for _, s := range subs {
+			seq, err := q.NextSequence()
+			if err != nil {
+				return err
+			}
+			d := WebhookDelivery{Seq: seq, Subscription: s.ID, Event: ev, NextAt: w.now()}
+			if err := webhookPut(q, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// Run entrega a fila até ctx terminar. Erros ao ler ou gravar a fila são
+// registrados em WebhookOtp.Logger e a entrega é repetida após uma espera.
+func (w *Webhooks) Run(ctx context.Context) error {
+	var failures uint
+	for {
+		next, err := w.deliverDue(ctx, w.now())
+		wake := w.wake
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			failures++
+			w.otp.Logger.Error("webhooks: falha ao entregar a fila", "error", err, "failures", failures)
+			// Durante a espera nem Publish acorda o laço.
+			next, wake = w.now().Add(w.backoff(failures)), nil
+		default:
+			failures = 0
+		}
+		// Sem entregas pendentes, só Publish e Redeliver acordam o laço.
+		timer := time.NewTimer(time.Hour)
+		if !next.IsZero() {
+			timer.Reset(next.Sub(w.now()))
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue tenta as entregas vencidas em t e retorna quando vence a próxima.
+func (w *Webhooks) deliverDue(ctx context.Context, t time.Time) (time.Time, error) {
+	var (
+		due  []WebhookDelivery
+		bad  = map[string]error{}
+		subs = map[string]WebhookSubscription{}
+	)
+	all, err := w.subscriptions()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, s := range all {
+		subs[s.ID] = s
+	}
+	err = w.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).ForEach(func(k, v []byte) error {
+			var d WebhookDelivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				bad[string(k)] = err
+				return nil
+			}
+			if !t.Before(d.NextAt) {
+				due = append(due, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(bad) > 0 {
+		// Entradas ilegíveis não têm como ser entregues nem podem travar a fila.
+		err = w.db.Update(func(tx *bolt.Tx) error {
+			q := tx.Bucket(webhookQueueBucket)
+			for k, decodeErr := range bad {
+				if err := q.Delete([]byte(k)); err != nil {
+					return err
+				}
+				d := WebhookDelivery{NextAt: t, LastError: "entrada ilegível: " + decodeErr.Error()}
+				if len(k) == 8 {
+					d.Seq = binary.BigEndian.Uint64([]byte(k))
+				}
+				if err := webhookPut(tx.Bucket(webhookDeadBucket), d); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return time.Time{}, ctx.Err()
+		}
+		s, ok := subs[d.Subscription]
+		var sendErr error
+		if ok {
+			sendErr = w.send(ctx, s, d)
+		}
+		err := w.db.Update(func(tx *bolt.Tx) error {
+			q := tx.Bucket(webhookQueueBucket)
+			k := webhookKey(d.Seq)
+			if q.Get(k) == nil {
+				return nil // removida por Unsubscribe
+			}
+			if !ok || sendErr == nil {
+				return q.Delete(k)
+			}
+			d.Attempts++
+			d.LastError = sendErr.Error()
+			if d.Attempts >= w.otp.MaxAttempts {
+				if err := q.Delete(k); err != nil {
+					return err
+				}
+				return webhookPut(tx.Bucket(webhookDeadBucket), d)
+			}
+			d.NextAt = t.Add(w.backoff(d.Attempts))
+			return webhookPut(q, d)
+		})
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	var next time.Time
+	err = w.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).ForEach(func(k, v []byte) error {
+			var d WebhookDelivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				next = t // ilegível: vai para os mortos na próxima passada
+				return nil
+			}
+			if next.IsZero() || d.NextAt.Before(next) {
+				next = d.NextAt
+			}
+			return nil
+		})
+	})
+	return next, err
+}
+
+// backoff é a espera após a n-ésima falha.
+func (w *Webhooks) backoff(n uint) time.Duration {
+	d := w.otp.MinBackoff
+	for i := uint(1); i < n && d < w.otp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > w.otp.MaxBackoff {
+		d = w.otp.MaxBackoff
+	}
+	return d
+}
+
+func (w *Webhooks) send(ctx context.Context, s WebhookSubscription, d WebhookDelivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", d.Event.ID)
+	req.Header.Set("X-Webhook-Event", string(d.Event.Event))
+	ts := strconv.FormatInt(w.now().Unix(), 10)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Signature", signBody([]byte(s.Secret), webhookSigned(ts, body)))
+	resp, err := w.otp.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// WebhookTolerance é a maior diferença entre X-Webhook-Timestamp e o relógio
+// do receptor aceita por VerifyWebhook.
+const WebhookTolerance = 5 * time.Minute
+
+// VerifyWebhook confere a assinatura X-Signature de um webhook recebido em t,
+// com o X-Webhook-Timestamp dado. Entregas com o horário fora de
+// WebhookTolerance são recusadas, para que uma entrega capturada não possa
+// ser reenviada depois; dentro dela, descarte IDs repetidos (X-Webhook-ID).
+func VerifyWebhook(secret, body []byte, timestamp, signature string, t time.Time) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := t.Sub(time.Unix(unix, 0)); d > WebhookTolerance || d < -WebhookTolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(signBody(secret, webhookSigned(timestamp, body))))
+}
+
+// webhookSigned é o conteúdo assinado de uma entrega: o horário, um ponto e o corpo.
+func webhookSigned(timestamp string, body []byte) []byte {
+	return append([]byte(timestamp+"."), body...)
+}
+
+// DeadLetters retorna as entregas que esgotaram as tentativas.
+func (w *Webhooks) DeadLetters() ([]WebhookDelivery, error) {
+	out := []WebhookDelivery{}
+	err := w.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookDeadBucket).ForEach(func(k, v []byte) error {
+			var d WebhookDelivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			out = append(out, d)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// Redeliver devolve a entrega seq da lista de mortos à fila, com as tentativas zeradas.
+func (w *Webhooks) Redeliver(seq uint64) error {
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(webhookDeadBucket)
+		v := dead.Get(webhookKey(seq))
+		if v == nil {
+			return ErrWebhookNotFound
+		}
+		var d WebhookDelivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		if err := dead.Delete(webhookKey(seq)); err != nil {
+			return err
+		}
+		d.Attempts, d.NextAt = 0, w.now()
+		return webhookPut(tx.Bucket(webhookQueueBucket), d)
+	})
+	if err == nil {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// Discard apaga a entrega seq da lista de mortos.
+func (w *Webhooks) Discard(seq uint64) error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(webhookDeadBucket)
+		if dead.Get(webhookKey(seq)) == nil {
+			return ErrWebhookNotFound
+		}
+		return dead.Delete(webhookKey(seq))
+	})
+}
+
+// ServeHTTP é a API de administração das assinaturas. Não há autenticação
+// própria: monte-a atrás da autenticação dos administradores.
+//
+//	GET    /subscriptions       lista as assinaturas
+//	POST   /subscriptions       {"url": ..., "events": [...], "secret": ...} cria e retorna o segredo
+//	DELETE /subscriptions/{id}  remove
+//	GET    /dead                lista a fila de mortos
+//	POST   /dead/{seq}          reenvia
+//	DELETE /dead/{seq}          descarta
+func (w *Webhooks) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	lang := r.Header.Get("Accept-Language")
+	fail := func(err error) {
+		http.Error(rw, Localize(err, lang), HTTPStatus(err))
+	}
+	reply := func(status int, v any) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(v)
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	collection, item, _ := strings.Cut(path, "/")
+	switch {
+	case collection == "subscriptions" && item == "" && r.Method == http.MethodGet:
+		subs, err := w.Subscriptions()
+		if err != nil {
+			fail(err)
+			return
+		}
+		reply(http.StatusOK, subs)
+	case collection == "subscriptions" && item == "" && r.Method == http.MethodPost:
+		var s WebhookSubscription
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&s); err != nil {
+			fail(ErrWebhookInvalid)
+			return
+		}
+		s, err := w.Subscribe(s)
+		if err != nil {
+			fail(err)
+			return
+		}
+		reply(http.StatusCreated, s)
+	case collection == "subscriptions" && item != "" && r.Method == http.MethodDelete:
+		if err := w.Unsubscribe(item); err != nil {
+			fail(err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	case collection == "dead" && item == "" && r.Method == http.MethodGet:
+		dead, err := w.DeadLetters()
+		if err != nil {
+			fail(err)
+			return
+		}
+		reply(http.StatusOK, dead)
+	case collection == "dead" && item != "" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		seq, err := strconv.ParseUint(item, 10, 64)
+		if err != nil {
+			fail(ErrWebhookNotFound)
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = w.Redeliver(seq)
+		} else {
+			err = w.Discard(seq)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	case collection == "subscriptions" || collection == "dead":
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func webhookKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+func webhookPut(b *bolt.Bucket, d WebhookDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return b.Put(webhookKey(d.Seq), data)
+}
+
+func webhookRandom(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,292 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// webhookReceiver é um receptor de webhooks que confere a assinatura e pode
+// ser posto para falhar.
+type webhookReceiver struct {
+	mu     sync.Mutex
+	secret string
+	at     time.Time // relógio do receptor
+	fail   bool
+	events []WebhookEvent
+}
+
+func (h *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	if h.fail {
+		http.Error(w, "", http.StatusServiceUnavailable)
+		return
+	}
+	if !VerifyWebhook([]byte(h.secret), body, r.Header.Get("X-Webhook-Timestamp"), r.Header.Get("X-Signature"), h.at) {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	var e WebhookEvent
+	if err := json.Unmarshal(body, &e); err != nil || r.Header.Get("X-Webhook-ID") != e.ID {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	h.events = append(h.events, e)
+}
+
+func (h *webhookReceiver) received() []WebhookEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]WebhookEvent(nil), h.events...)
+}
+
+func TestWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.db")
+	opts := WebhookOtp{MinBackoff: 10 * time.Second, MaxAttempts: 3}
+	w, err := OpenWebhooks(path, opts)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0).UTC()
+	w.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	soc := &webhookReceiver{at: now}
+	socSrv := httptest.NewServer(soc)
+	defer socSrv.Close()
+	down := &webhookReceiver{secret: "segredo", at: now, fail: true}
+	downSrv := httptest.NewServer(down)
+	defer downSrv.Close()
+
+	_, err = w.Subscribe(WebhookSubscription{URL: "ftp://example.com"})
+	require.ErrorIs(t, err, ErrWebhookInvalid)
+	s1, err := w.Subscribe(WebhookSubscription{URL: socSrv.URL, Events: WebhookSecurityEvents})
+	require.NoError(t, err)
+	require.Len(t, s1.Secret, 64, "Segredo gerado")
+	soc.secret = s1.Secret
+	s2, err := w.Subscribe(WebhookSubscription{URL: downSrv.URL, Secret: "segredo"})
+	require.NoError(t, err)
+	subs, err := w.Subscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Empty(t, subs[0].Secret)
+
+	// Eventos chegam pelo Auditor. Só a segunda assinatura quer "verify".
+	audit := NewAuditor(w)
+	audit.Record(AuditEntry{Time: now, Event: AuditLockout, Account: "Brisa:ana", Success: true})
+	audit.Record(AuditEntry{Time: now, Event: AuditVerify, Account: "Brisa:ana", Method: MethodTOTP, Success: true})
+
+	next, err := w.deliverDue(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(10*time.Second), next)
+	got := soc.received()
+	require.Len(t, got, 1)
+	require.Equal(t, AuditLockout, got[0].Event)
+	require.Equal(t, "Brisa:ana", got[0].Account)
+
+	// A fila sobrevive a um reinício.
+	require.NoError(t, w.Close())
+	w, err = OpenWebhooks(path, opts)
+	require.NoError(t, err)
+	defer w.Close()
+	w.now = func() time.Time { return now }
+	next, err = w.deliverDue(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(10*time.Second), next, "Ainda não venceu")
+
+	// Espera exponencial até a lista de mortos.
+	now = now.Add(10 * time.Second)
+	next, err = w.deliverDue(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(20*time.Second), next)
+	now = next
+	next, err = w.deliverDue(ctx, now)
+	require.NoError(t, err)
+	require.True(t, next.IsZero(), "Fila vazia")
+	dead, err := w.DeadLetters()
+	require.NoError(t, err)
+	require.Len(t, dead, 2)
+	require.Equal(t, s2.ID, dead[0].Subscription)
+	require.Equal(t, uint(3), dead[0].Attempts)
+	require.Equal(t, "status 503", dead[0].LastError)
+
+	// Reenvio manual depois que o receptor volta.
+	down.mu.Lock()
+	down.fail = false
+	down.mu.Unlock()
+	require.NoError(t, w.Redeliver(dead[0].Seq))
+	require.NoError(t, w.Discard(dead[1].Seq))
+	require.ErrorIs(t, w.Discard(dead[1].Seq), ErrWebhookNotFound)
+	_, err = w.deliverDue(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, down.received(), 1)
+	dead, err = w.DeadLetters()
+	require.NoError(t, err)
+	require.Empty(t, dead)
+
+	// Run entrega assim que o evento é publicado.
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- w.Run(runCtx) }()
+	require.NoError(t, w.Publish(AuditEntry{Event: AuditRecovery, Account: "Brisa:bia", Success: true}))
+	require.Eventually(t, func() bool { return len(soc.received()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, AuditRecovery, soc.received()[1].Event)
+	cancel()
+	require.NoError(t, <-done)
+
+	require.NoError(t, w.Unsubscribe(s2.ID))
+	require.ErrorIs(t, w.Unsubscribe(s2.ID), ErrWebhookNotFound)
+	require.Equal(t, 20*time.Second, w.backoff(2))
+	require.Equal(t, time.Hour, w.backoff(50))
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	secret := []byte("segredo")
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"1","event":"lockout"}`)
+	ts := "1700000000"
+	sig := signBody(secret, webhookSigned(ts, body))
+
+	require.True(t, VerifyWebhook(secret, body, ts, sig, now.Add(time.Minute)))
+	require.False(t, VerifyWebhook(secret, body, ts, sig, now.Add(WebhookTolerance+time.Second)), "Entrega antiga reenviada")
+	require.False(t, VerifyWebhook(secret, body, "1700000100", sig, now), "Horário trocado")
+	require.False(t, VerifyWebhook(secret, append(body, ' '), ts, sig, now), "Corpo alterado")
+	require.False(t, VerifyWebhook(secret, body, "", sig, now))
+	require.False(t, VerifyWebhook(secret, body, ts, signBody(secret, body), now), "Assinatura só do corpo")
+}
+
+func TestWebhooksPublishSkipsWrite(t *testing.T) {
+	w, err := OpenWebhooks(filepath.Join(t.TempDir(), "webhooks.db"), WebhookOtp{})
+	require.NoError(t, err)
+	defer w.Close()
+	txid := func() int {
+		var id int
+		require.NoError(t, w.db.View(func(tx *bolt.Tx) error {
+			id = tx.ID()
+			return nil
+		}))
+		return id
+	}
+
+	// Eventos que nenhuma assinatura quer não custam um commit no disco.
+	before := txid()
+	require.NoError(t, w.Publish(AuditEntry{Event: AuditVerify, Account: "Brisa:ana", Success: true}))
+	require.Equal(t, before, txid(), "Sem assinaturas")
+	_, err = w.Subscribe(WebhookSubscription{URL: "https://soc.example.com/otp", Events: []AuditEvent{AuditLockout}})
+	require.NoError(t, err)
+	before = txid()
+	require.NoError(t, w.Publish(AuditEntry{Event: AuditVerify, Account: "Brisa:ana", Success: true}))
+	require.Equal(t, before, txid())
+	require.NoError(t, w.Publish(AuditEntry{Event: AuditLockout, Account: "Brisa:ana", Success: true}))
+	require.Equal(t, before+1, txid())
+}
+
+func TestWebhooksUndecodable(t *testing.T) {
+	w, err := OpenWebhooks(filepath.Join(t.TempDir(), "webhooks.db"), WebhookOtp{})
+	require.NoError(t, err)
+	defer w.Close()
+	now := time.Unix(1700000000, 0).UTC()
+	w.now = func() time.Time { return now }
+
+	soc := &webhookReceiver{secret: "segredo", at: now}
+	srv := httptest.NewServer(soc)
+	defer srv.Close()
+	_, err = w.Subscribe(WebhookSubscription{URL: srv.URL, Secret: "segredo"})
+	require.NoError(t, err)
+	require.NoError(t, w.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).Put(webhookKey(1<<40), []byte("{quebrado"))
+	}))
+	require.NoError(t, w.Publish(AuditEntry{Event: AuditLockout, Account: "Brisa:ana"}))
+
+	// Uma entrada ilegível vai para os mortos sem parar as demais entregas.
+	_, err = w.deliverDue(context.Background(), now)
+	require.NoError(t, err)
+	require.Len(t, soc.received(), 1)
+	dead, err := w.DeadLetters()
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, uint64(1<<40), dead[0].Seq)
+	require.Contains(t, dead[0].LastError, "entrada ilegível")
+	require.NoError(t, w.Discard(dead[0].Seq))
+}
+
+// syncBuffer é um bytes.Buffer que pode ser lido enquanto outra goroutine escreve.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestWebhooksRunKeepsGoing(t *testing.T) {
+	var logs syncBuffer
+	w, err := OpenWebhooks(filepath.Join(t.TempDir(), "webhooks.db"), WebhookOtp{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	require.NoError(t, err)
+	require.NoError(t, w.db.Close())
+
+	// Com o banco fora do ar Run registra o erro e espera, em vez de terminar.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	require.Eventually(t, func() bool { return strings.Contains(logs.String(), "falha ao entregar a fila") }, time.Second, 5*time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Run terminou: %v", err)
+	default:
+	}
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestWebhooksHTTP(t *testing.T) {
+	w, err := OpenWebhooks(filepath.Join(t.TempDir(), "webhooks.db"), WebhookOtp{})
+	require.NoError(t, err)
+	defer w.Close()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	require.Equal(t, http.StatusBadRequest, do("POST", "/subscriptions", `{"url":"nada"}`).Code)
+	rec := do("POST", "/subscriptions", `{"url":"https://soc.example.com/otp","events":["lockout"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var s WebhookSubscription
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s))
+	require.NotEmpty(t, s.Secret)
+	require.Equal(t, []AuditEvent{AuditLockout}, s.Events)
+
+	rec = do("GET", "/subscriptions", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), s.Secret)
+	require.Contains(t, rec.Body.String(), s.ID)
+
+	require.Equal(t, http.StatusOK, do("GET", "/dead", "").Code)
+	require.Equal(t, http.StatusNotFound, do("POST", "/dead/7", "").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, do("PUT", "/subscriptions", "").Code)
+	require.Equal(t, http.StatusNoContent, do("DELETE", "/subscriptions/"+s.ID, "").Code)
+	require.Equal(t, http.StatusNotFound, do("DELETE", "/subscriptions/"+s.ID, "").Code)
+}
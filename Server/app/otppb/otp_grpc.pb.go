@@ -0,0 +1,369 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: otp.proto
+
+// API gRPC de cadastro e validação de chaves OTP. O servidor fica em
+// otp/app/otp (GRPCServer). Para regenerar o código Go:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative otp.proto
+
+package otppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	OTP_Enroll_FullMethodName  = "/otp.v1.OTP/Enroll"
+	OTP_Confirm_FullMethodName = "/otp.v1.OTP/Confirm"
+	OTP_Verify_FullMethodName  = "/otp.v1.OTP/Verify"
+	OTP_Resync_FullMethodName  = "/otp.v1.OTP/Resync"
+	OTP_Rotate_FullMethodName  = "/otp.v1.OTP/Rotate"
+	OTP_Delete_FullMethodName  = "/otp.v1.OTP/Delete"
+	OTP_GetQR_FullMethodName   = "/otp.v1.OTP/GetQR"
+)
+
+// OTPClient is the client API for OTP service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OTPClient interface {
+	// Enroll gera uma chave nova e a guarda como pendente.
+	Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error)
+	// Confirm ativa uma chave pendente com um código do aplicativo.
+	Confirm(ctx context.Context, in *ConfirmRequest, opts ...grpc.CallOption) (*ConfirmResponse, error)
+	// Verify valida um código de uma chave ativa.
+	Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error)
+	// Resync reposiciona o contador de uma chave HOTP com dois códigos seguidos.
+	Resync(ctx context.Context, in *ResyncRequest, opts ...grpc.CallOption) (*ResyncResponse, error)
+	// Rotate gera um segredo novo, aceitando os dois durante o prazo de carência.
+	Rotate(ctx context.Context, in *RotateRequest, opts ...grpc.CallOption) (*RotateResponse, error)
+	// Delete remove uma chave.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// GetQR retorna o QR code de uma chave pendente ou do segredo novo de uma rotação.
+	GetQR(ctx context.Context, in *GetQRRequest, opts ...grpc.CallOption) (*GetQRResponse, error)
+}
+
+type oTPClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOTPClient(cc grpc.ClientConnInterface) OTPClient {
+	return &oTPClient{cc}
+}
+
+func (c *oTPClient) Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EnrollResponse)
+	err := c.cc.Invoke(ctx, OTP_Enroll_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oTPClient) Confirm(ctx context.Context, in *ConfirmRequest, opts ...grpc.CallOption) (*ConfirmResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ConfirmResponse)
+	err := c.cc.Invoke(ctx, OTP_Confirm_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oTPClient) Verify(ctx context.Context, in *VerifyRequest, opts ...grpc.CallOption) (*VerifyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VerifyResponse)
+	err := c.cc.Invoke(ctx, OTP_Verify_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oTPClient) Resync(ctx context.Context, in *ResyncRequest, opts ...grpc.CallOption) (*ResyncResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ResyncResponse)
+	err := c.cc.Invoke(ctx, OTP_Resync_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oTPClient) Rotate(ctx context.Context, in *RotateRequest, opts ...grpc.CallOption) (*RotateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RotateResponse)
+	err := c.cc.Invoke(ctx, OTP_Rotate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oTPClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, OTP_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oTPClient) GetQR(ctx context.Context, in *GetQRRequest, opts ...grpc.CallOption) (*GetQRResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetQRResponse)
+	err := c.cc.Invoke(ctx, OTP_GetQR_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OTPServer is the server API for OTP service.
+// All implementations must embed UnimplementedOTPServer
+// for forward compatibility.
+type OTPServer interface {
+	// Enroll gera uma chave nova e a guarda como pendente.
+	Enroll(context.Context, *EnrollRequest) (*EnrollResponse, error)
+	// Confirm ativa uma chave pendente com um código do aplicativo.
+	Confirm(context.Context, *ConfirmRequest) (*ConfirmResponse, error)
+	// Verify valida um código de uma chave ativa.
+	Verify(context.Context, *VerifyRequest) (*VerifyResponse, error)
+	// Resync reposiciona o contador de uma chave HOTP com dois códigos seguidos.
+	Resync(context.Context, *ResyncRequest) (*ResyncResponse, error)
+	// Rotate gera um segredo novo, aceitando os dois durante o prazo de carência.
+	Rotate(context.Context, *RotateRequest) (*RotateResponse, error)
+	// Delete remove uma chave.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// GetQR retorna o QR code de uma chave pendente ou do segredo novo de uma rotação.
+	GetQR(context.Context, *GetQRRequest) (*GetQRResponse, error)
+	mustEmbedUnimplementedOTPServer()
+}
+
+// UnimplementedOTPServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedOTPServer struct{}
+
+func (UnimplementedOTPServer) Enroll(context.Context, *EnrollRequest) (*EnrollResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Enroll not implemented")
+}
+func (UnimplementedOTPServer) Confirm(context.Context, *ConfirmRequest) (*ConfirmResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Confirm not implemented")
+}
+func (UnimplementedOTPServer) Verify(context.Context, *VerifyRequest) (*VerifyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Verify not implemented")
+}
+func (UnimplementedOTPServer) Resync(context.Context, *ResyncRequest) (*ResyncResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resync not implemented")
+}
+func (UnimplementedOTPServer) Rotate(context.Context, *RotateRequest) (*RotateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Rotate not implemented")
+}
+func (UnimplementedOTPServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedOTPServer) GetQR(context.Context, *GetQRRequest) (*GetQRResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetQR not implemented")
+}
+func (UnimplementedOTPServer) mustEmbedUnimplementedOTPServer() {}
+func (UnimplementedOTPServer) testEmbeddedByValue()             {}
+
+// UnsafeOTPServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OTPServer will
+// result in compilation errors.
+type UnsafeOTPServer interface {
+	mustEmbedUnimplementedOTPServer()
+}
+
+func RegisterOTPServer(s grpc.ServiceRegistrar, srv OTPServer) {
+	// If the following call pancis, it indicates UnimplementedOTPServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&OTP_ServiceDesc, srv)
+}
+
+func _OTP_Enroll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnrollRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OTPServer).Enroll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OTP_Enroll_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OTPServer).Enroll(ctx, req.(*EnrollRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OTP_Confirm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfirmRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OTPServer).Confirm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OTP_Confirm_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OTPServer).Confirm(ctx, req.(*ConfirmRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OTP_Verify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OTPServer).Verify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OTP_Verify_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OTPServer).Verify(ctx, req.(*VerifyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OTP_Resync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResyncRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OTPServer).Resync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OTP_Resync_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OTPServer).Resync(ctx, req.(*ResyncRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OTP_Rotate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OTPServer).Rotate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OTP_Rotate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OTPServer).Rotate(ctx, req.(*RotateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OTP_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OTPServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OTP_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OTPServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OTP_GetQR_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetQRRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OTPServer).GetQR(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OTP_GetQR_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OTPServer).GetQR(ctx, req.(*GetQRRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// OTP_ServiceDesc is the grpc.ServiceDesc for OTP service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OTP_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "otp.v1.OTP",
+	HandlerType: (*OTPServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Enroll",
+			Handler:    _OTP_Enroll_Handler,
+		},
+		{
+			MethodName: "Confirm",
+			Handler:    _OTP_Confirm_Handler,
+		},
+		{
+			MethodName: "Verify",
+			Handler:    _OTP_Verify_Handler,
+		},
+		{
+			MethodName: "Resync",
+			Handler:    _OTP_Resync_Handler,
+		},
+		{
+			MethodName: "Rotate",
+			Handler:    _OTP_Rotate_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _OTP_Delete_Handler,
+		},
+		{
+			MethodName: "GetQR",
+			Handler:    _OTP_GetQR_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "otp.proto",
+}
@@ -0,0 +1,68 @@
+// Comando otpaudit confere um arquivo de auditoria encadeado (ver app.AuditChain).
+//
+//	otpaudit verify [-key-file arquivo] audit.chain
+//
+// A chave de auditoria é lida em hexadecimal de -key-file ou da variável
+// OTP_AUDIT_KEY. Sai com status 1 se a cadeia foi adulterada.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	app "otp/app/otp"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "verify" {
+		fmt.Fprintln(os.Stderr, "uso: otpaudit verify [-key-file arquivo] audit.chain")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "arquivo com a chave de auditoria em hexadecimal")
+	fs.Parse(os.Args[2:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	key, err := readKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "otpaudit:", err)
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "otpaudit:", err)
+		os.Exit(2)
+	}
+	defer f.Close()
+
+	n, last, err := app.VerifyAuditChain(f, key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "otpaudit: %v (%d entradas válidas)\n", err, n)
+		os.Exit(1)
+	}
+	fmt.Printf("%d entradas, último hash %s\n", n, last)
+}
+
+func readKey(path string) ([]byte, error) {
+	s := os.Getenv("OTP_AUDIT_KEY")
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("chave de auditoria não definida (use -key-file ou OTP_AUDIT_KEY)")
+	}
+	return hex.DecodeString(s)
+}
@@ -0,0 +1,54 @@
+// Comando otpgrpc serve a API gRPC otp.v1.OTP com as chaves em um arquivo JSON.
+// Os clientes se autenticam com "authorization: Bearer <token>"; o arquivo de
+// tokens é um objeto JSON de token para nome do cliente.
+//
+//	otpgrpc -addr :9090 -store keys.json -tokens tokens.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+
+	app "otp/app/otp"
+	"otp/app/otppb"
+)
+
+func main() {
+	addr := flag.String("addr", ":9090", "endereço de escuta")
+	path := flag.String("store", "keys.json", "arquivo de chaves")
+	tokensPath := flag.String("tokens", "", "arquivo JSON de tokens dos clientes (obrigatório)")
+	flag.Parse()
+
+	if *tokensPath == "" {
+		log.Fatal("-tokens é obrigatório")
+	}
+	raw, err := os.ReadFile(*tokensPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tokens map[string]string
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := app.NewFileStore(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	enroll := app.NewEnrollment(store, app.EnrollOtp{Verify: app.VerifyOtp{Skew: 1, LookAhead: 3}})
+	verify := app.NewVerifier(store, app.VerifyOtp{Skew: 1, LookAhead: 3})
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(app.GRPCAuth(app.GRPCTokens(tokens))))
+	otppb.RegisterOTPServer(s, app.NewGRPCServer(enroll, verify))
+	log.Printf("otpgrpc escutando em %s", lis.Addr())
+	log.Fatal(s.Serve(lis))
+}
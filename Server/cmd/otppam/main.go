@@ -0,0 +1,197 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+// Comando otppam valida códigos do ~/.google_authenticator via pam_exec,
+// substituindo o módulo pam_google_authenticator:
+//
+//	auth required pam_exec.so expose_authtok quiet /usr/local/sbin/otppam
+//
+// O usuário vem de PAM_USER e o código da entrada padrão. Depois de cada
+// tentativa o arquivo é regravado com o estado de RATE_LIMIT, DISALLOW_REUSE,
+// HOTP_COUNTER e dos scratch codes, com um flock em "<arquivo>.lock" do início
+// da leitura até o rename, para que autenticações simultâneas não percam
+// contadores ou aceitem o mesmo código. Sai com 0 se o código for aceito.
+//
+// Executado como root, o comando assume o uid e o gid do usuário antes de
+// tocar no diretório dele. Como o pam_google_authenticator, recusa um arquivo
+// que não seja do usuário, que outros possam ler ou que seja um link simbólico.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	app "otp/app/otp"
+)
+
+func main() {
+	path := flag.String("file", "%h/.google_authenticator", "arquivo do usuário; %u é o usuário e %h o diretório dele")
+	nullok := flag.Bool("nullok", false, "aceita usuários sem arquivo")
+	flag.Parse()
+
+	if t := os.Getenv("PAM_TYPE"); t != "" && t != "auth" {
+		os.Exit(0)
+	}
+	if err := run(*path, *nullok); err != nil {
+		fmt.Fprintln(os.Stderr, "otppam:", err)
+		os.Exit(1)
+	}
+}
+
+func run(path string, nullok bool) error {
+	name := os.Getenv("PAM_USER")
+	if name == "" {
+		return errors.New("PAM_USER não definido")
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	path = strings.NewReplacer("%u", u.Username, "%h", u.HomeDir).Replace(path)
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if err := dropPrivileges(uid, gid); err != nil {
+		return err
+	}
+
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := readSecret(path, uid)
+	if errors.Is(err, os.ErrNotExist) && nullok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := app.ParseGoogleAuth(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	// pam_exec termina o token com NUL.
+	in, err := io.ReadAll(io.LimitReader(os.Stdin, 512))
+	if err != nil {
+		return err
+	}
+	code, _, _ := strings.Cut(string(in), "\x00")
+
+	_, verr := f.Verify(strings.TrimSpace(code), time.Now())
+	if err := save(path, f); err != nil {
+		return err
+	}
+	return verr
+}
+
+// dropPrivileges troca o processo, se for root, para uid e gid. Desde o Go 1.16
+// Setuid e Setgid valem para todas as threads.
+func dropPrivileges(uid, gid int) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// readSecret lê path sem seguir links simbólicos e confere, no arquivo aberto,
+// que ele é de uid e não pode ser lido por grupo ou outros.
+func readSecret(path string, uid int) ([]byte, error) {
+	fd, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s não é um arquivo comum", path)
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); !ok || int(sys.Uid) != uid {
+		return nil, fmt.Errorf("%s não pertence ao usuário", path)
+	}
+	if st.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s tem permissões %o, mais abertas que 0600", path, st.Mode().Perm())
+	}
+	return io.ReadAll(fd)
+}
+
+// lock bloqueia até obter o flock exclusivo de path+".lock" e retorna a função
+// que o libera. O arquivo de lock não segue links simbólicos.
+func lock(path string) (func(), error) {
+	l, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(l.Fd()), syscall.LOCK_EX); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(l.Fd()), syscall.LOCK_UN)
+		l.Close()
+	}, nil
+}
+
+// save regrava path de forma atômica, mantendo as permissões; o processo já
+// roda como o dono. Deve ser chamado com o lock de path: um arquivo temporário
+// que já exista sobrou de uma execução interrompida e é descartado.
+func save(path string, f *app.GoogleAuthFile) error {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + "~"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := f.WriteTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}